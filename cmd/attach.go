@@ -0,0 +1,60 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/89luca89/lilipod/pkg/constants"
+	"github.com/89luca89/lilipod/pkg/containerutils"
+	"github.com/89luca89/lilipod/pkg/fileutils"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/spf13/cobra"
+)
+
+// NewAttachCommand will attach to the console of a running container.
+func NewAttachCommand() *cobra.Command {
+	attachCommand := &cobra.Command{
+		Use:              "attach [flags] CONTAINER",
+		Short:            "Attach to a running container",
+		PreRunE:          logging.Init,
+		RunE:             attach,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	attachCommand.Flags().SetInterspersed(false)
+	attachCommand.Flags().BoolP("help", "h", false, "show help")
+	attachCommand.Flags().Bool("no-stdin", false, "do not attach STDIN")
+	attachCommand.Flags().String("detach-keys", constants.DefaultDetachKeys,
+		"key sequence to detach from the container, an empty value disables it")
+
+	return attachCommand
+}
+
+func attach(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) < 1 {
+		return cmd.Help()
+	}
+
+	noStdin, err := cmd.Flags().GetBool("no-stdin")
+	if err != nil {
+		return err
+	}
+
+	detachKeys, err := cmd.Flags().GetString("detach-keys")
+	if err != nil {
+		return err
+	}
+
+	container := arguments[0]
+
+	if !fileutils.Exist(containerutils.GetDir(container)) {
+		return fmt.Errorf("container %s does not exist", container)
+	}
+
+	logging.LogDebug("attaching to: %s", container)
+
+	// the container's exit code becomes ours, unless we detach
+	return containerutils.Attach(container, !noStdin, detachKeys)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/logging"
 	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -51,22 +52,24 @@ func cp(cmd *cobra.Command, arguments []string) error {
 		container := strings.Split(src, ":")[0]
 		file := strings.Split(src, ":")[1]
 
-		src = filepath.Join(containerutils.GetRootfsDir(container), file)
-
-		if !fileutils.Exist(containerutils.GetDir(container)) {
+		config, err := utils.LoadConfig(filepath.Join(containerutils.GetDir(container), "config"))
+		if err != nil {
 			return fmt.Errorf("container %s does not exist", container)
 		}
+
+		src = containerutils.GetRootfsPath(config, file, false)
 	}
 
 	if strings.Contains(dest, ":") {
 		container := strings.Split(dest, ":")[0]
 		file := strings.Split(dest, ":")[1]
 
-		dest = filepath.Join(containerutils.GetRootfsDir(container), file)
-
-		if !fileutils.Exist(containerutils.GetDir(container)) {
+		config, err := utils.LoadConfig(filepath.Join(containerutils.GetDir(container), "config"))
+		if err != nil {
 			return fmt.Errorf("container %s does not exist", container)
 		}
+
+		dest = containerutils.GetRootfsPath(config, file, true)
 	}
 
 	return fileutils.CopyFileContainer(src, dest)
@@ -2,17 +2,22 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/89luca89/lilipod/pkg/cgrouputils"
 	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/containerutils"
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/imageutils"
 	"github.com/89luca89/lilipod/pkg/logging"
 	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/securityutils"
 	"github.com/89luca89/lilipod/pkg/utils"
 	imgName "github.com/google/go-containerregistry/pkg/name"
 	"github.com/spf13/cobra"
@@ -31,37 +36,91 @@ func NewCreateCommand() *cobra.Command {
 	}
 
 	createCommand.Flags().SetInterspersed(false)
-	createCommand.Flags().Bool("help", false, "show help")
-	createCommand.Flags().Bool("privileged", false, "give extended privileges to the container")
-	createCommand.Flags().Bool("pull", false, "pull image before running")
-	createCommand.Flags().String("cgroupns", constants.Private, "cgroup namespace to use")
-	createCommand.Flags().String("entrypoint", "", "overwrite command to execute when starting the container")
-	createCommand.Flags().String("ipc", constants.Private, "IPC namespace to use")
-	createCommand.Flags().String("name", containerutils.GetRandomName(), "Assign a name to the container")
-	createCommand.Flags().String("network", constants.Private, "connect a container to a network")
-	createCommand.Flags().String("pid", constants.Private, "pid namespace to use")
-	createCommand.Flags().String("time", constants.Private, "time namespace to use")
-	createCommand.Flags().String("userns", constants.KeepID, "user namespace to use")
-	createCommand.Flags().String("stop-signal", "SIGTERM", "signal to stop the container")
-	//nolint:lll
-	createCommand.Flags().StringArrayP("env", "e", nil, "set environment variables in container (default [PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin,TERM=xterm])")
-	createCommand.Flags().StringArrayP("label", "", nil, "set metadata on container")
-	createCommand.Flags().StringArrayP("volume", "v", nil, "bind mount a volume into the container")
-	createCommand.Flags().StringArrayP("mount", "", nil, "perform a mount into the container")
-	createCommand.Flags().StringP("hostname", "h", "", "set container hostname")
-	createCommand.Flags().StringP("user", "u", "root:root", "username or UID (format: <name|uid>[:<group|gid>])")
-
-	// This does nothing, it's here for CLI compatibility with podman/docker
-	createCommand.Flags().String("security-opt", "", "")
-	createCommand.Flags().String("pids-limit", "", "")
-	_ = createCommand.Flags().MarkHidden("security-opt")
-	_ = createCommand.Flags().MarkHidden("pids-limit")
+	addCreateFlags(createCommand)
 
 	return createCommand
 }
 
+// addCreateFlags will add the flags shared by create and run to input command.
+func addCreateFlags(command *cobra.Command) {
+	command.Flags().Bool("help", false, "show help")
+	command.Flags().Bool("privileged", false, "give extended privileges to the container")
+	command.Flags().Bool("init", false, "run an init inside the container that forwards signals and reaps processes")
+	command.Flags().Bool("env-host", false, "pass the host environment to the container")
+	command.Flags().Bool("no-healthcheck", false, "disable the healthcheck of the image")
+	command.Flags().Bool("passwd", true, "add the host user to the container's /etc/passwd and /etc/group with userns keep-id")
+	command.Flags().Bool("sudo", false, "allow the host user added by --passwd to use sudo without password")
+	command.Flags().Bool("pull", false, "pull image before running")
+	command.Flags().Bool("rm", false, "delete container at the end of execution")
+	command.Flags().String("cgroupns", constants.Private, "cgroup namespace to use")
+	command.Flags().String("entrypoint", "",
+		"overwrite the default entrypoint of the image, as a command or a JSON array")
+	command.Flags().String("health-cmd", "",
+		"command to check the container's health, as a shell command or a JSON array")
+	command.Flags().Duration("health-interval", 0, "time between healthchecks (default from image, or 30s)")
+	command.Flags().String("health-on-failure", utils.HealthActionNone,
+		"action to take when the container becomes unhealthy (none, kill, restart, stop)")
+	command.Flags().Int("health-retries", 0,
+		"consecutive failed healthchecks needed to be unhealthy (default from image, or 3)")
+	command.Flags().Duration("health-start-period", 0, "time for the container to start, before failed healthchecks count")
+	command.Flags().Duration("health-timeout", 0, "time after which a healthcheck is failed (default from image, or 30s)")
+	command.Flags().Float64("cpus", 0, "number of CPUs the container can use, like 1.5")
+	command.Flags().Uint64("cpu-weight", 0,
+		"relative CPU weight of the container, between 1 and 10000 (default 100)")
+	command.Flags().String("cpuset-cpus", "", "CPUs the container can run on, like 0-2,4")
+	command.Flags().String("ipc", constants.Private, "IPC namespace to use")
+	command.Flags().String("name", containerutils.GetRandomName(), "Assign a name to the container")
+	command.Flags().Uint64("io-weight", 0,
+		"relative IO weight of the container, between 1 and 10000 (default 100)")
+	command.Flags().StringP("memory", "m", "", "memory limit of the container, like 512m or 2g")
+	command.Flags().String("memory-swap", "", "memory plus swap limit of the container, -1 for unlimited swap")
+	command.Flags().String("network", constants.Private, "connect a container to a network")
+	command.Flags().String("pid", constants.Private, "pid namespace to use")
+	command.Flags().Int64("pids-limit", 0, "maximum number of processes in the container, -1 for unlimited")
+	command.Flags().String("restart", constants.RestartNo,
+		"restart policy to apply when the container exits (no, on-failure[:N], always, unless-stopped)")
+	command.Flags().String("rootfs", "",
+		"use an existing directory as rootfs instead of an IMAGE, it is modified by the container "+
+			"unless :O is appended to mount it as overlay lower dir")
+	command.Flags().String("time", constants.Private, "time namespace to use")
+	command.Flags().String("time-offset", "",
+		"offset the clocks of the private time namespace, as monotonic=SECONDS,boottime=SECONDS")
+	command.Flags().String("userns", constants.KeepID, "user namespace to use")
+	command.Flags().String("systemd", constants.TrueString,
+		"run the container in systemd mode (true, false, always), true enables it if the command is systemd or init")
+	command.Flags().String("stop-signal", "",
+		"signal to stop the container (default SIGRTMIN+3 for systemd, from image, or SIGTERM)")
+	command.Flags().String("tz", "", "set the container's timezone, like Europe/Rome, or local for the host's one")
+	command.Flags().String("umask", "", "set the umask of the container's processes, in octal (default 0022)")
+	command.Flags().Int("oom-score-adj", 0, "tune the container's OOM score adjustment, between -1000 and 1000")
+	command.Flags().Int("stop-timeout", constants.DefaultStopTimeout,
+		"seconds to wait for the container to stop before killing it, 0 to kill it right away")
+	//nolint:lll
+	command.Flags().StringArrayP("env", "e", nil, "set environment variables in container (default [PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin,TERM=xterm])")
+	command.Flags().StringArrayP("env-file", "", nil, "read environment variables from a file, one per line")
+	command.Flags().StringArrayP("group-add", "", nil, "add additional groups to the container's user")
+	command.Flags().StringArrayP("label", "", nil, "set metadata on container")
+	command.Flags().StringArrayP("log-opt", "", nil, "logging options: max-size=SIZE, max-file=N")
+	command.Flags().StringArrayP("volume", "v", nil, "bind mount a volume into the container")
+	command.Flags().StringArrayP("mount", "", nil, "perform a mount into the container")
+	command.Flags().StringArrayP("sysctl", "", nil, "set namespaced kernel parameters in the container (key=value)")
+	command.Flags().StringArrayP("ulimit", "", nil,
+		"set resource limits in the container, as name=soft[:hard], like nofile=1024:2048")
+	command.Flags().StringArrayP("unsetenv", "", nil, "unset default environment variables in container")
+	command.Flags().StringP("hostname", "h", "", "set container hostname")
+	command.Flags().StringP("user", "u", "",
+		"username or UID (format: <name|uid>[:<group|gid>]) (default from image, or root:root)")
+	command.Flags().StringP("workdir", "w", "", "working directory inside the container (default from image, or /)")
+
+	command.Flags().StringArray("cap-add", nil, "add capabilities to the container, or ALL")
+	command.Flags().StringArray("cap-drop", nil, "drop capabilities from the container, or ALL")
+	command.Flags().StringArray("security-opt", nil,
+		"set security options: seccomp=PATH|unconfined, landlock=PATH, no-new-privileges, "+
+			"mask=PATH[:PATH...], unmask=ALL|PATH[:PATH...], label=VALUE")
+}
+
 func create(cmd *cobra.Command, arguments []string) error {
-	if len(arguments) < 1 {
+	if len(arguments) < 1 && !cmd.Flags().Lookup("rootfs").Changed {
 		return cmd.Help()
 	}
 
@@ -74,89 +133,355 @@ func create(cmd *cobra.Command, arguments []string) error {
 		return nil
 	}
 
-	pull, err := cmd.Flags().GetBool("pull")
+	name, err := createContainer(cmd)
 	if err != nil {
 		return err
 	}
 
+	fmt.Println(containerutils.GetID(name))
+
+	return nil
+}
+
+// createContainer will create the container set with the flags shared by create
+// and run, returning its name.
+func createContainer(cmd *cobra.Command) (string, error) {
+	pull, err := cmd.Flags().GetBool("pull")
+	if err != nil {
+		return "", err
+	}
+
 	privileged, err := cmd.Flags().GetBool("privileged")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	initProcess, err := cmd.Flags().GetBool("init")
+	if err != nil {
+		return "", err
+	}
+
+	passwd, err := cmd.Flags().GetBool("passwd")
+	if err != nil {
+		return "", err
+	}
+
+	sudo, err := cmd.Flags().GetBool("sudo")
+	if err != nil {
+		return "", err
 	}
 
 	hostname, err := cmd.Flags().GetString("hostname")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	ipc, err := cmd.Flags().GetString("ipc")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	name, err := cmd.Flags().GetString("name")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	network, err := cmd.Flags().GetString("network")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	cgroup, err := cmd.Flags().GetString("cgroupns")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	timens, err := cmd.Flags().GetString("time")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	timeOffset, err := cmd.Flags().GetString("time-offset")
+	if err != nil {
+		return "", err
+	}
+
+	var timeOffsets map[string]int64
+
+	if timeOffset != "" {
+		if timens != constants.Private {
+			return "", fmt.Errorf("time offsets require a private time namespace")
+		}
+
+		timeOffsets, err = procutils.ParseTimeOffsets(timeOffset)
+		if err != nil {
+			return "", err
+		}
+
+		err = procutils.CheckTimeOffsets()
+		if err != nil {
+			return "", err
+		}
 	}
 
 	pid, err := cmd.Flags().GetString("pid")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	user, err := cmd.Flags().GetString("user")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	workdir, err := cmd.Flags().GetString("workdir")
+	if err != nil {
+		return "", err
 	}
 
 	userns, err := cmd.Flags().GetString("userns")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	stopsignal, err := cmd.Flags().GetString("stop-signal")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if stopsignal != "" {
+		_, err = procutils.ParseSignal(stopsignal)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var stopTimeout *int
+
+	if cmd.Flags().Lookup("stop-timeout").Changed {
+		timeout, err := cmd.Flags().GetInt("stop-timeout")
+		if err != nil {
+			return "", err
+		}
+
+		if timeout < 0 {
+			return "", fmt.Errorf("invalid stop timeout %d, must be 0 or more", timeout)
+		}
+
+		stopTimeout = &timeout
+	}
+
+	systemd, err := cmd.Flags().GetString("systemd")
+	if err != nil {
+		return "", err
+	}
+
+	if !slices.Contains([]string{constants.TrueString, "false", constants.SystemdAlways}, systemd) {
+		return "", fmt.Errorf("invalid systemd mode %s, must be true, false or always", systemd)
+	}
+
+	ulimits, err := cmd.Flags().GetStringArray("ulimit")
+	if err != nil {
+		return "", err
+	}
+
+	for _, ulimit := range ulimits {
+		_, err = procutils.ParseUlimit(ulimit)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	sysctl, err := cmd.Flags().GetStringArray("sysctl")
+	if err != nil {
+		return "", err
+	}
+
+	for _, value := range sysctl {
+		if !strings.Contains(value, "=") {
+			return "", fmt.Errorf("invalid sysctl %s, must be key=value", value)
+		}
+	}
+
+	sysctls := utils.ListToMap(sysctl)
+	for key := range sysctls {
+		err = procutils.ValidateSysctl(key, ipc, network)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	umask, err := cmd.Flags().GetString("umask")
+	if err != nil {
+		return "", err
+	}
+
+	if umask != "" {
+		_, err = procutils.ParseUmask(umask)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// nil means the OOM score adjustment is inherited
+	var oomScoreAdj *int
+
+	if cmd.Flags().Lookup("oom-score-adj").Changed {
+		score, err := cmd.Flags().GetInt("oom-score-adj")
+		if err != nil {
+			return "", err
+		}
+
+		err = procutils.ValidateOomScoreAdj(score)
+		if err != nil {
+			return "", err
+		}
+
+		oomScoreAdj = &score
+	}
+
+	timezone, err := cmd.Flags().GetString("tz")
+	if err != nil {
+		return "", err
+	}
+
+	if timezone != "" {
+		_, err = fileutils.GetZoneinfo(timezone)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	entrypoint, err := cmd.Flags().GetString("entrypoint")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	env, err := cmd.Flags().GetStringArray("env")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	envFile, err := cmd.Flags().GetStringArray("env-file")
+	if err != nil {
+		return "", err
+	}
+
+	envHost, err := cmd.Flags().GetBool("env-host")
+	if err != nil {
+		return "", err
+	}
+
+	unsetenv, err := cmd.Flags().GetStringArray("unsetenv")
+	if err != nil {
+		return "", err
+	}
+
+	configEnv, err := utils.ConfigEnv()
+	if err != nil {
+		return "", err
+	}
+
+	env, err = utils.ResolveEnv(configEnv, envHost, envFile, env)
+	if err != nil {
+		return "", err
 	}
 
 	label, err := cmd.Flags().GetStringArray("label")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	groupAdd, err := cmd.Flags().GetStringArray("group-add")
+	if err != nil {
+		return "", err
 	}
 
 	volume, err := cmd.Flags().GetStringArray("volume")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	mount, err := cmd.Flags().GetStringArray("mount")
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	rootfs, err := cmd.Flags().GetString("rootfs")
+	if err != nil {
+		return "", err
+	}
+
+	restart, err := cmd.Flags().GetString("restart")
+	if err != nil {
+		return "", err
+	}
+
+	restartPolicy, _, err := utils.ParseRestartPolicy(restart)
+	if err != nil {
+		return "", err
+	}
+
+	healthcheck, err := getHealthcheck(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	capabilities, capAdd, capDrop, err := getCapabilities(cmd, privileged)
+	if err != nil {
+		return "", err
+	}
+
+	securityOpt, err := cmd.Flags().GetStringArray("security-opt")
+	if err != nil {
+		return "", err
+	}
+
+	security, err := securityutils.ParseSecurityOptions(securityOpt)
+	if err != nil {
+		return "", err
+	}
+
+	resources, err := getResources(cmd, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if resources != nil {
+		err = cgrouputils.Check(*resources)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	healthOnFailure, err := cmd.Flags().GetString("health-on-failure")
+	if err != nil {
+		return "", err
+	}
+
+	switch healthOnFailure {
+	case utils.HealthActionNone, utils.HealthActionKill, utils.HealthActionRestart, utils.HealthActionStop:
+	default:
+		return "", fmt.Errorf("invalid health-on-failure action %s, use one of none, kill, restart, stop", healthOnFailure)
+	}
+
+	logOpt, err := cmd.Flags().GetStringArray("log-opt")
+	if err != nil {
+		return "", err
+	}
+
+	logMaxSize, logMaxFiles, err := utils.ParseLogOptions(logOpt)
+	if err != nil {
+		return "", err
+	}
+
+	remove, err := cmd.Flags().GetBool("rm")
+	if err != nil {
+		return "", err
+	}
+
+	if remove && restartPolicy != constants.RestartNo {
+		return "", fmt.Errorf("the --rm option conflicts with --restart")
 	}
 
 	// default hostname to name if not specified.
@@ -164,76 +489,295 @@ func create(cmd *cobra.Command, arguments []string) error {
 		hostname = name
 	}
 
-	image := cmd.Flags().Args()[0]
+	var image, rootfsMode string
 
-	if pull {
-		logging.LogDebug("pulling image: %s", image)
+	args := cmd.Flags().Args()
 
-		_, err := imageutils.Pull(image, false)
+	if rootfs != "" {
+		image, rootfsMode, err = containerutils.ParseRootfs(rootfs)
 		if err != nil {
-			return err
+			return "", err
 		}
-	}
+	} else {
+		image = args[0]
+		args = args[1:]
 
-	if !fileutils.Exist(imageutils.GetPath(image)) {
-		ref, err := imgName.ParseReference(image)
-		if err == nil {
-			image = ref.Name()
+		if pull {
+			logging.LogDebug("pulling image: %s", image)
+
+			_, err := imageutils.Pull(image, false)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if !fileutils.Exist(imageutils.GetPath(image)) {
+			ref, err := imgName.ParseReference(image)
+			if err == nil {
+				image = ref.Name()
+			}
 		}
 	}
 
-	args := cmd.Flags().Args()[1:]
 	if len(args) == 0 {
 		args = nil
 	}
 
-	configEntrypoint := []string{}
-	if entrypoint != "" {
-		configEntrypoint = append(configEntrypoint, entrypoint)
+	// nil means the image's entrypoint is used
+	var configEntrypoint []string
+	if cmd.Flags().Lookup("entrypoint").Changed {
+		configEntrypoint = containerutils.ParseEntrypoint(entrypoint)
 	}
 
 	if os.Getenv("ROOTFUL") == constants.TrueString && userns == constants.KeepID {
-		return fmt.Errorf("cannot use userns=keep-id in rootful mode, use private for it")
+		return "", fmt.Errorf("cannot use userns=keep-id in rootful mode, use private for it")
 	}
 
 	uid := os.Getenv("PARENT_UID_MAP")
 	gid := os.Getenv("PARENT_GID_MAP")
 
 	createConfig := utils.Config{
-		ID:         containerutils.GetID(name),
-		Env:        env,
-		Cgroup:     cgroup,
-		Created:    time.Now().Format("2006.01.02 15:04:05"),
-		Hostname:   hostname,
-		Image:      image,
-		Ipc:        ipc,
-		Names:      name,
-		Network:    network,
-		Pid:        pid,
-		Privileged: privileged,
-		Time:       timens,
-		User:       user,
-		Userns:     userns,
-		Workdir:    "/",
-		Stopsignal: stopsignal,
-		Mounts:     append(mount, volume...),
-		Labels:     utils.ListToMap(label),
+		ID:          containerutils.GetID(name),
+		Env:         env,
+		Unsetenv:    unsetenv,
+		Cgroup:      cgroup,
+		Created:     time.Now().Format("2006.01.02 15:04:05"),
+		Hostname:    hostname,
+		Image:       image,
+		Rootfs:      rootfsMode,
+		Ipc:         ipc,
+		Names:       name,
+		Network:     network,
+		Passwd:      passwd,
+		Sudo:        sudo,
+		Pid:         pid,
+		Privileged:  privileged,
+		Init:        initProcess,
+		Time:        timens,
+		TimeOffsets: timeOffsets,
+		User:        user,
+		GroupAdd:    groupAdd,
+		Userns:      userns,
+		Workdir:     workdir,
+		Stopsignal:  stopsignal,
+		StopTimeout: stopTimeout,
+		Systemd:     systemd,
+		Mounts:      append(mount, volume...),
+		Labels:      utils.ListToMap(label),
+		AutoRemove:  remove,
+		Restart:     restart,
+		LogMaxSize:  logMaxSize,
+		LogMaxFiles: logMaxFiles,
 		// entry point related
-		Entrypoint: append(configEntrypoint, args...),
+		Entrypoint: args,
+		// health related
+		Healthcheck:     healthcheck,
+		HealthOnFailure: healthOnFailure,
+		// process related
+		Ulimits:     ulimits,
+		Sysctls:     sysctls,
+		Umask:       umask,
+		OomScoreAdj: oomScoreAdj,
+		Timezone:    timezone,
+		// resources related
+		Resources: resources,
+		// security related
+		SecurityOpt:     securityOpt,
+		Seccomp:         security.Seccomp,
+		Landlock:        security.Landlock,
+		NoNewPrivileges: security.NoNewPrivileges,
+		Mask:            security.Mask,
+		Unmask:          security.Unmask,
+		Capabilities:    capabilities,
+		CapAdd:          capAdd,
+		CapDrop:         capDrop,
 	}
 
 	if fileutils.Exist(filepath.Join(containerutils.GetDir(name), "config")) {
-		return fmt.Errorf("container %s already exists", name)
+		return "", fmt.Errorf("container %s already exists", name)
 	}
 
 	logging.LogDebug("preparing rootfs for: %s", name)
 
-	err = containerutils.CreateRootfs(image, name, createConfig, uid, gid)
+	err = containerutils.CreateRootfs(image, name, createConfig, configEntrypoint, uid, gid)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	fmt.Println(containerutils.GetID(name))
+	return name, nil
+}
 
-	return nil
+// getHealthcheck returns the healthcheck set with the health flags, nil if none
+// is set. Unset fields are taken from the image's healthcheck.
+func getHealthcheck(cmd *cobra.Command) (*utils.Healthcheck, error) {
+	healthcheck := &utils.Healthcheck{}
+
+	noHealthcheck, err := cmd.Flags().GetBool("no-healthcheck")
+	if err != nil {
+		return nil, err
+	}
+
+	healthCmd, err := cmd.Flags().GetString("health-cmd")
+	if err != nil {
+		return nil, err
+	}
+
+	healthcheck.Interval, err = cmd.Flags().GetDuration("health-interval")
+	if err != nil {
+		return nil, err
+	}
+
+	healthcheck.Retries, err = cmd.Flags().GetInt("health-retries")
+	if err != nil {
+		return nil, err
+	}
+
+	healthcheck.StartPeriod, err = cmd.Flags().GetDuration("health-start-period")
+	if err != nil {
+		return nil, err
+	}
+
+	healthcheck.Timeout, err = cmd.Flags().GetDuration("health-timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case noHealthcheck:
+		return &utils.Healthcheck{Test: []string{"NONE"}}, nil
+	case strings.HasPrefix(healthCmd, "["):
+		err = json.Unmarshal([]byte(healthCmd), &healthcheck.Test)
+		if err != nil || len(healthcheck.Test) == 0 {
+			return nil, fmt.Errorf("invalid health-cmd %s", healthCmd)
+		}
+
+		healthcheck.Test = append([]string{"CMD"}, healthcheck.Test...)
+	case healthCmd != "":
+		healthcheck.Test = []string{"CMD-SHELL", healthCmd}
+	}
+
+	if len(healthcheck.Test) == 0 && healthcheck.Interval == 0 && healthcheck.Retries == 0 &&
+		healthcheck.StartPeriod == 0 && healthcheck.Timeout == 0 {
+		//nolint: nilnil
+		return nil, nil
+	}
+
+	return healthcheck, nil
+}
+
+// getCapabilities returns the capabilities of the container, and the ones added
+// and dropped with --cap-add and --cap-drop.
+func getCapabilities(cmd *cobra.Command, privileged bool) ([]string, []string, []string, error) {
+	capAdd, err := cmd.Flags().GetStringArray("cap-add")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	capDrop, err := cmd.Flags().GetStringArray("cap-drop")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	capAdd, err = securityutils.ParseCapabilities(capAdd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	capDrop, err = securityutils.ParseCapabilities(capDrop)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	capabilities, err := securityutils.GetCapabilities(capAdd, capDrop, privileged)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return capabilities, capAdd, capDrop, nil
+}
+
+// getResources returns input resource limits, nil if none, changed by the
+// resource flags set.
+func getResources(cmd *cobra.Command, current *cgrouputils.Resources) (*cgrouputils.Resources, error) {
+	resources := cgrouputils.Resources{}
+	if current != nil {
+		resources = *current
+	}
+
+	var err error
+
+	if cmd.Flags().Lookup("memory").Changed {
+		memory, err := cmd.Flags().GetString("memory")
+		if err != nil {
+			return nil, err
+		}
+
+		resources.Memory, err = utils.ParseSize(memory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Lookup("memory-swap").Changed {
+		memorySwap, err := cmd.Flags().GetString("memory-swap")
+		if err != nil {
+			return nil, err
+		}
+
+		resources.MemorySwap = -1
+
+		if memorySwap != "-1" {
+			resources.MemorySwap, err = utils.ParseSize(memorySwap)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cmd.Flags().Lookup("cpus").Changed {
+		resources.CPUs, err = cmd.Flags().GetFloat64("cpus")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Lookup("cpu-weight").Changed {
+		resources.CPUWeight, err = cmd.Flags().GetUint64("cpu-weight")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Lookup("cpuset-cpus").Changed {
+		resources.CpusetCpus, err = cmd.Flags().GetString("cpuset-cpus")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Lookup("pids-limit").Changed {
+		resources.PidsLimit, err = cmd.Flags().GetInt64("pids-limit")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Lookup("io-weight").Changed {
+		resources.IOWeight, err = cmd.Flags().GetUint64("io-weight")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = resources.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if resources.IsEmpty() {
+		//nolint: nilnil
+		return nil, nil
+	}
+
+	return &resources, nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"path/filepath"
 
+	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/containerutils"
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/logging"
@@ -30,13 +31,13 @@ func NewExecCommand() *cobra.Command {
 	execCommand.Flags().BoolP("interactive", "i", false, "keep STDIN open even if not attached")
 	execCommand.Flags().BoolP("tty", "t", false, "allocate a pseudo-TTY. The default is false")
 	//nolint:lll
+	execCommand.Flags().String("detach-keys", constants.DefaultDetachKeys,
+		"key sequence to detach from the exec session, an empty value disables it")
 	execCommand.Flags().StringArrayP("env", "e", nil, "set environment variables in container (default [PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin,TERM=xterm])")
+	execCommand.Flags().StringArrayP("env-file", "", nil, "read environment variables from a file, one per line")
 	execCommand.Flags().StringP("user", "u", "root:root", "username or UID (format: <name|uid>[:<group|gid>])")
 	execCommand.Flags().StringP("workdir", "w", "/", "working directory inside the container")
 
-	// This does nothing, it's here for CLI compatibility with podman/docker
-	execCommand.Flags().String("detach-keys", "", "")
-
 	return execCommand
 }
 
@@ -60,6 +61,11 @@ func execute(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
+	detachKeys, err := cmd.Flags().GetString("detach-keys")
+	if err != nil {
+		return err
+	}
+
 	user, err := cmd.Flags().GetString("user")
 	if err != nil {
 		return err
@@ -75,9 +81,15 @@ func execute(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
-	env = append(
-		[]string{"TERM=xterm", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
-		env...)
+	envFile, err := cmd.Flags().GetStringArray("env-file")
+	if err != nil {
+		return err
+	}
+
+	env, err = utils.ResolveEnv(nil, false, envFile, env)
+	if err != nil {
+		return err
+	}
 
 	container := cmd.Flags().Args()[0]
 	entrypoint := cmd.Flags().Args()[1:]
@@ -86,15 +98,6 @@ func execute(cmd *cobra.Command, arguments []string) error {
 		return fmt.Errorf("entrypoint command empty, please specify one")
 	}
 
-	if interactive || tty {
-		detach = false
-	}
-
-	if detach {
-		interactive = false
-		tty = false
-	}
-
 	if !fileutils.Exist(containerutils.GetDir(container)) {
 		return fmt.Errorf("container %s does not exist", container)
 	}
@@ -116,10 +119,21 @@ func execute(cmd *cobra.Command, arguments []string) error {
 
 		config.User = user
 		config.Entrypoint = entrypoint
-		config.Env = append(config.Env, env...)
+		config.Env = utils.MergeEnv(
+			[]string{"TERM=xterm", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+			config.Env,
+			env,
+		)
 		config.Workdir = workdir
 
-		err = containerutils.Exec(containerPid, interactive, tty, config)
+		opts := containerutils.ConsoleOptions{
+			Tty:         tty,
+			Interactive: interactive,
+			Attach:      !detach,
+			DetachKeys:  detachKeys,
+		}
+
+		err = containerutils.Exec(opts, config)
 		if err != nil {
 			return err
 		}
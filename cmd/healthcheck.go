@@ -0,0 +1,93 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/89luca89/lilipod/pkg/containerutils"
+	"github.com/89luca89/lilipod/pkg/fileutils"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+// NewHealthcheckCommand will manage the healthchecks of containers.
+func NewHealthcheckCommand() *cobra.Command {
+	healthcheckCommand := &cobra.Command{
+		Use:              "healthcheck [command]",
+		Short:            "Manage the healthchecks of containers",
+		PreRunE:          logging.Init,
+		RunE:             func(cmd *cobra.Command, _ []string) error { return cmd.Help() },
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	healthcheckCommand.Flags().SetInterspersed(false)
+	healthcheckCommand.Flags().BoolP("help", "h", false, "show help")
+	healthcheckCommand.AddCommand(newHealthcheckRunCommand())
+
+	return healthcheckCommand
+}
+
+// newHealthcheckRunCommand will run the healthcheck of a container.
+func newHealthcheckRunCommand() *cobra.Command {
+	runCommand := &cobra.Command{
+		Use:              "run CONTAINER",
+		Short:            "Run the healthcheck of a container",
+		PreRunE:          logging.Init,
+		RunE:             healthcheckRun,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	runCommand.Flags().SetInterspersed(false)
+	runCommand.Flags().BoolP("help", "h", false, "show help")
+
+	return runCommand
+}
+
+func healthcheckRun(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) < 1 {
+		return cmd.Help()
+	}
+
+	container := arguments[0]
+
+	configPath := filepath.Join(containerutils.GetDir(container), "config")
+	if !fileutils.Exist(configPath) {
+		return fmt.Errorf("container %s does not exist", container)
+	}
+
+	config, err := utils.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	if !config.Healthcheck.Enabled() {
+		return fmt.Errorf("container %s has no healthcheck", container)
+	}
+
+	if !containerutils.IsRunning(container) {
+		return fmt.Errorf("container %s is not running", container)
+	}
+
+	result, status, err := containerutils.RunHealthcheck(config)
+	if err != nil {
+		return err
+	}
+
+	logging.LogDebug("healthcheck output: %s", result.Output)
+
+	fmt.Println(status)
+
+	// a failed check is an error, even if the container is not unhealthy yet
+	if result.ExitCode != 0 {
+		return &procutils.ExitCodeError{Code: 1}
+	}
+
+	return nil
+}
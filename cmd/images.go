@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/imageutils"
@@ -37,11 +38,10 @@ func NewImagesCommand() *cobra.Command {
 }
 
 func images(cmd *cobra.Command, _ []string) error {
-	images, err := os.ReadDir(imageutils.ImageDir)
-	if err != nil {
+	images := imageutils.List()
+	if len(images) == 0 {
 		logging.Log("no images found")
 
-		//nolint: nilerr
 		return nil
 	}
 
@@ -71,7 +71,7 @@ func images(cmd *cobra.Command, _ []string) error {
 	}
 
 	for _, img := range images {
-		err = doImageRow(imageTable, img.Name(), quiet, notrunc, digest)
+		err = doImageRow(imageTable, img, quiet, notrunc, digest)
 		if err != nil {
 			return err
 		}
@@ -84,18 +84,28 @@ func images(cmd *cobra.Command, _ []string) error {
 	return nil
 }
 
-func doImageRow(imageTable table.Writer, image string, quiet, notrunc, digest bool) error {
+// doImageRow will add a row for the image in input path, which can be located
+// either in our own store or in one of the additional read-only image stores.
+func doImageRow(imageTable table.Writer, imagePath string, quiet, notrunc, digest bool) error {
+	image := filepath.Base(imagePath)
+
 	if quiet {
-		fmt.Println(imageutils.GetID(image))
+		fmt.Println(image)
 
 		return nil
 	}
 
-	imageFile, err := fileutils.ReadFile(filepath.Join(imageutils.ImageDir, image, "image_name"))
+	imageFile, err := fileutils.ReadFile(filepath.Join(imagePath, "image_name"))
 	if err != nil {
+		if filepath.Dir(imagePath) != filepath.Clean(imageutils.ImageDir) {
+			logging.LogWarning("found invalid image %s in read-only store, skipping", imagePath)
+
+			return nil
+		}
+
 		logging.LogWarning("found invalid image %s, cleaning up", image)
 
-		err = os.RemoveAll(imageutils.GetPath(image))
+		err = os.RemoveAll(imagePath)
 		if err != nil {
 			logging.LogError("%+v", err)
 
@@ -105,18 +115,25 @@ func doImageRow(imageTable table.Writer, image string, quiet, notrunc, digest bo
 		return nil
 	}
 
-	imageName := string(bytes.Split(imageFile, []byte(":"))[0])
-	imageTag := string(bytes.Split(imageFile, []byte(":"))[1])
+	// the tag follows the last ":" after the last "/", as registries can have
+	// a port, eg: laptop:5000/alpine:latest, images pushed by digest have none.
+	imageName, imageTag := string(imageFile), "<none>"
 
-	directorySize, err := fileutils.DiscUsageMegaBytes(filepath.Join(imageutils.ImageDir, image))
+	index := bytes.LastIndex(imageFile, []byte(":"))
+	if !bytes.Contains(imageFile, []byte("@")) && index > bytes.LastIndex(imageFile, []byte("/")) {
+		imageName = string(imageFile[:index])
+		imageTag = string(imageFile[index+1:])
+	}
+
+	imageName, _, _ = strings.Cut(imageName, "@")
+
+	directorySize, err := fileutils.DiscUsageMegaBytes(imagePath)
 	if err != nil {
 		return err
 	}
 
 	if digest {
-		checksum := fileutils.GetFileDigest(
-			filepath.Join(imageutils.GetPath(image), "manifest.json"),
-		)
+		checksum := fileutils.GetFileDigest(filepath.Join(imagePath, "manifest.json"))
 		if !notrunc {
 			checksum = checksum[:12]
 		}
@@ -126,7 +143,7 @@ func doImageRow(imageTable table.Writer, image string, quiet, notrunc, digest bo
 				imageName,
 				imageTag,
 				"sha256:" + checksum,
-				imageutils.GetID(image),
+				image,
 				directorySize,
 			},
 		)
@@ -134,7 +151,7 @@ func doImageRow(imageTable table.Writer, image string, quiet, notrunc, digest bo
 		return nil
 	}
 
-	imageTable.AppendRow([]interface{}{imageName, imageTag, imageutils.GetID(image), directorySize})
+	imageTable.AppendRow([]interface{}{imageName, imageTag, image, directorySize})
 
 	return nil
 }
@@ -0,0 +1,92 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/89luca89/lilipod/pkg/containerutils"
+	"github.com/89luca89/lilipod/pkg/fileutils"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/spf13/cobra"
+)
+
+// NewKillCommand will send a signal to the main process of given containers.
+func NewKillCommand() *cobra.Command {
+	killCommand := &cobra.Command{
+		Use:              "kill [flags] CONTAINER [CONTAINER...]",
+		Short:            "Kill one or more running containers with a specific signal",
+		PreRunE:          logging.Init,
+		RunE:             kill,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	killCommand.Flags().SetInterspersed(false)
+	killCommand.Flags().BoolP("all", "a", false, "signal all running containers")
+	killCommand.Flags().BoolP("help", "h", false, "show help")
+	killCommand.Flags().StringP("signal", "s", "SIGKILL", "signal to send to the container")
+
+	return killCommand
+}
+
+func kill(cmd *cobra.Command, arguments []string) error {
+	killAll, err := cmd.Flags().GetBool("all")
+	if err != nil {
+		return err
+	}
+
+	signalName, err := cmd.Flags().GetString("signal")
+	if err != nil {
+		return err
+	}
+
+	if len(arguments) < 1 && !killAll {
+		return cmd.Help()
+	}
+
+	signal, err := procutils.ParseSignal(signalName)
+	if err != nil {
+		return err
+	}
+
+	// if we want to kill all, just get a list of the running containers and
+	// add it to the arguments.
+	if killAll {
+		arguments = []string{}
+
+		containers, err := os.ReadDir(containerutils.ContainerDir)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range containers {
+			if containerutils.IsRunning(i.Name()) {
+				arguments = append(arguments, i.Name())
+			}
+		}
+	}
+
+	for _, container := range arguments {
+		if !fileutils.Exist(containerutils.GetDir(container)) {
+			return fmt.Errorf("container %s does not exist", container)
+		}
+
+		if !containerutils.IsRunning(container) {
+			return fmt.Errorf("container %s is not running", container)
+		}
+
+		logging.LogDebug("sending %s to: %s", signalName, container)
+
+		err = containerutils.Kill(container, signal)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(container)
+	}
+
+	return nil
+}
@@ -2,8 +2,10 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/89luca89/lilipod/pkg/containerutils"
@@ -65,19 +67,39 @@ func logs(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
-	_, err = os.Create(containerutils.GetDir(container) + "/current-logs")
-	if err != nil {
-		return err
+	// rotated logs are complete, only the current one can be followed
+	files := logging.GetLogFiles(filepath.Join(containerutils.GetDir(container), "current-logs"))
+
+	for i, path := range files {
+		err := readLog(path, convert(since), convert(until), follow && i == len(files)-1, timestamps)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readLog will read input log file, see logging.ReadLog.
+// A missing log file is empty, as the container has not logged yet.
+func readLog(path string, since, until int64, follow, timestamps bool) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !follow {
+		return nil
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		// wait for the container to log something
+		file, err = os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0o644)
 	}
 
-	file, err := os.Open(containerutils.GetDir(container) + "/current-logs")
 	if err != nil {
 		return err
 	}
 
 	defer func() { _ = file.Close() }()
 
-	return logging.ReadLog(file, convert(since), convert(until), follow, timestamps)
+	return logging.ReadLog(file, since, until, follow, timestamps)
 }
 
 // convert input string into a unix timestamp int64.
@@ -0,0 +1,119 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/89luca89/lilipod/pkg/containerutils"
+	"github.com/89luca89/lilipod/pkg/fileutils"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+// NewMonitorCommand will start and supervise a container, or an exec session.
+func NewMonitorCommand() *cobra.Command {
+	monitorCommand := &cobra.Command{
+		Use:              "monitor [flags] CONTAINER",
+		Short:            "Start and supervise a container",
+		Hidden:           true,
+		PreRunE:          logging.Init,
+		RunE:             monitor,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	monitorCommand.Flags().SetInterspersed(false)
+	monitorCommand.Flags().Bool("attach", false, "wait for a client to attach to the console before starting")
+	monitorCommand.Flags().Bool("interactive", false, "keep stdin open")
+	monitorCommand.Flags().Bool("tty", false, "allocate a pseudo-TTY")
+	monitorCommand.Flags().String("config", "", "config of the exec session")
+	monitorCommand.Flags().String("exec", "", "run an exec session with this ID, instead of the container")
+
+	return monitorCommand
+}
+
+func monitor(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) < 1 {
+		return cmd.Help()
+	}
+
+	opts := containerutils.ConsoleOptions{}
+
+	attach, err := cmd.Flags().GetBool("attach")
+	if err != nil {
+		return err
+	}
+
+	interactive, err := cmd.Flags().GetBool("interactive")
+	if err != nil {
+		return err
+	}
+
+	tty, err := cmd.Flags().GetBool("tty")
+	if err != nil {
+		return err
+	}
+
+	session, err := cmd.Flags().GetString("exec")
+	if err != nil {
+		return err
+	}
+
+	opts.Attach = attach
+	opts.Interactive = interactive
+	opts.Tty = tty
+
+	ready := os.NewFile(containerutils.MonitorReadyFd, "ready")
+
+	// exec sessions enter the container's namespaces from where we are,
+	// like exec does.
+	if session != "" {
+		configArg, err := cmd.Flags().GetString("config")
+		if err != nil {
+			return err
+		}
+
+		config, err := utils.InitConfig([]byte(configArg))
+		if err != nil {
+			_, _ = ready.WriteString(err.Error())
+
+			return err
+		}
+
+		return containerutils.MonitorExec(config, session, opts, ready)
+	}
+
+	success, err := procutils.EnsureFakeRoot(true)
+	if err != nil {
+		return err
+	}
+
+	if success {
+		return nil
+	}
+
+	container := arguments[0]
+
+	configPath := filepath.Join(containerutils.GetDir(container), "config")
+	if !fileutils.Exist(configPath) {
+		err := fmt.Errorf("container %s does not exist", container)
+
+		_, _ = ready.WriteString(err.Error())
+
+		return err
+	}
+
+	config, err := utils.LoadConfig(configPath)
+	if err != nil {
+		_, _ = ready.WriteString(err.Error())
+
+		return err
+	}
+
+	return containerutils.Monitor(config, opts, ready)
+}
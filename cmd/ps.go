@@ -60,30 +60,7 @@ func ps(cmd *cobra.Command, _ []string) error {
 		return err
 	}
 
-	filters = make(map[string]string)
-
-	for _, filter := range filterInput {
-		name := strings.Split(filter, "=")[0]
-		value := strings.Join(strings.Split(filter, "=")[1:], "=")
-
-		switch name {
-		case "label":
-			if filters[name] != "" {
-				filters[name] = filters[name] + constants.FilterSeparator + value
-			} else {
-				filters[name] = value
-			}
-		case "status":
-			filters[name] = value
-		case "name":
-			filters[name] = value
-		case "id":
-			filters[name] = value
-		default:
-			logging.LogWarning("invalid filter %s, skipping", name)
-			logging.LogWarning("valid filters are: label, status, name, id")
-		}
-	}
+	filters = parseFilters(filterInput)
 
 	size, err := cmd.Flags().GetBool("size")
 	if err != nil {
@@ -202,7 +179,12 @@ func doContainerRow(
 		command = command[:15] + "..."
 	}
 
-	if config.Status == "running" || all {
+	status := config.Status
+	if config.State != nil {
+		status = config.State.HumanStatus()
+	}
+
+	if config.Status == utils.StateRunning || all {
 		if size {
 			psTable.AppendRow(
 				[]interface{}{
@@ -210,7 +192,7 @@ func doContainerRow(
 					config.Image,
 					command,
 					config.Created,
-					config.Status,
+					status,
 					labels,
 					config.Names,
 					config.Size,
@@ -222,7 +204,7 @@ func doContainerRow(
 				config.Image,
 				command,
 				config.Created,
-				config.Status,
+				status,
 				labels,
 				config.Names,
 			})
@@ -231,3 +213,30 @@ func doContainerRow(
 
 	return nil
 }
+
+// parseFilters will parse input filters, in the form of name=value, into a map.
+// Multiple label filters are joined with constants.FilterSeparator.
+func parseFilters(input []string) map[string]string {
+	filters := make(map[string]string)
+
+	for _, filter := range input {
+		name := strings.Split(filter, "=")[0]
+		value := strings.Join(strings.Split(filter, "=")[1:], "=")
+
+		switch name {
+		case "label":
+			if filters[name] != "" {
+				filters[name] = filters[name] + constants.FilterSeparator + value
+			} else {
+				filters[name] = value
+			}
+		case "status", "name", "id", "restart-policy":
+			filters[name] = value
+		default:
+			logging.LogWarning("invalid filter %s, skipping", name)
+			logging.LogWarning("valid filters are: label, status, name, id, restart-policy")
+		}
+	}
+
+	return filters
+}
@@ -6,13 +6,14 @@ import (
 
 	"github.com/89luca89/lilipod/pkg/imageutils"
 	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/procutils"
 	"github.com/spf13/cobra"
 )
 
 // NewPullCommand will pull a new OCI image from a registry.
 func NewPullCommand() *cobra.Command {
 	pullCommand := &cobra.Command{
-		Use:              "pull [flags] IMAGE:TAG",
+		Use:              "pull [flags] [containers-storage:]IMAGE:TAG",
 		Short:            "Pull an image from a registry",
 		PreRunE:          logging.Init,
 		RunE:             pull,
@@ -39,6 +40,23 @@ func pull(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
+	// importing from a local containers/storage needs to read files owned
+	// by sub-uids, so we need to be fake root for it.
+	for _, image := range arguments {
+		if imageutils.IsContainersStorage(image) {
+			success, err := procutils.EnsureFakeRoot(true)
+			if err != nil {
+				return err
+			}
+
+			if success {
+				return nil
+			}
+
+			break
+		}
+	}
+
 	for _, image := range arguments {
 		id, err := imageutils.Pull(image, quiet)
 		if err != nil {
@@ -0,0 +1,120 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"os"
+
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/registryutils"
+	"github.com/89luca89/lilipod/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+// NewRegistryCommand will manage the built-in OCI registry.
+func NewRegistryCommand() *cobra.Command {
+	registryCommand := &cobra.Command{
+		Use:              "registry [command]",
+		Short:            "Manage the built-in OCI registry",
+		PreRunE:          logging.Init,
+		RunE:             func(cmd *cobra.Command, _ []string) error { return cmd.Help() },
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	registryCommand.Flags().SetInterspersed(false)
+	registryCommand.Flags().BoolP("help", "h", false, "show help")
+	registryCommand.AddCommand(newRegistryServeCommand())
+
+	return registryCommand
+}
+
+// newRegistryServeCommand will serve the local image store as an OCI registry.
+func newRegistryServeCommand() *cobra.Command {
+	serveCommand := &cobra.Command{
+		Use:              "serve [flags]",
+		Short:            "Serve the local images over the OCI distribution API",
+		PreRunE:          logging.Init,
+		RunE:             registryServe,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	serveCommand.Flags().SetInterspersed(false)
+	serveCommand.Flags().String("address", "127.0.0.1:5000", "address to listen on, in the form of host:port")
+	serveCommand.Flags().String("credentials", "",
+		"require basic auth with user:password, LILIPOD_REGISTRY_CREDENTIALS is used if unset")
+	serveCommand.Flags().String("tls-cert", "", "path to the certificate used to serve over https")
+	serveCommand.Flags().String("tls-key", "", "path to the key used to serve over https")
+	serveCommand.Flags().Bool("push", false, "allow pushing images to the local image store")
+	serveCommand.Flags().String("name", "",
+		"registry host:port pushed images are named after, defaults to the address")
+	serveCommand.Flags().Bool("overwrite", false, "allow pushes to replace images not pushed to this registry")
+	serveCommand.Flags().String("max-upload-size", "10g", "maximum size of a pushed blob, like 500m, 0 means no limit")
+	serveCommand.Flags().BoolP("help", "h", false, "show help")
+
+	return serveCommand
+}
+
+func registryServe(cmd *cobra.Command, _ []string) error {
+	address, err := cmd.Flags().GetString("address")
+	if err != nil {
+		return err
+	}
+
+	credentials, err := cmd.Flags().GetString("credentials")
+	if err != nil {
+		return err
+	}
+
+	if credentials == "" {
+		credentials = os.Getenv("LILIPOD_REGISTRY_CREDENTIALS")
+	}
+
+	tlsCert, err := cmd.Flags().GetString("tls-cert")
+	if err != nil {
+		return err
+	}
+
+	tlsKey, err := cmd.Flags().GetString("tls-key")
+	if err != nil {
+		return err
+	}
+
+	push, err := cmd.Flags().GetBool("push")
+	if err != nil {
+		return err
+	}
+
+	registryName, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+
+	overwrite, err := cmd.Flags().GetBool("overwrite")
+	if err != nil {
+		return err
+	}
+
+	maxUploadSize, err := cmd.Flags().GetString("max-upload-size")
+	if err != nil {
+		return err
+	}
+
+	maxUploadBytes, err := utils.ParseSize(maxUploadSize)
+	if err != nil {
+		return err
+	}
+
+	return registryutils.Serve(registryutils.Options{
+		Address:       address,
+		Credentials:   credentials,
+		TLSCert:       tlsCert,
+		TLSKey:        tlsKey,
+		Push:          push,
+		Name:          registryName,
+		Overwrite:     overwrite,
+		MaxUploadSize: maxUploadBytes,
+	})
+}
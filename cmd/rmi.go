@@ -4,6 +4,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/imageutils"
@@ -50,6 +51,11 @@ func rmi(cmd *cobra.Command, arguments []string) error {
 			return fmt.Errorf("image %s not found", img)
 		}
 
+		if imageutils.IsReadOnly(img) {
+			return fmt.Errorf("image %s is in read-only store %s, cannot remove it",
+				img, filepath.Dir(targetDIR))
+		}
+
 		logging.LogDebug("deleting: %s", img)
 
 		err = os.RemoveAll(targetDIR)
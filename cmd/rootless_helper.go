@@ -99,7 +99,16 @@ func parent(arguments []string) error {
 
 	logging.LogDebug("parent: waiting for child completion")
 
-	return cmd.Wait()
+	err = cmd.Wait()
+	if err != nil {
+		// the child already reported its errors, just propagate its exit code
+		code, _ := procutils.GetExitStatus(err)
+		if code > 0 {
+			return &procutils.ExitCodeError{Code: code}
+		}
+	}
+
+	return err
 }
 
 // child is launched by parent and will wait until the uid/gid-mapping is performed.
@@ -5,9 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"sync"
-	"time"
 
+	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/containerutils"
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/logging"
@@ -29,8 +28,13 @@ func NewStartCommand() *cobra.Command {
 	}
 
 	startCommand.Flags().SetInterspersed(false)
-	startCommand.Flags().BoolP("all", "a", false, "start all containers regardless of their state or configuration")
+	startCommand.Flags().BoolP("all", "a", false, "start all the stopped containers")
+	startCommand.Flags().Bool("attach", false, "attach to the container's output and wait for it to exit")
+	startCommand.Flags().String("detach-keys", constants.DefaultDetachKeys,
+		"key sequence to detach from the container, an empty value disables it")
 	startCommand.Flags().BoolP("help", "h", false, "show help")
+	startCommand.Flags().
+		StringArrayP("filter", "f", []string{}, "with --all, start only the containers matching the conditions given")
 	startCommand.Flags().BoolP("interactive", "i", false, "keep process in foreground")
 	startCommand.Flags().BoolP("tty", "t", false, "allocate a pseudo-TTY. The default is false")
 
@@ -48,7 +52,31 @@ func start(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
-	parent, err := procutils.EnsureFakeRoot(interactive)
+	attach, err := cmd.Flags().GetBool("attach")
+	if err != nil {
+		return err
+	}
+
+	detachKeys, err := cmd.Flags().GetString("detach-keys")
+	if err != nil {
+		return err
+	}
+
+	_, err = containerutils.ParseDetachKeys(detachKeys)
+	if err != nil {
+		return err
+	}
+
+	// -i and -t keep us attached to the container, like --attach does, stdin
+	// is only sent with -i.
+	opts := containerutils.ConsoleOptions{
+		Tty:         tty,
+		Interactive: interactive,
+		Attach:      attach || interactive || tty,
+		DetachKeys:  detachKeys,
+	}
+
+	parent, err := procutils.EnsureFakeRoot(true)
 	if err != nil {
 		return err
 	}
@@ -66,22 +94,25 @@ func start(cmd *cobra.Command, arguments []string) error {
 		return cmd.Help()
 	}
 
-	// if we want to delete all, just get a list of the targets and add it to
-	// the arguments.
-	if startAll {
-		arguments = []string{}
+	filterInput, err := cmd.Flags().GetStringArray("filter")
+	if err != nil {
+		return err
+	}
 
-		containers, err := os.ReadDir(containerutils.ContainerDir)
+	// if we want to start all, just get a list of the stopped targets matching
+	// the filters and add it to the arguments.
+	if startAll {
+		arguments, err = getStartableContainers(parseFilters(filterInput))
 		if err != nil {
 			return err
 		}
+	}
 
-		for _, i := range containers {
-			arguments = append(arguments, i.Name())
-		}
+	if opts.Attach && len(arguments) > 1 {
+		return fmt.Errorf("cannot start and attach to multiple containers at once")
 	}
 
-	var wg sync.WaitGroup
+	configs := []utils.Config{}
 
 	for _, container := range arguments {
 		// ensure a container for this name is already running
@@ -94,27 +125,75 @@ func start(cmd *cobra.Command, arguments []string) error {
 			targetDIR = containerutils.GetDir(container)
 		}
 
-		// save the config to file
 		configPath := filepath.Join(targetDIR, "config")
-		if fileutils.Exist(configPath) {
-			config, err := utils.LoadConfig(configPath)
-			if err != nil {
-				return err
-			}
+		if !fileutils.Exist(configPath) {
+			return fmt.Errorf("container %s does not exist", container)
+		}
 
-			logging.LogDebug("starting: %s", container)
+		config, err := utils.LoadConfig(configPath)
+		if err != nil {
+			return err
+		}
 
-			wg.Add(1)
-			go containerutils.Start(interactive, tty, config)
+		configs = append(configs, config)
+	}
 
-			// wait for routine to correctly statt
-			time.Sleep(time.Millisecond * 250)
-		} else {
-			return fmt.Errorf("container %s does not exist", container)
-		}
+	if len(configs) == 0 {
+		return nil
 	}
 
-	wg.Wait()
+	// in foreground, the container's exit code becomes ours
+	if opts.Attach {
+		logging.LogDebug("starting: %s", configs[0].Names)
+
+		return containerutils.Start(opts, configs[0])
+	}
+
+	// in background, the containers are left to their monitors
+	for _, config := range configs {
+		logging.LogDebug("starting: %s", config.Names)
+
+		err := containerutils.Start(opts, config)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(config.Names)
+	}
 
 	return nil
 }
+
+// getStartableContainers returns the stopped containers matching input filters.
+// Containers with restart policy unless-stopped that were stopped by the user
+// are skipped, like the ones that are already running.
+func getStartableContainers(filters map[string]string) ([]string, error) {
+	result := []string{}
+
+	containers, err := os.ReadDir(containerutils.ContainerDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range containers {
+		config, err := containerutils.GetContainerInfo(i.Name(), false, filters)
+		if err != nil {
+			return nil, err
+		}
+
+		if config == nil || config.Status == utils.StateRunning || config.Status == utils.StateRestarting {
+			continue
+		}
+
+		policy, _, _ := utils.ParseRestartPolicy(config.Restart)
+		if policy == constants.RestartUnlessStopped && config.State.StoppedByUser {
+			logging.LogDebug("container %s was stopped by the user, skipping", config.Names)
+
+			continue
+		}
+
+		result = append(result, i.Name())
+	}
+
+	return result, nil
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/89luca89/lilipod/pkg/containerutils"
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -26,9 +28,10 @@ func NewStopCommand() *cobra.Command {
 
 	stopCommand.Flags().SetInterspersed(false)
 	stopCommand.Flags().BoolP("all", "a", false, "stop all running containers")
-	stopCommand.Flags().BoolP("force", "f", false, "force stop running container (use SIGKILL instead of SIGTERM)")
+	stopCommand.Flags().BoolP("force", "f", false, "force stop running container (use SIGKILL instead of the stop signal)")
 	stopCommand.Flags().BoolP("help", "h", false, "show help")
-	stopCommand.Flags().IntP("timeout", "t", 10, "seconds to wait before forcefully exiting the container")
+	stopCommand.Flags().IntP("timeout", "t", 0,
+		"seconds to wait before forcefully exiting the container (default from container, or 10)")
 
 	return stopCommand
 }
@@ -78,14 +81,28 @@ func stop(cmd *cobra.Command, arguments []string) error {
 		if fileutils.Exist(targetDIR) {
 			logging.LogDebug("stopping: %s", container)
 
-			pid, _ := containerutils.GetPid(container)
-			if pid < 1 {
+			state := containerutils.GetState(container)
+			if state.Status != utils.StateRunning && state.Status != utils.StateRestarting {
 				logging.LogDebug("container %s already stopped", container)
 
-				return nil
+				continue
 			}
 
-			err = containerutils.Stop(container, force, timeout)
+			config, err := utils.LoadConfig(filepath.Join(targetDIR, "config"))
+			if err != nil {
+				return err
+			}
+
+			signal := containerutils.GetStopSignal(config)
+			if force {
+				signal = syscall.SIGKILL
+			}
+
+			if !cmd.Flags().Lookup("timeout").Changed {
+				timeout = containerutils.GetStopTimeout(config)
+			}
+
+			err = containerutils.Stop(container, signal, timeout)
 			if err != nil {
 				return err
 			}
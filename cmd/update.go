@@ -4,16 +4,28 @@ package cmd
 import (
 	"fmt"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/89luca89/lilipod/pkg/cgrouputils"
+	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/containerutils"
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/securityutils"
 	"github.com/89luca89/lilipod/pkg/utils"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
+// resourceFlags are the flags changing the resource limits, the only ones that
+// can be updated while the container is running.
+var resourceFlags = []string{
+	"memory", "memory-swap", "cpus", "cpu-weight", "cpuset-cpus", "pids-limit", "io-weight",
+}
+
 // NewUpdateCommand will update a new container environment ready to use.
 func NewUpdateCommand() *cobra.Command {
 	updateCommand := &cobra.Command{
@@ -36,12 +48,27 @@ func NewUpdateCommand() *cobra.Command {
 	updateCommand.Flags().String("network", "", "connect a container to a network")
 	updateCommand.Flags().String("pid", "", "pid namespace to use")
 	updateCommand.Flags().String("privileged", "", "Give extended privileges to the container")
+	updateCommand.Flags().String("restart", "", "restart policy to apply when the container exits (no, on-failure[:N], always, unless-stopped)")
+	updateCommand.Flags().String("stop-signal", "", "signal to stop the container")
+	updateCommand.Flags().Int("stop-timeout", 0, "seconds to wait for the container to stop before killing it")
 	updateCommand.Flags().String("time", "", "time namespace to use")
+	updateCommand.Flags().String("time-offset", "",
+		"offset the clocks of the private time namespace, as monotonic=SECONDS,boottime=SECONDS, empty to reset them")
 	updateCommand.Flags().String("userns", "", "user namespace to use")
-	//nolint:lll
-	updateCommand.Flags().StringArrayP("env", "e", nil, "set environment variables in container (default [PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin,TERM=xterm])")
+	updateCommand.Flags().StringArrayP("env", "e", nil, "add or replace environment variables in container, same as --env-add")
+	updateCommand.Flags().StringArrayP("env-add", "", nil, "add or replace environment variables in container")
+	updateCommand.Flags().StringArrayP("env-rm", "", nil, "remove environment variables from container")
 	updateCommand.Flags().StringArrayP("label", "", nil, "set metadata on container")
 	updateCommand.Flags().StringArrayP("volume", "v", nil, "bind mount a volume into the container")
+	updateCommand.Flags().Float64("cpus", 0, "number of CPUs the container can use, 0 for unlimited")
+	updateCommand.Flags().Uint64("cpu-weight", 0,
+		"relative CPU weight of the container, between 1 and 10000, 0 for default")
+	updateCommand.Flags().String("cpuset-cpus", "", "CPUs the container can run on, like 0-2,4, empty for all")
+	updateCommand.Flags().Uint64("io-weight", 0,
+		"relative IO weight of the container, between 1 and 10000, 0 for default")
+	updateCommand.Flags().StringP("memory", "m", "", "memory limit of the container, like 512m or 2g, 0 for unlimited")
+	updateCommand.Flags().String("memory-swap", "", "memory plus swap limit of the container, -1 for unlimited swap")
+	updateCommand.Flags().Int64("pids-limit", 0, "maximum number of processes in the container, -1 for unlimited")
 	updateCommand.Flags().StringP("hostname", "h", "", "set container hostname")
 
 	return updateCommand
@@ -89,6 +116,11 @@ func update(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
+	timeOffset, err := cmd.Flags().GetString("time-offset")
+	if err != nil {
+		return err
+	}
+
 	pid, err := cmd.Flags().GetString("pid")
 	if err != nil {
 		return err
@@ -104,11 +136,36 @@ func update(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
+	restart, err := cmd.Flags().GetString("restart")
+	if err != nil {
+		return err
+	}
+
+	stopsignal, err := cmd.Flags().GetString("stop-signal")
+	if err != nil {
+		return err
+	}
+
+	stopTimeout, err := cmd.Flags().GetInt("stop-timeout")
+	if err != nil {
+		return err
+	}
+
 	env, err := cmd.Flags().GetStringArray("env")
 	if err != nil {
 		return err
 	}
 
+	envAdd, err := cmd.Flags().GetStringArray("env-add")
+	if err != nil {
+		return err
+	}
+
+	envRm, err := cmd.Flags().GetStringArray("env-rm")
+	if err != nil {
+		return err
+	}
+
 	label, err := cmd.Flags().GetStringArray("label")
 	if err != nil {
 		return err
@@ -143,8 +200,24 @@ func update(cmd *cobra.Command, arguments []string) error {
 		return nil
 	}
 
+	resources, err := getResources(cmd, config.Resources)
+	if err != nil {
+		return err
+	}
+
 	if containerutils.IsRunning(container) {
-		return fmt.Errorf("container %s is running, stop it first", container)
+		return updateRunning(cmd, config, resources)
+	}
+
+	if slices.ContainsFunc(resourceFlags, func(name string) bool { return cmd.Flags().Lookup(name).Changed }) {
+		if resources != nil {
+			err = cgrouputils.Check(*resources)
+			if err != nil {
+				return err
+			}
+		}
+
+		config.Resources = resources
 	}
 
 	if reset {
@@ -154,8 +227,12 @@ func update(cmd *cobra.Command, arguments []string) error {
 		defConf.ID = config.ID
 		defConf.Names = config.Names
 		defConf.Image = config.Image
+		defConf.Rootfs = config.Rootfs
 		defConf.Hostname = config.Hostname
 		defConf.Userns = config.Userns
+		defConf.Passwd = config.Passwd
+		defConf.Sudo = config.Sudo
+		defConf.AutoRemove = config.AutoRemove
 		defConf.ID = containerutils.GetID(container)
 
 		return utils.SaveConfig(defConf, filepath.Join(containerutils.GetDir(container), "config"))
@@ -170,6 +247,12 @@ func update(cmd *cobra.Command, arguments []string) error {
 		if err != nil {
 			return err
 		}
+
+		// privileged containers get all capabilities
+		config.Capabilities, err = securityutils.GetCapabilities(config.CapAdd, config.CapDrop, config.Privileged)
+		if err != nil {
+			return err
+		}
 	}
 
 	if cmd.Flags().Lookup("ipc").Changed {
@@ -188,6 +271,26 @@ func update(cmd *cobra.Command, arguments []string) error {
 		config.Time = time
 	}
 
+	if cmd.Flags().Lookup("time-offset").Changed {
+		config.TimeOffsets = nil
+
+		if timeOffset != "" {
+			config.TimeOffsets, err = procutils.ParseTimeOffsets(timeOffset)
+			if err != nil {
+				return err
+			}
+
+			err = procutils.CheckTimeOffsets()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(config.TimeOffsets) > 0 && config.Time != constants.Private {
+		return fmt.Errorf("time offsets require a private time namespace")
+	}
+
 	if cmd.Flags().Lookup("pid").Changed {
 		config.Pid = pid
 	}
@@ -200,10 +303,44 @@ func update(cmd *cobra.Command, arguments []string) error {
 		config.Hostname = hostname
 	}
 
-	if cmd.Flags().Lookup("env").Changed {
-		config.Env = env
+	if cmd.Flags().Lookup("restart").Changed {
+		restartPolicy, _, err := utils.ParseRestartPolicy(restart)
+		if err != nil {
+			return err
+		}
+
+		if config.AutoRemove && restartPolicy != constants.RestartNo {
+			return fmt.Errorf("container %s is removed when it exits, it cannot be restarted", container)
+		}
+
+		config.Restart = restart
+	}
+
+	if cmd.Flags().Lookup("stop-signal").Changed {
+		_, err = procutils.ParseSignal(stopsignal)
+		if err != nil {
+			return err
+		}
+
+		config.Stopsignal = stopsignal
+	}
+
+	if cmd.Flags().Lookup("stop-timeout").Changed {
+		if stopTimeout < 0 {
+			return fmt.Errorf("invalid stop timeout %d, must be 0 or more", stopTimeout)
+		}
+
+		config.StopTimeout = &stopTimeout
 	}
 
+	// --env is an alias of --env-add, removals are applied last
+	envAdd, err = utils.ExpandEnv(append(env, envAdd...))
+	if err != nil {
+		return err
+	}
+
+	config.Env = utils.UnsetEnv(utils.MergeEnv(config.Env, envAdd), envRm)
+
 	if cmd.Flags().Lookup("volume").Changed {
 		config.Mounts = volume
 	}
@@ -229,3 +366,46 @@ func update(cmd *cobra.Command, arguments []string) error {
 
 	return nil
 }
+
+// updateRunning will update the resource limits of input running container,
+// live. Other settings cannot be changed while the container is running.
+func updateRunning(cmd *cobra.Command, config utils.Config, resources *cgrouputils.Resources) error {
+	onlyResources := true
+
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		if !slices.Contains(resourceFlags, flag.Name) && flag.Name != "log-level" {
+			onlyResources = false
+		}
+	})
+
+	if !onlyResources {
+		return fmt.Errorf("container %s is running, stop it first, only resource limits can be updated live",
+			config.Names)
+	}
+
+	// the cgroup is only created by containers started with resource limits
+	if config.Resources == nil {
+		return fmt.Errorf("container %s was started without resource limits, stop it first", config.Names)
+	}
+
+	limits := cgrouputils.Resources{}
+	if resources != nil {
+		limits = *resources
+	}
+
+	err := cgrouputils.Update(config.ID, limits)
+	if err != nil {
+		return err
+	}
+
+	config.Resources = resources
+
+	err = utils.SaveConfig(config, filepath.Join(containerutils.GetDir(config.ID), "config"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(config.Names)
+
+	return nil
+}
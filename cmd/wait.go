@@ -0,0 +1,128 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/89luca89/lilipod/pkg/containerutils"
+	"github.com/89luca89/lilipod/pkg/fileutils"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+// exitCodeTimeout is how long to wait for the exit code to be saved, after
+// the container exits.
+const exitCodeTimeout = time.Second * 2
+
+// NewWaitCommand will wait for the containers to reach a condition, and print their exit codes.
+func NewWaitCommand() *cobra.Command {
+	waitCommand := &cobra.Command{
+		Use:              "wait [flags] CONTAINER [CONTAINER...]",
+		Short:            "Block on one or more containers",
+		PreRunE:          logging.Init,
+		RunE:             wait,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	waitCommand.Flags().SetInterspersed(false)
+	waitCommand.Flags().BoolP("help", "h", false, "show help")
+	waitCommand.Flags().String("condition", "stopped", "condition to wait on (stopped, running, healthy)")
+	waitCommand.Flags().DurationP("interval", "i", time.Millisecond*250, "time interval to wait between checks")
+
+	return waitCommand
+}
+
+func wait(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) < 1 {
+		return cmd.Help()
+	}
+
+	condition, err := cmd.Flags().GetString("condition")
+	if err != nil {
+		return err
+	}
+
+	interval, err := cmd.Flags().GetDuration("interval")
+	if err != nil {
+		return err
+	}
+
+	switch condition {
+	case utils.StateStopped, utils.StateExited, utils.StateRunning, utils.HealthHealthy:
+	default:
+		return fmt.Errorf("invalid condition %s, use one of stopped, running, healthy", condition)
+	}
+
+	for _, container := range arguments {
+		if !fileutils.Exist(containerutils.GetDir(container)) {
+			return fmt.Errorf("container %s does not exist", container)
+		}
+
+		logging.LogDebug("waiting for %s to be %s", container, condition)
+
+		if condition == utils.HealthHealthy {
+			config, err := utils.LoadConfig(filepath.Join(containerutils.GetDir(container), "config"))
+			if err != nil {
+				return err
+			}
+
+			if !config.Healthcheck.Enabled() {
+				return fmt.Errorf("container %s has no healthcheck", container)
+			}
+		}
+
+		var exited time.Time
+
+		for {
+			state := containerutils.GetState(container)
+
+			if condition == utils.StateRunning && state.Status == utils.StateRunning {
+				// there is no exit code for running containers
+				fmt.Println(-1)
+
+				break
+			}
+
+			if condition == utils.HealthHealthy && state.Status == utils.StateRunning &&
+				state.Health != nil && state.Health.Status == utils.HealthHealthy {
+				fmt.Println(-1)
+
+				break
+			}
+
+			if condition == utils.HealthHealthy && state.Status == utils.StateExited {
+				return fmt.Errorf("container %s exited before becoming healthy", container)
+			}
+
+			if condition != utils.StateRunning && condition != utils.HealthHealthy &&
+				state.Status == utils.StateExited {
+				if exited.IsZero() {
+					exited = time.Now()
+				}
+
+				if !state.FinishedAt.IsZero() {
+					fmt.Println(state.ExitCode)
+
+					break
+				}
+
+				// the exit code is saved right after the container exits, if it
+				// is not, the container was not started by us and it is unknown.
+				if time.Since(exited) > exitCodeTimeout {
+					fmt.Println(-1)
+
+					break
+				}
+			}
+
+			time.Sleep(interval)
+		}
+	}
+
+	return nil
+}
@@ -24,8 +24,10 @@ package main
 
 import (
 	_ "embed"
+	"errors"
 	"log"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -33,6 +35,7 @@ import (
 	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/containerutils"
 	"github.com/89luca89/lilipod/pkg/imageutils"
+	"github.com/89luca89/lilipod/pkg/procutils"
 	"github.com/89luca89/lilipod/pkg/utils"
 	"github.com/spf13/cobra"
 )
@@ -43,6 +46,12 @@ var pty []byte
 //go:embed busybox
 var busybox []byte
 
+func init() {
+	// keep main on the main thread, as some per-process settings can only be
+	// done from it, see procutils.SetTimeOffsets
+	runtime.LockOSThread()
+}
+
 func newApp() *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:              "lilipod",
@@ -54,15 +63,20 @@ func newApp() *cobra.Command {
 	}
 
 	rootCmd.AddCommand(
+		cmd.NewAttachCommand(),
 		cmd.NewCpCommand(),
 		cmd.NewCreateCommand(),
 		cmd.NewEnterCommand(),
 		cmd.NewExecCommand(),
+		cmd.NewHealthcheckCommand(),
 		cmd.NewImagesCommand(),
 		cmd.NewInspectCommand(),
+		cmd.NewKillCommand(),
 		cmd.NewLogsCommand(),
+		cmd.NewMonitorCommand(),
 		cmd.NewPsCommand(),
 		cmd.NewPullCommand(),
+		cmd.NewRegistryCommand(),
 		cmd.NewRenameCommand(),
 		cmd.NewRmCommand(),
 		cmd.NewRmiCommand(),
@@ -72,6 +86,7 @@ func newApp() *cobra.Command {
 		cmd.NewStopCommand(),
 		cmd.NewUpdateCommand(),
 		cmd.NewVersionCommand(),
+		cmd.NewWaitCommand(),
 	)
 	rootCmd.PersistentFlags().
 		String("log-level", "", "log messages above specified level (debug, warn, warning, error)")
@@ -111,6 +126,12 @@ func main() {
 
 	err = app.Execute()
 	if err != nil {
+		// exit codes of containers are propagated as they are
+		var exitErr *procutils.ExitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
+
 		log.Fatalf("%+v\n", err)
 	}
 }
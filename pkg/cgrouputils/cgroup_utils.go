@@ -0,0 +1,441 @@
+// Package cgrouputils contains helpers and utilities for managing the cgroup v2
+// resource limits of containers.
+package cgrouputils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/89luca89/lilipod/pkg/constants"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"golang.org/x/sys/unix"
+)
+
+// CgroupRoot is where the cgroup v2 hierarchy is mounted.
+const CgroupRoot = "/sys/fs/cgroup"
+
+// cpuPeriod is the period in microseconds used for cpu.max.
+const cpuPeriod = 100000
+
+// ErrNoDelegation is returned when there is no cgroup v2 subtree we can write to.
+var ErrNoDelegation = errors.New(
+	"resource limits need a writable cgroup v2 subtree: run lilipod as root, or in a cgroup " +
+		"delegated to your user, eg. in a systemd user session or with " +
+		"'systemd-run --user --scope -p Delegate=yes lilipod ...'")
+
+var cpusetPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// Resources are the resource limits of a container, zero values are unlimited.
+type Resources struct {
+	// Memory is the memory limit in bytes.
+	Memory int64 `json:"memory,omitempty"`
+	// MemorySwap is the memory plus swap limit in bytes, -1 for unlimited swap.
+	MemorySwap int64 `json:"memoryswap,omitempty"`
+	// CPUs is the number of CPUs the container can use.
+	CPUs float64 `json:"cpus,omitempty"`
+	// CPUWeight is the relative CPU weight, from 1 to 10000, 100 by default.
+	CPUWeight uint64 `json:"cpuweight,omitempty"`
+	// CpusetCpus are the CPUs the container can run on, eg: 0-2,4.
+	CpusetCpus string `json:"cpusetcpus,omitempty"`
+	// PidsLimit is the maximum number of processes, -1 for unlimited.
+	PidsLimit int64 `json:"pidslimit,omitempty"`
+	// IOWeight is the relative IO weight, from 1 to 10000, 100 by default.
+	IOWeight uint64 `json:"ioweight,omitempty"`
+}
+
+// IsEmpty returns true if input resources do not set any limit.
+func (r Resources) IsEmpty() bool {
+	return r == Resources{}
+}
+
+// Validate returns an error if input resources are not valid.
+func (r Resources) Validate() error {
+	switch {
+	case r.Memory < 0:
+		return fmt.Errorf("invalid memory limit %d", r.Memory)
+	case r.MemorySwap != 0 && r.Memory == 0:
+		return fmt.Errorf("memory-swap requires a memory limit")
+	case r.MemorySwap > 0 && r.MemorySwap < r.Memory:
+		return fmt.Errorf("memory-swap must be greater than or equal to memory")
+	case r.MemorySwap < -1:
+		return fmt.Errorf("invalid memory-swap limit %d", r.MemorySwap)
+	case r.CPUs < 0:
+		return fmt.Errorf("invalid cpus %g", r.CPUs)
+	case r.CPUWeight > 10000:
+		return fmt.Errorf("invalid cpu-weight %d, must be between 1 and 10000", r.CPUWeight)
+	case r.CpusetCpus != "" && !cpusetPattern.MatchString(r.CpusetCpus):
+		return fmt.Errorf("invalid cpuset-cpus %s, must be a list of CPUs or ranges like 0-2,4", r.CpusetCpus)
+	case r.PidsLimit < -1:
+		return fmt.Errorf("invalid pids-limit %d", r.PidsLimit)
+	case r.IOWeight > 10000:
+		return fmt.Errorf("invalid io-weight %d, must be between 1 and 10000", r.IOWeight)
+	}
+
+	return nil
+}
+
+// controllers returns the cgroup controllers needed by input resources.
+func (r Resources) controllers() []string {
+	result := []string{}
+
+	if r.Memory != 0 || r.MemorySwap != 0 {
+		result = append(result, "memory")
+	}
+
+	if r.CPUs != 0 || r.CPUWeight != 0 {
+		result = append(result, "cpu")
+	}
+
+	if r.CpusetCpus != "" {
+		result = append(result, "cpuset")
+	}
+
+	if r.PidsLimit != 0 {
+		result = append(result, "pids")
+	}
+
+	if r.IOWeight != 0 {
+		result = append(result, "io")
+	}
+
+	return result
+}
+
+// files returns the cgroup files to write for input controller, with their
+// content. Unset limits are reset to their default.
+func (r Resources) files(controller string) map[string]string {
+	switch controller {
+	case "memory":
+		memory, swap := "max", "max"
+
+		if r.Memory > 0 {
+			memory = strconv.FormatInt(r.Memory, 10)
+		}
+
+		// memory.swap.max is only the swap, while MemorySwap includes the memory
+		if r.MemorySwap > 0 {
+			swap = strconv.FormatInt(r.MemorySwap-r.Memory, 10)
+		}
+
+		return map[string]string{"memory.max": memory, "memory.swap.max": swap}
+	case "cpu":
+		quota, weight := "max", "100"
+
+		if r.CPUs > 0 {
+			quota = strconv.FormatInt(int64(r.CPUs*cpuPeriod), 10)
+		}
+
+		if r.CPUWeight > 0 {
+			weight = strconv.FormatUint(r.CPUWeight, 10)
+		}
+
+		return map[string]string{"cpu.max": quota + " " + strconv.Itoa(cpuPeriod), "cpu.weight": weight}
+	case "cpuset":
+		// an empty cpuset uses the parent's one
+		return map[string]string{"cpuset.cpus": r.CpusetCpus + "\n"}
+	case "pids":
+		pids := "max"
+
+		if r.PidsLimit > 0 {
+			pids = strconv.FormatInt(r.PidsLimit, 10)
+		}
+
+		return map[string]string{"pids.max": pids}
+	case "io":
+		weight := uint64(100)
+
+		if r.IOWeight > 0 {
+			weight = r.IOWeight
+		}
+
+		return map[string]string{"io.weight": "default " + strconv.FormatUint(weight, 10)}
+	default:
+		return nil
+	}
+}
+
+// GetPath returns the cgroup of input container, where its init is started.
+// The cgroup is under the lilipod cgroup of:
+//   - the root cgroup, in rootful mode
+//   - the topmost cgroup delegated to us containing our own, in rootless mode,
+//     eg: the systemd user service /user.slice/user-1000.slice/user@1000.service
+//
+// ErrNoDelegation is returned if there is no such cgroup.
+func GetPath(name string) (string, error) {
+	parent, err := getDelegatedCgroup()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(parent, "lilipod", name), nil
+}
+
+// getDelegatedCgroup returns the cgroup under which we can create cgroups,
+// see GetPath.
+func getDelegatedCgroup() (string, error) {
+	var statfs unix.Statfs_t
+
+	err := unix.Statfs(CgroupRoot, &statfs)
+	if err != nil || statfs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return "", fmt.Errorf("resource limits need cgroup v2 mounted on %s", CgroupRoot)
+	}
+
+	if os.Getenv("ROOTFUL") == constants.TrueString {
+		return CgroupRoot, nil
+	}
+
+	current, err := getCurrentCgroup()
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return "", err
+	}
+
+	// the delegated subtree goes from our cgroup up to the delegated one
+	delegated := ""
+
+	for cgroup := current; cgroup != CgroupRoot; cgroup = filepath.Dir(cgroup) {
+		if unix.Access(cgroup, unix.W_OK) != nil ||
+			unix.Access(filepath.Join(cgroup, "cgroup.procs"), unix.W_OK) != nil ||
+			unix.Access(filepath.Join(cgroup, "cgroup.subtree_control"), unix.W_OK) != nil {
+			break
+		}
+
+		delegated = cgroup
+	}
+
+	// our own cgroup has processes, us, its children cannot have controllers
+	if delegated == "" || delegated == current {
+		logging.LogDebug("no delegated cgroup found from %s", current)
+
+		return "", ErrNoDelegation
+	}
+
+	return delegated, nil
+}
+
+// getCurrentCgroup returns the cgroup v2 of the current process.
+func getCurrentCgroup() (string, error) {
+	return getProcessCgroup("self")
+}
+
+// getProcessCgroup returns the cgroup v2 of input pid, or self.
+func getProcessCgroup(pid string) (string, error) {
+	file, err := os.Open(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		cgroup, found := strings.CutPrefix(scanner.Text(), "0::")
+		if found {
+			return filepath.Join(CgroupRoot, cgroup), nil
+		}
+	}
+
+	return "", fmt.Errorf("cannot find the cgroup v2 of process %s", pid)
+}
+
+// Check returns an error if input resources cannot be applied to a container:
+// if there is no delegated cgroup, or if it misses the needed controllers.
+func Check(resources Resources) error {
+	err := resources.Validate()
+	if err != nil {
+		return err
+	}
+
+	parent, err := getDelegatedCgroup()
+	if err != nil {
+		return err
+	}
+
+	return checkControllers(parent, resources.controllers())
+}
+
+// checkControllers returns an error if input controllers are not available in
+// input cgroup.
+func checkControllers(cgroup string, controllers []string) error {
+	content, err := os.ReadFile(filepath.Join(cgroup, "cgroup.controllers"))
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	available := strings.Fields(string(content))
+
+	for _, controller := range controllers {
+		if !slices.Contains(available, controller) {
+			return fmt.Errorf("the %s controller is not delegated to %s, it is needed for resource limits",
+				controller, cgroup)
+		}
+	}
+
+	return nil
+}
+
+// Create will create the cgroup of input container, see GetPath, with input
+// resource limits, and return an open file descriptor of it, to start the
+// container in it. The needed controllers are enabled along the way.
+// The file descriptor must be closed by the caller.
+func Create(name string, resources Resources) (int, error) {
+	path, err := GetPath(name)
+	if err != nil {
+		return -1, err
+	}
+
+	logging.LogDebug("creating cgroup %s", path)
+
+	err = os.MkdirAll(path, 0o755)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return -1, err
+	}
+
+	err = apply(path, resources)
+	if err != nil {
+		return -1, err
+	}
+
+	return unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+}
+
+// Open will return an open file descriptor of the cgroup of input pid, to start
+// other processes in it, like the exec sessions of a container in the cgroup of
+// its init process.
+// The file descriptor must be closed by the caller.
+func Open(pid int) (int, error) {
+	path, err := getProcessCgroup(strconv.Itoa(pid))
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return -1, err
+	}
+
+	return unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+}
+
+// Update will apply input resource limits to the cgroup of input container,
+// while it is running.
+func Update(name string, resources Resources) error {
+	err := resources.Validate()
+	if err != nil {
+		return err
+	}
+
+	path, err := GetPath(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("container %s has no cgroup, restart it to apply resource limits", name)
+	}
+
+	return apply(path, resources)
+}
+
+// apply will enable the controllers needed by input resources down to input
+// cgroup, and write its limits, for its enabled controllers.
+func apply(cgroup string, resources Resources) error {
+	controllers := resources.controllers()
+
+	// every cgroup from the delegated one to the container's parent must
+	// enable the controllers for its children
+	for _, parent := range []string{filepath.Dir(filepath.Dir(cgroup)), filepath.Dir(cgroup)} {
+		err := checkControllers(parent, controllers)
+		if err != nil {
+			return err
+		}
+
+		for _, controller := range controllers {
+			err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+"+controller), 0o644)
+			if err != nil {
+				logging.LogDebug("error: %+v", err)
+
+				return fmt.Errorf("cannot enable the %s controller in %s: %w", controller, parent, err)
+			}
+		}
+	}
+
+	enabled, err := os.ReadFile(filepath.Join(cgroup, "cgroup.controllers"))
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	for _, controller := range strings.Fields(string(enabled)) {
+		for file, value := range resources.files(controller) {
+			logging.LogDebug("setting %s to %s in %s", file, value, cgroup)
+
+			err := os.WriteFile(filepath.Join(cgroup, file), []byte(value), 0o644)
+			// swap accounting could be disabled, this is fine if we do not limit it
+			if errors.Is(err, os.ErrNotExist) && file == "memory.swap.max" && resources.MemorySwap <= 0 {
+				continue
+			}
+
+			if err != nil {
+				logging.LogDebug("error: %+v", err)
+
+				return fmt.Errorf("cannot set %s to %s: %w", file, value, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove will remove the cgroup of input container, if any, with the cgroups
+// created in it. This fails if the container's processes did not exit yet.
+func Remove(name string) error {
+	path, err := GetPath(name)
+	if err != nil {
+		// no delegation, no cgroup to remove
+		return nil //nolint: nilerr
+	}
+
+	cgroups := []string{}
+
+	err = filepath.WalkDir(path, func(cgroup string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			cgroups = append(cgroups, cgroup)
+		}
+
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// children first
+	slices.Reverse(cgroups)
+
+	for _, cgroup := range cgroups {
+		err = unix.Rmdir(cgroup)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -26,3 +26,34 @@ const (
 	// Private is the string we use for private namespaces.
 	Private string = "private"
 )
+
+const (
+	// RootfsBind is the rootfs mode bind-mounting an existing directory as rootfs.
+	RootfsBind string = "bind"
+	// RootfsOverlay is the rootfs mode using an existing directory as overlay lower dir.
+	RootfsOverlay string = "overlay"
+)
+
+// DefaultStopTimeout is the default number of seconds to wait for a container to
+// stop, before killing it.
+const DefaultStopTimeout = 10
+
+const (
+	// RestartNo is the restart policy never restarting a container.
+	RestartNo string = "no"
+	// RestartOnFailure is the restart policy restarting a container when it exits with a non-zero code.
+	RestartOnFailure string = "on-failure"
+	// RestartAlways is the restart policy always restarting a container, and starting it with start --all.
+	RestartAlways string = "always"
+	// RestartUnlessStopped is like RestartAlways, except for containers stopped by the user.
+	RestartUnlessStopped string = "unless-stopped"
+)
+
+// DefaultDetachKeys is the default key sequence to detach from a container's console.
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+// SystemdAlways is the systemd mode enabling it regardless of the entrypoint.
+const SystemdAlways = "always"
+
+// ZoneinfoDir is the host's directory containing the timezones for --tz.
+const ZoneinfoDir = "/usr/share/zoneinfo"
@@ -0,0 +1,830 @@
+// Package containerutils contains helpers and utilities for managing and creating
+// containers.
+package containerutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/utils"
+	"github.com/pkg/term/termios"
+	"golang.org/x/sys/unix"
+)
+
+// Frames exchanged on a console socket. Each frame is made of its kind, the
+// big endian uint32 length of its payload, and the payload.
+const (
+	// frameHello is sent by the monitor to new clients, with the tty and
+	// interactive flags of the console.
+	frameHello byte = iota
+	// frameStdout and frameStderr are sent by the monitor with the process output.
+	frameStdout
+	frameStderr
+	// frameExit is sent by the monitor with the big endian int32 exit code of the
+	// process, once its output was sent.
+	frameExit
+	// frameStdin is sent by clients with their input.
+	frameStdin
+	// frameCloseStdin is sent by clients when their input ends.
+	frameCloseStdin
+	// frameResize is sent by clients with the big endian uint16 rows and columns
+	// of their terminal.
+	frameResize
+	// frameSignal is sent by clients with a signal to send to the process.
+	frameSignal
+)
+
+// maxFrameSize is the maximum payload accepted in a console frame.
+const maxFrameSize = 1 << 20
+
+// consoleWriteTimeout is the time after which clients that are not reading
+// their output are dropped, so that they do not block the process.
+const consoleWriteTimeout = time.Second * 5
+
+// consoleAttachTimeout is the time a console waits for its first client, when
+// one was requested.
+const consoleAttachTimeout = time.Second * 30
+
+// maxLogLine is the size after which a line without newlines is logged anyway.
+const maxLogLine = 64 * 1024
+
+// GetConsolePath returns the path of the console socket of input container.
+// Sockets are kept in the runtime dir, as the container's dir could exceed the
+// length allowed for socket paths.
+func GetConsolePath(name string) string {
+	return filepath.Join(utils.GetLilipodRuntimeDir(), GetID(name)+".console")
+}
+
+// getExecConsolePath returns the path of the console socket of input exec
+// session of input container.
+func getExecConsolePath(name, session string) string {
+	return filepath.Join(utils.GetLilipodRuntimeDir(), GetID(name)+".exec-"+session)
+}
+
+// console holds the stdio of a process run by a monitor: its output is saved
+// in the logs, if any, and sent to the clients attached to the console socket,
+// that in turn can send input, window size changes and signals to the process.
+//
+// With tty, the process runs in a new pseudo-terminal, else it uses pipes and,
+// if interactive, a pipe for its stdin.
+type console struct {
+	tty         bool
+	interactive bool
+	logfile     *logging.LogFile
+	path        string
+	listener    net.Listener
+
+	attached     chan struct{}
+	attachedOnce sync.Once
+
+	clientsMutex sync.Mutex
+	clients      map[net.Conn]bool
+
+	processMutex sync.Mutex
+	process      *os.Process
+	stdin        io.WriteCloser
+	master       *os.File
+}
+
+// newConsole will create a console listening on input socket path.
+func newConsole(path string, tty, interactive bool, logfile *logging.LogFile) (*console, error) {
+	if len(path) >= len(unix.RawSockaddrUnix{}.Path) {
+		return nil, fmt.Errorf("console socket path %s is too long", path)
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return nil, err
+	}
+
+	// a stale socket of a previous run would prevent us to listen
+	_ = os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0o600)
+	if err != nil {
+		_ = listener.Close()
+
+		return nil, err
+	}
+
+	result := &console{
+		tty:         tty,
+		interactive: interactive,
+		logfile:     logfile,
+		path:        path,
+		listener:    listener,
+		attached:    make(chan struct{}),
+		clients:     map[net.Conn]bool{},
+	}
+
+	go result.accept()
+
+	return result, nil
+}
+
+// waitAttached will wait for the first client to attach to the console.
+func (c *console) waitAttached() error {
+	select {
+	case <-c.attached:
+		return nil
+	case <-time.After(consoleAttachTimeout):
+		return fmt.Errorf("no client attached to %s after %s", c.path, consoleAttachTimeout)
+	}
+}
+
+// run will run input cmd with the console's stdio, calling input started
+// function once it started, and return when it exits.
+func (c *console) run(cmd *exec.Cmd, started func(pid int)) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Foreground = false
+	cmd.SysProcAttr.Setsid = true
+
+	var wg sync.WaitGroup
+
+	// the child ends of the stdio, to be closed once the child has its own copy
+	childFiles := []*os.File{}
+
+	var stdin io.WriteCloser
+
+	var master *os.File
+
+	if c.tty {
+		ptyMaster, slave, err := termios.Pty()
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return err
+		}
+
+		defer func() { _ = ptyMaster.Close() }()
+
+		cmd.Stdin = slave
+		cmd.Stdout = slave
+		cmd.Stderr = slave
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+
+		childFiles = append(childFiles, slave)
+		master = ptyMaster
+		stdin = ptyMaster
+
+		wg.Add(1)
+
+		go c.copyOutput(&wg, ptyMaster, frameStdout, "out")
+	} else {
+		outR, outW, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+
+		errR, errW, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+
+		cmd.Stdout = outW
+		cmd.Stderr = errW
+
+		childFiles = append(childFiles, outW, errW)
+
+		if c.interactive {
+			inR, inW, err := os.Pipe()
+			if err != nil {
+				return err
+			}
+
+			cmd.Stdin = inR
+			childFiles = append(childFiles, inR)
+			stdin = inW
+		}
+
+		wg.Add(2)
+
+		go c.copyOutput(&wg, outR, frameStdout, "out")
+		go c.copyOutput(&wg, errR, frameStderr, "err")
+	}
+
+	err := cmd.Start()
+
+	// the child has its own copy of its stdio, close ours so that readers
+	// get EOF when the child exits.
+	for _, file := range childFiles {
+		_ = file.Close()
+	}
+
+	if err != nil {
+		if stdin != nil && !c.tty {
+			_ = stdin.Close()
+		}
+
+		return err
+	}
+
+	c.processMutex.Lock()
+	c.process = cmd.Process
+	c.stdin = stdin
+	c.master = master
+	c.processMutex.Unlock()
+
+	if started != nil {
+		started(cmd.Process.Pid)
+	}
+
+	err = cmd.Wait()
+
+	c.processMutex.Lock()
+	c.process = nil
+	c.stdin = nil
+	c.master = nil
+	c.processMutex.Unlock()
+
+	if stdin != nil && !c.tty {
+		_ = stdin.Close()
+	}
+
+	// wait for the remaining output to be sent, without hanging on
+	// processes that outlived cmd and still hold the pipes.
+	copied := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(copied)
+	}()
+
+	select {
+	case <-copied:
+	case <-time.After(time.Second):
+		logging.LogDebug("output still open after exit, stop copying")
+	}
+
+	return err
+}
+
+// exit will send input exit code to the attached clients, and disconnect them.
+func (c *console) exit(code int) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(int32(code)))
+
+	c.broadcast(frameExit, payload)
+
+	c.clientsMutex.Lock()
+	defer c.clientsMutex.Unlock()
+
+	for conn := range c.clients {
+		_ = conn.Close()
+		delete(c.clients, conn)
+	}
+}
+
+// close will stop listening and remove the console socket.
+func (c *console) close() {
+	_ = c.listener.Close()
+	_ = os.Remove(c.path)
+
+	c.clientsMutex.Lock()
+	defer c.clientsMutex.Unlock()
+
+	for conn := range c.clients {
+		_ = conn.Close()
+		delete(c.clients, conn)
+	}
+}
+
+// accept will accept clients until the console is closed.
+func (c *console) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		hello := []byte{0, 0}
+		if c.tty {
+			hello[0] = 1
+		}
+
+		if c.interactive {
+			hello[1] = 1
+		}
+
+		c.clientsMutex.Lock()
+
+		_ = conn.SetWriteDeadline(time.Now().Add(consoleWriteTimeout))
+
+		err = writeFrame(conn, frameHello, hello)
+		if err != nil {
+			c.clientsMutex.Unlock()
+
+			_ = conn.Close()
+
+			continue
+		}
+
+		c.clients[conn] = true
+		c.clientsMutex.Unlock()
+
+		logging.LogDebug("client attached to %s", c.path)
+
+		c.attachedOnce.Do(func() { close(c.attached) })
+
+		go c.serve(conn)
+	}
+}
+
+// serve will handle the frames sent by input client, until it disconnects.
+func (c *console) serve(conn net.Conn) {
+	defer func() {
+		c.clientsMutex.Lock()
+		delete(c.clients, conn)
+		c.clientsMutex.Unlock()
+
+		_ = conn.Close()
+
+		logging.LogDebug("client detached from %s", c.path)
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		kind, payload, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+
+		c.processMutex.Lock()
+		process, stdin, master := c.process, c.stdin, c.master
+		c.processMutex.Unlock()
+
+		switch kind {
+		case frameStdin:
+			if stdin != nil {
+				_, _ = stdin.Write(payload)
+			}
+		case frameCloseStdin:
+			// a terminal has no end of input, the process gets ctrl-d instead
+			if stdin != nil && !c.tty {
+				_ = stdin.Close()
+			}
+		case frameResize:
+			if master != nil && len(payload) == 4 {
+				_ = unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+					Row: binary.BigEndian.Uint16(payload[0:2]),
+					Col: binary.BigEndian.Uint16(payload[2:4]),
+				})
+			}
+		case frameSignal:
+			if process != nil && len(payload) == 1 {
+				_ = process.Signal(syscall.Signal(payload[0]))
+			}
+		}
+	}
+}
+
+// broadcast will send input frame to all the attached clients, dropping the
+// ones that cannot keep up.
+func (c *console) broadcast(kind byte, payload []byte) {
+	c.clientsMutex.Lock()
+	defer c.clientsMutex.Unlock()
+
+	for conn := range c.clients {
+		_ = conn.SetWriteDeadline(time.Now().Add(consoleWriteTimeout))
+
+		err := writeFrame(conn, kind, payload)
+		if err != nil {
+			logging.LogDebug("dropping client of %s: %v", c.path, err)
+
+			_ = conn.Close()
+			delete(c.clients, conn)
+		}
+	}
+}
+
+// copyOutput will send the output read from input reader to the attached
+// clients as input frame kind, and append each line to the logs, if any,
+// prefixed with the timestamp and input stream name.
+func (c *console) copyOutput(wg *sync.WaitGroup, reader io.ReadCloser, kind byte, stream string) {
+	defer wg.Done()
+	defer func() { _ = reader.Close() }()
+
+	buffer := make([]byte, 32*1024)
+	line := []byte{}
+
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			c.broadcast(kind, buffer[:n])
+
+			line = append(line, buffer[:n]...)
+
+			for {
+				index := bytes.IndexByte(line, '\n')
+				if index < 0 && len(line) < maxLogLine {
+					break
+				}
+
+				if index < 0 {
+					index = len(line)
+				}
+
+				c.log(stream, line[:index])
+
+				line = line[min(index+1, len(line)):]
+			}
+		}
+
+		// reading a pseudo-terminal whose slave is closed fails with EIO
+		if err != nil {
+			if len(line) > 0 {
+				c.log(stream, line)
+			}
+
+			return
+		}
+	}
+}
+
+// log will append input line to the logs.
+func (c *console) log(stream string, line []byte) {
+	if c.logfile == nil {
+		return
+	}
+
+	text := strings.TrimSuffix(string(line), "\r")
+
+	err := c.logfile.Append(fmt.Sprintf("%d:%s:%s", time.Now().Unix(), stream, text))
+	if err != nil {
+		logging.LogError("could not log output: %v", err)
+	}
+}
+
+// writeFrame will write a console frame of input kind and payload.
+func writeFrame(writer io.Writer, kind byte, payload []byte) error {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+
+	_, err := writer.Write(append(frame, payload...))
+
+	return err
+}
+
+// readFrame will read a console frame, returning its kind and payload.
+func readFrame(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("console frame too big: %d bytes", size)
+	}
+
+	payload := make([]byte, size)
+
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// frameWriter serializes the frames written by the client's goroutines.
+type frameWriter struct {
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func (w *frameWriter) write(kind byte, payload []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return writeFrame(w.conn, kind, payload)
+}
+
+// ParseDetachKeys will parse input detach keys, a comma separated list of
+// characters or ctrl-<value> keys, where value is a letter or one of @, [, \, ],
+// ^ and _, like in docker. An empty input disables detaching.
+func ParseDetachKeys(input string) ([]byte, error) {
+	result := []byte{}
+
+	if input == "" {
+		return result, nil
+	}
+
+	for _, key := range strings.Split(input, ",") {
+		if len(key) == 1 {
+			result = append(result, key[0])
+
+			continue
+		}
+
+		value, ok := strings.CutPrefix(strings.ToLower(key), "ctrl-")
+		if !ok || len(value) != 1 {
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+
+		char := value[0]
+
+		switch {
+		case char >= 'a' && char <= 'z':
+			result = append(result, char-'a'+1)
+		case strings.ContainsRune("@[\\]^_", rune(char)):
+			result = append(result, char-'@')
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+	}
+
+	return result, nil
+}
+
+// detachScanner looks for the detach keys in the client's input.
+type detachScanner struct {
+	keys    []byte
+	matched int
+}
+
+// scan returns input without the detach keys, and whether they were all typed.
+// Keys typed while matching are held until the sequence is complete or broken,
+// in which case they are returned as they are.
+func (d *detachScanner) scan(input []byte) ([]byte, bool) {
+	if len(d.keys) == 0 {
+		return input, false
+	}
+
+	result := make([]byte, 0, len(input)+d.matched)
+
+	for _, char := range input {
+		if char == d.keys[d.matched] {
+			d.matched++
+
+			if d.matched == len(d.keys) {
+				return result, true
+			}
+
+			continue
+		}
+
+		result = append(result, d.keys[:d.matched]...)
+		d.matched = 0
+
+		if char == d.keys[0] {
+			d.matched = 1
+
+			continue
+		}
+
+		result = append(result, char)
+	}
+
+	return result, false
+}
+
+// Attach will attach the current terminal to the console of input container,
+// until it exits or input detach keys are typed. If stdin is false, no input
+// is sent to the container.
+// The container's exit code is returned as an ExitCodeError.
+func Attach(name string, stdin bool, detachKeys string) error {
+	keys, err := ParseDetachKeys(detachKeys)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("unix", GetConsolePath(name))
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return fmt.Errorf("container %s is not running", name)
+	}
+
+	return attachConsole(conn, stdin, keys)
+}
+
+// dialConsole will connect to the console socket in input path, retrying
+// until its monitor is listening, or reports on input ready channel that it
+// failed.
+func dialConsole(path string, ready <-chan error) (net.Conn, error) {
+	timeout := time.After(consoleAttachTimeout)
+
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case err := <-ready:
+			if err == nil {
+				err = errors.New("monitor started without waiting for the console")
+			}
+
+			return nil, err
+		case <-timeout:
+			return nil, fmt.Errorf("cannot connect to %s: %w", path, err)
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+// attachConsole will attach the current terminal to input console connection,
+// see Attach.
+func attachConsole(conn net.Conn, stdin bool, keys []byte) error {
+	defer func() { _ = conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	writer := &frameWriter{conn: conn}
+
+	kind, hello, err := readFrame(reader)
+	if err != nil || kind != frameHello || len(hello) != 2 {
+		return fmt.Errorf("invalid console handshake: %v", err)
+	}
+
+	tty := hello[0] == 1
+	stdin = stdin && hello[1] == 1
+
+	if tty {
+		restore := makeRaw(os.Stdin, stdin)
+		defer restore()
+
+		resize := make(chan os.Signal, 1)
+		signal.Notify(resize, syscall.SIGWINCH)
+
+		defer signal.Stop(resize)
+
+		go func() {
+			for {
+				size := getWindowSize()
+				if size != nil {
+					_ = writer.write(frameResize, size)
+				}
+
+				_, ok := <-resize
+				if !ok {
+					return
+				}
+			}
+		}()
+	} else {
+		// without a terminal, signals are the only way to reach the process
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP,
+			syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+		defer signal.Stop(signals)
+
+		go func() {
+			for sig := range signals {
+				signum, ok := sig.(syscall.Signal)
+				if ok {
+					_ = writer.write(frameSignal, []byte{byte(signum)})
+				}
+			}
+		}()
+	}
+
+	detached := make(chan struct{})
+
+	if stdin {
+		go forwardStdin(writer, &detachScanner{keys: keys}, tty, detached)
+	}
+
+	for {
+		kind, payload, err := readFrame(reader)
+		if err != nil {
+			select {
+			case <-detached:
+				logging.LogDebug("detached from console")
+
+				return nil
+			default:
+				return fmt.Errorf("lost connection to the console: %w", err)
+			}
+		}
+
+		switch kind {
+		case frameStdout:
+			_, _ = os.Stdout.Write(payload)
+		case frameStderr:
+			_, _ = os.Stderr.Write(payload)
+		case frameExit:
+			if len(payload) != 4 {
+				return errors.New("invalid exit frame")
+			}
+
+			code := int(int32(binary.BigEndian.Uint32(payload)))
+			if code != 0 {
+				return &procutils.ExitCodeError{Code: code}
+			}
+
+			return nil
+		}
+	}
+}
+
+// forwardStdin will send our stdin to the console until input detach keys
+// are typed, in which case detached is closed and so is the connection.
+func forwardStdin(writer *frameWriter, scanner *detachScanner, tty bool, detached chan struct{}) {
+	buffer := make([]byte, 32*1024)
+
+	for {
+		n, err := os.Stdin.Read(buffer)
+		if n > 0 {
+			input, detach := scanner.scan(buffer[:n])
+
+			if len(input) > 0 {
+				err := writer.write(frameStdin, input)
+				if err != nil {
+					return
+				}
+			}
+
+			if detach {
+				close(detached)
+
+				_ = writer.conn.Close()
+
+				return
+			}
+		}
+
+		if err != nil {
+			if !tty {
+				_ = writer.write(frameCloseStdin, nil)
+			}
+
+			return
+		}
+	}
+}
+
+// makeRaw will put input terminal in raw mode, if it is one and input is
+// enabled, and return the function restoring it.
+func makeRaw(terminal *os.File, input bool) func() {
+	var previous unix.Termios
+
+	if !input || termios.Tcgetattr(terminal.Fd(), &previous) != nil {
+		return func() {}
+	}
+
+	raw := previous
+	termios.Cfmakeraw(&raw)
+
+	err := termios.Tcsetattr(terminal.Fd(), termios.TCSANOW, &raw)
+	if err != nil {
+		logging.LogDebug("cannot make terminal raw: %v", err)
+
+		return func() {}
+	}
+
+	return func() {
+		_ = termios.Tcsetattr(terminal.Fd(), termios.TCSANOW, &previous)
+	}
+}
+
+// getWindowSize returns the resize frame payload for our terminal, or nil if
+// we have none.
+func getWindowSize() []byte {
+	for _, terminal := range []*os.File{os.Stdout, os.Stdin, os.Stderr} {
+		size, err := unix.IoctlGetWinsize(int(terminal.Fd()), unix.TIOCGWINSZ)
+		if err == nil {
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint16(payload[0:2], size.Row)
+			binary.BigEndian.PutUint16(payload[2:4], size.Col)
+
+			return payload
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package containerutils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseDetachKeys(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []byte
+		wantErr bool
+	}{
+		{input: "", want: []byte{}},
+		{input: "ctrl-p,ctrl-q", want: []byte{16, 17}},
+		{input: "CTRL-A", want: []byte{1}},
+		{input: "ctrl-z", want: []byte{26}},
+		{input: "ctrl-@,ctrl-[,ctrl-\\,ctrl-],ctrl-^,ctrl-_", want: []byte{0, 27, 28, 29, 30, 31}},
+		{input: "a,b", want: []byte{'a', 'b'}},
+		{input: "ctrl-a,x", want: []byte{1, 'x'}},
+		{input: "ctrl-", wantErr: true},
+		{input: "ctrl-ab", wantErr: true},
+		{input: "ctrl-1", wantErr: true},
+		{input: "alt-a", wantErr: true},
+		{input: "ab", wantErr: true},
+		{input: "ctrl-p,", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := ParseDetachKeys(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseDetachKeys(%q) error = %v, wantErr %v", test.input, err, test.wantErr)
+			}
+
+			if !test.wantErr && !bytes.Equal(got, test.want) {
+				t.Errorf("ParseDetachKeys(%q) = %v, want %v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDetachScannerScan(t *testing.T) {
+	type step struct {
+		input      string
+		want       string
+		wantDetach bool
+	}
+
+	tests := []struct {
+		name  string
+		keys  []byte
+		steps []step
+	}{
+		{
+			name:  "no keys",
+			keys:  nil,
+			steps: []step{{input: "\x10\x11", want: "\x10\x11"}},
+		},
+		{
+			name:  "plain input",
+			keys:  []byte{16, 17},
+			steps: []step{{input: "hello", want: "hello"}},
+		},
+		{
+			name:  "detach",
+			keys:  []byte{16, 17},
+			steps: []step{{input: "ls\x10\x11", want: "ls", wantDetach: true}},
+		},
+		{
+			name: "detach across reads",
+			keys: []byte{16, 17},
+			steps: []step{
+				{input: "ls\x10", want: "ls"},
+				{input: "\x11", want: "", wantDetach: true},
+			},
+		},
+		{
+			name:  "broken sequence is passed through",
+			keys:  []byte{16, 17},
+			steps: []step{{input: "\x10a", want: "\x10a"}},
+		},
+		{
+			name: "broken sequence across reads",
+			keys: []byte{16, 17},
+			steps: []step{
+				{input: "\x10", want: ""},
+				{input: "a", want: "\x10a"},
+			},
+		},
+		{
+			name:  "sequence restarted",
+			keys:  []byte{16, 17},
+			steps: []step{{input: "\x10\x10\x11", want: "\x10", wantDetach: true}},
+		},
+		{
+			name:  "single key",
+			keys:  []byte{1},
+			steps: []step{{input: "a\x01b", want: "a", wantDetach: true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scanner := &detachScanner{keys: test.keys}
+
+			for _, step := range test.steps {
+				got, detach := scanner.scan([]byte(step.input))
+				if string(got) != step.want || detach != step.wantDetach {
+					t.Errorf("scan(%q) = %q, %v, want %q, %v",
+						step.input, got, detach, step.want, step.wantDetach)
+				}
+			}
+		})
+	}
+}
@@ -14,17 +14,21 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"text/template"
 	"time"
 
+	"github.com/89luca89/lilipod/pkg/cgrouputils"
 	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/imageutils"
 	"github.com/89luca89/lilipod/pkg/logging"
 	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/securityutils"
 	"github.com/89luca89/lilipod/pkg/utils"
 	"github.com/google/go-containerregistry/pkg/legacy"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -80,8 +84,178 @@ func GetRootfsDir(name string) string {
 	return filepath.Join(GetDir(name), "rootfs")
 }
 
+// GetOverlayDir returns the path on the filesystem where container's overlay
+// upper and work dirs are located, used with an external overlay rootfs.
+func GetOverlayDir(name string) string {
+	return filepath.Join(GetDir(name), "overlay")
+}
+
+// GetRootfsPath returns the path on the host of input file inside the rootfs of
+// input container.
+// For containers using an external rootfs, the path is resolved inside said
+// directory, for overlay rootfs, if write is specified or the file was already
+// modified, the path inside the upper dir is returned.
+// When writing to an overlay rootfs, the needed directories are created in the
+// upper dir.
+func GetRootfsPath(config utils.Config, file string, write bool) string {
+	switch config.Rootfs {
+	case constants.RootfsBind:
+		return filepath.Join(config.Image, file)
+	case constants.RootfsOverlay:
+		upper := filepath.Join(GetOverlayDir(config.ID), "upper", file)
+		lower := filepath.Join(config.Image, file)
+
+		if write {
+			dir := filepath.Dir(upper)
+
+			info, err := os.Stat(lower)
+			if err == nil && info.IsDir() {
+				dir = upper
+			}
+
+			_ = os.MkdirAll(dir, 0o755)
+
+			return upper
+		}
+
+		if fileutils.Exist(upper) {
+			return upper
+		}
+
+		return lower
+	default:
+		return filepath.Join(GetRootfsDir(config.ID), file)
+	}
+}
+
+// ParseRootfs will parse input --rootfs value in the form of PATH[:O], returning
+// the absolute path of the directory, and the rootfs mode, bind or overlay if
+// the :O suffix is specified.
+// Bind rootfs are modified like any other rootfs, both by the container and by
+// us, see injectAgent, setupKeepIDUser and setupMachineID.
+func ParseRootfs(input string) (string, string, error) {
+	mode := constants.RootfsBind
+
+	if strings.HasSuffix(input, ":O") {
+		mode = constants.RootfsOverlay
+		input = strings.TrimSuffix(input, ":O")
+	}
+
+	path, err := filepath.Abs(input)
+	if err != nil {
+		return "", "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid rootfs %s: %w", path, err)
+	}
+
+	if !info.IsDir() {
+		return "", "", fmt.Errorf("invalid rootfs %s: not a directory", path)
+	}
+
+	// overlay options are comma and colon separated
+	if mode == constants.RootfsOverlay && strings.ContainsAny(path, ",:") {
+		return "", "", fmt.Errorf("invalid rootfs %s: overlay paths cannot contain ',' or ':'", path)
+	}
+
+	return path, mode, nil
+}
+
+// ParseEntrypoint will parse input --entrypoint value, which can be either a
+// single command or a JSON array, eg: '["/bin/sh", "-c"]'.
+// An empty input resets the entrypoint.
+func ParseEntrypoint(input string) []string {
+	if input == "" {
+		return []string{}
+	}
+
+	var result []string
+
+	if strings.HasPrefix(input, "[") && json.Unmarshal([]byte(input), &result) == nil {
+		return result
+	}
+
+	return []string{input}
+}
+
+// GetStatePath returns the path on the filesystem of the container's state file.
+func GetStatePath(name string) string {
+	return filepath.Join(GetDir(name), "state")
+}
+
+// GetState returns the state of the container with input name or id.
+// A running state is verified against the pid and start time of the container's
+// init process, so that containers that died without updating their state, or
+// whose pid was reused, are reported as exited. The same goes for containers
+// waiting to be restarted by a monitor that is gone.
+func GetState(name string) utils.State {
+	state, err := utils.LoadState(GetStatePath(name))
+	if err != nil {
+		logging.LogDebug("cannot read state of %s: %v, recovering it", name, err)
+
+		state = recoverState(name)
+	}
+
+	if state.Status == utils.StateRunning {
+		startTime, err := procutils.GetStartTime(state.Pid)
+		if err != nil || startTime != state.StartTime || !procutils.IsPidRunning(state.Pid) {
+			logging.LogDebug("container %s init process %d is gone", name, state.Pid)
+
+			state.Status = utils.StateExited
+		}
+	}
+
+	if state.Status == utils.StateRestarting && !procutils.IsPidRunning(state.MonitorPid) {
+		logging.LogDebug("container %s monitor %d is gone", name, state.MonitorPid)
+
+		state.Status = utils.StateExited
+	}
+
+	return state
+}
+
 // GetPid will return the pid of the process running the container with input id.
 func GetPid(id string) (int, error) {
+	state := GetState(id)
+	if state.Status != utils.StateRunning {
+		return -1, fmt.Errorf("container %s is not running", id)
+	}
+
+	return state.Pid, nil
+}
+
+// recoverState will rebuild the state of input container, in case it is
+// missing, by searching its init process in /proc.
+func recoverState(name string) utils.State {
+	state := utils.State{Status: utils.StateExited}
+
+	pid, err := findPid(name)
+	if err == nil {
+		startTime, err := procutils.GetStartTime(pid)
+		if err == nil {
+			state = utils.State{Status: utils.StateRunning, Pid: pid, StartTime: startTime}
+		}
+	}
+
+	if !fileutils.Exist(GetDir(name)) {
+		return state
+	}
+
+	err = utils.UpdateState(GetStatePath(name), func(current *utils.State) {
+		*current = state
+	})
+	if err != nil {
+		logging.LogDebug("cannot save state of %s: %v", name, err)
+	}
+
+	return state
+}
+
+// findPid will search in /proc the first process running inside the container
+// with input id.
+func findPid(id string) (int, error) {
 	id = GetID(id)
 	idb := []byte(id)
 
@@ -131,7 +305,6 @@ func GetContainerInfo(
 ) (*utils.Config, error) {
 	configPath := filepath.Join(ContainerDir, container, "config")
 	directorySize := ""
-	state := "stopped"
 
 	config, err := utils.LoadConfig(configPath)
 	if err != nil {
@@ -141,17 +314,17 @@ func GetContainerInfo(
 		return nil, exec.Command(os.Args[0], "rm", container).Run()
 	}
 
+	state := GetState(container)
+
+	config.Status = state.Status
+	config.State = &state
+
 	if !filterContainer(config, filters) {
 		// this container does not match any filter, return nil, and no errors.
 		//nolint: nilnil
 		return nil, nil
 	}
 
-	isRunning := IsRunning(config.Names)
-	if isRunning {
-		state = "running"
-	}
-
 	if size {
 		directorySize, err = fileutils.DiscUsageMegaBytes(filepath.Join(ContainerDir, container))
 		if err != nil {
@@ -159,7 +332,6 @@ func GetContainerInfo(
 		}
 	}
 
-	config.Status = state
 	config.Size = directorySize
 
 	return &config, nil
@@ -170,8 +342,24 @@ func GetContainerInfo(
 // This function will read the oci-image manifest and properly unpack the layers in the right order to generate
 // a valid rootfs.
 // Untarring process will follow the keep-id option if specified in order to ensure no permission problems.
+// If the config specifies an external Rootfs, image resolution is skipped and input
+// image is the path to the rootfs directory, which is mounted when the container starts.
+//
+// The image config is used for defaults following docker semantics: input config's
+// Entrypoint is the command, appended to the image's Entrypoint, or to input entrypoint
+// if not nil. If no command is specified, the image's Cmd is used, unless the entrypoint
+// is overridden. Empty Workdir, User and Stopsignal are taken from the image,
+// except for systemd containers, that are stopped with SIGRTMIN+3,
+// as are the Healthcheck fields not set in input config,
+// image's Labels are merged with input ones, and image's Volumes become anonymous volumes.
 // Generated config will be saved inside the container's dir. This will NOT be an oci-compatible container config.
-func CreateRootfs(image string, name string, createConfig utils.Config, uid, gid string) error {
+func CreateRootfs(
+	image string,
+	name string,
+	createConfig utils.Config,
+	entrypoint []string,
+	uid, gid string,
+) error {
 	logging.LogDebug("preparing rootfs for new container %s", name)
 
 	containerDIR := GetRootfsDir(name)
@@ -183,13 +371,171 @@ func CreateRootfs(image string, name string, createConfig utils.Config, uid, gid
 		return err
 	}
 
+	var config legacy.LayerConfigFile
+
+	if createConfig.Rootfs == "" {
+		config, err = unpackImage(image, containerDIR, createConfig.Userns)
+		if err != nil {
+			return err
+		}
+	} else {
+		logging.LogDebug("using external rootfs %s as %s", image, createConfig.Rootfs)
+
+		if createConfig.Rootfs == constants.RootfsOverlay {
+			for _, dir := range []string{"upper", "work"} {
+				err = os.MkdirAll(filepath.Join(GetOverlayDir(name), dir), 0o755)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// there is no image config, so let's provide sane defaults
+		config.Config.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+		config.Config.Cmd = []string{"/bin/sh"}
+	}
+
+	logging.LogDebug("setting up custom configs")
+
+	logging.LogDebug("merging custom env with default image env")
+	// custom env wins over the image env, which wins over the defaults
+	createConfig.Env = utils.MergeEnv(
+		[]string{"TERM=xterm", "HOSTNAME=" + createConfig.Hostname},
+		config.Config.Env,
+		createConfig.Env,
+	)
+	createConfig.Env = utils.UnsetEnv(createConfig.Env, createConfig.Unsetenv)
+
+	if entrypoint == nil {
+		entrypoint = config.Config.Entrypoint
+	} else {
+		// overriding the entrypoint resets the default command
+		config.Config.Cmd = nil
+	}
+
+	// if empty command, default to image default command
+	if len(createConfig.Entrypoint) == 0 {
+		logging.LogDebug("command not specified, fallbacking to default one in image manifest")
+
+		createConfig.Entrypoint = config.Config.Cmd
+	}
+
+	createConfig.Entrypoint = append(append([]string{}, entrypoint...), createConfig.Entrypoint...)
+
+	if createConfig.Workdir == "" {
+		createConfig.Workdir = config.Config.WorkingDir
+	}
+
+	if createConfig.Workdir == "" {
+		createConfig.Workdir = "/"
+	}
+
+	if createConfig.User == "" {
+		createConfig.User = config.Config.User
+	}
+
+	if createConfig.User == "" {
+		createConfig.User = "root:root"
+	}
+
+	// systemd is stopped with SIGRTMIN+3, regardless of the image
+	if createConfig.Stopsignal == "" && IsSystemd(createConfig) {
+		createConfig.Stopsignal = "SIGRTMIN+3"
+	}
+
+	if createConfig.Stopsignal == "" {
+		createConfig.Stopsignal = config.Config.StopSignal
+	}
+
+	if createConfig.Stopsignal == "" {
+		createConfig.Stopsignal = "SIGTERM"
+	}
+
+	var imageHealthcheck *utils.Healthcheck
+	if config.Config.Healthcheck != nil {
+		imageHealthcheck = &utils.Healthcheck{
+			Test:        config.Config.Healthcheck.Test,
+			Interval:    config.Config.Healthcheck.Interval,
+			Timeout:     config.Config.Healthcheck.Timeout,
+			StartPeriod: config.Config.Healthcheck.StartPeriod,
+			Retries:     config.Config.Healthcheck.Retries,
+		}
+	}
+
+	createConfig.Healthcheck = utils.MergeHealthcheck(imageHealthcheck, createConfig.Healthcheck)
+
+	logging.LogDebug("merging image labels")
+
+	labels := map[string]string{}
+
+	for key, value := range config.Config.Labels {
+		labels[key] = value
+	}
+
+	for key, value := range createConfig.Labels {
+		labels[key] = value
+	}
+
+	createConfig.Labels = labels
+
+	logging.LogDebug("adding image volumes as anonymous volumes")
+
+	destinations := map[string]bool{}
+	for _, mount := range createConfig.Mounts {
+		destinations[filepath.Clean(getMountDestination(mount))] = true
+	}
+
+	volumes := []string{}
+	for volume := range config.Config.Volumes {
+		if !destinations[filepath.Clean(volume)] {
+			volumes = append(volumes, filepath.Clean(volume))
+		}
+	}
+
+	sort.Strings(volumes)
+
+	createConfig.Mounts = append(createConfig.Mounts, volumes...)
+
+	createConfig.Uidmap = uid
+	createConfig.Gidmap = gid
+
+	// save the config to file
+	configPath := filepath.Join(GetDir(name), "config")
+
+	logging.LogDebug("saving config")
+
+	err = utils.SaveConfig(createConfig, configPath)
+	if err != nil {
+		return err
+	}
+
+	err = utils.UpdateState(GetStatePath(name), func(state *utils.State) {
+		*state = utils.State{Status: utils.StateCreated}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = setupKeepIDUser(createConfig, createConfig.Sudo)
+	if err != nil {
+		return err
+	}
+
+	logging.LogDebug("done")
+
+	return nil
+}
+
+// unpackImage will extract the layers of input image into containerDIR, pulling
+// the image if not found, and return the image's config.
+func unpackImage(image, containerDIR, userns string) (legacy.LayerConfigFile, error) {
 	logging.LogDebug("looking up image %s", image)
 
 	imageDir := imageutils.GetPath(image)
 	if !fileutils.Exist(imageDir) {
 		_, err := imageutils.Pull(image, false)
 		if err != nil {
-			return err
+			return legacy.LayerConfigFile{}, err
 		}
 	}
 
@@ -198,30 +544,34 @@ func CreateRootfs(image string, name string, createConfig utils.Config, uid, gid
 	// get manifest
 	manifestFile, err := fileutils.ReadFile(filepath.Join(imageDir, "manifest.json"))
 	if err != nil {
-		return err
+		return legacy.LayerConfigFile{}, err
 	}
 
 	var manifest v1.Manifest
 
 	err = json.Unmarshal(manifestFile, &manifest)
 	if err != nil {
-		return err
+		return legacy.LayerConfigFile{}, err
 	}
 
 	logging.LogDebug("extracting image's layers")
 
 	for _, layer := range manifest.Layers {
-		layerDigest := strings.Split(layer.Digest.String(), ":")[1] + ".tar.gz"
+		layerFile := filepath.Join(imageDir, imageutils.GetLayerFileName(layer))
+		if !fileutils.Exist(layerFile) {
+			// images pulled by older versions always saved layers as .tar.gz
+			layerFile = filepath.Join(imageDir, layer.Digest.Hex+".tar.gz")
+		}
 
-		logging.LogDebug("extracting layer %s in %s", layerDigest, containerDIR)
+		logging.LogDebug("extracting layer %s in %s", layerFile, containerDIR)
 
 		err = fileutils.UntarFile(
-			filepath.Join(imageDir, layerDigest),
+			layerFile,
 			containerDIR,
-			createConfig.Userns,
+			userns,
 		)
 		if err != nil {
-			return err
+			return legacy.LayerConfigFile{}, err
 		}
 	}
 
@@ -231,47 +581,14 @@ func CreateRootfs(image string, name string, createConfig utils.Config, uid, gid
 	// this is useful in case we need to setup defaults like env and entrypoint
 	configFile, err := fileutils.ReadFile(filepath.Join(imageDir, "config.json"))
 	if err != nil {
-		return err
+		return legacy.LayerConfigFile{}, err
 	}
 
 	var config legacy.LayerConfigFile
 
 	err = json.Unmarshal(configFile, &config)
-	if err != nil {
-		return err
-	}
-
-	logging.LogDebug("setting up custom configs")
-
-	logging.LogDebug("appending custom env to default image env")
-	// append custom env to default image env
-	createConfig.Env = append(createConfig.Env, config.Config.Env...)
-	createConfig.Env = append(createConfig.Env, "HOSTNAME="+createConfig.Hostname)
-	createConfig.Env = append(createConfig.Env, "TERM=xterm")
-
-	// if empty entrypoint, default to image default entrypoint
-	if len(createConfig.Entrypoint) == 0 || createConfig.Entrypoint == nil {
-		logging.LogDebug("entrypoint not specified, fallbacking to default one in image manifest")
-
-		createConfig.Entrypoint = config.Config.Cmd
-	}
-
-	createConfig.Uidmap = uid
-	createConfig.Gidmap = gid
-
-	// save the config to file
-	configPath := filepath.Join(GetDir(name), "config")
-
-	logging.LogDebug("saving config")
-
-	err = utils.SaveConfig(createConfig, configPath)
-	if err != nil {
-		return err
-	}
 
-	logging.LogDebug("done")
-
-	return nil
+	return config, err
 }
 
 // Rename will change the name of oldContainer to newContainer.
@@ -330,148 +647,259 @@ func Rename(oldContainer string, newContainer string) error {
 	return utils.SaveConfig(config, filepath.Join(GetDir(newContainer), "config"))
 }
 
-// Start will enter the target container.
-// If tty is specified, the container will be started in interactive mode with full shell.
-// If interactive only is specified, container will be started in interactive mode, but only stdin will be forwarded.
-// Else the container will be started in background and all output will be saved in the logs.
-func Start(interactive, tty bool, config utils.Config) error {
-	logging.LogDebug("entering container")
+// Start will start the target container through its monitor, see Monitor.
+// If tty is specified, the container is started with a pseudo-terminal, if interactive
+// is specified, its stdin is kept open.
+// If attach is specified, the current terminal is attached to the container's console
+// and this returns when the container exits, with its exit code as an ExitCodeError,
+// or when the detach keys are typed. Else this returns once the container started.
+func Start(opts ConsoleOptions, config utils.Config) error {
+	args := append(opts.args(), config.ID)
 
-	path := GetRootfsDir(config.ID)
+	return runMonitor(config.Names, args, opts, GetConsolePath(config.ID))
+}
 
-	logging.LogDebug("searching pty agent")
+// prepareStart will prepare the rootfs of input container and return the
+// command that will start it.
+func prepareStart(config utils.Config) (*exec.Cmd, error) {
+	logging.LogDebug("entering container")
 
-	ptyFile, err := fileutils.ReadFile(filepath.Join(utils.LilipodBinPath, "pty"))
+	// inject the agent where it will be visible in the rootfs
+	err := injectAgent(GetRootfsPath(config, "/", true))
 	if err != nil {
-		logging.LogError("failed to read pty agent: %v", err)
-
-		return err
+		return nil, err
 	}
 
-	if !fileutils.Exist(filepath.Join(path, constants.PtyAgentPath)) {
-		logging.LogDebug("injecting pty agent")
+	err = setupKeepIDUser(config, false)
+	if err != nil {
+		return nil, err
+	}
 
-		err = os.MkdirAll(filepath.Join(path, filepath.Base(constants.PtyAgentPath)), 0o755)
+	if IsSystemd(config) {
+		err = setupMachineID(config)
 		if err != nil {
-			logging.LogError("failed to create path for pty agent: %v", err)
-
-			return err
+			return nil, err
 		}
+	}
+
+	logging.LogDebug("ready to start the container")
+
+	cmd, err := generateEnterCommand(config)
+	if err != nil {
+		logging.LogError("failed to generate enter cmd: %v", err)
+
+		return nil, err
+	}
 
-		err = fileutils.WriteFile(filepath.Join(path, constants.PtyAgentPath), ptyFile, 0o755)
+	// the container is started straight in its cgroup, so that it cannot
+	// escape its limits
+	if config.Resources != nil {
+		cgroup, err := cgrouputils.Create(config.ID, *config.Resources)
 		if err != nil {
-			logging.LogError("failed to inject pty agent: %v", err)
+			logging.LogDebug("error: %+v", err)
 
-			return err
+			return nil, fmt.Errorf("setup cgroup: %w", err)
 		}
 
-		logging.LogDebug("pty agent injected")
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = cgroup
 	}
 
-	if !fileutils.Exist(filepath.Join(path, constants.PtyAgentPath)) {
-		logging.LogError(
-			"failed to inject agent in %s",
-			filepath.Join(path, constants.PtyAgentPath),
-		)
+	logging.LogDebug("container is starting with %+v", cmd.SysProcAttr)
 
-		return fmt.Errorf(
-			"failed to inject agent in %s",
-			filepath.Join(path, constants.PtyAgentPath),
-		)
+	logging.LogDebug("starting the container, executing %v", cmd.Args)
+
+	return cmd, nil
+}
+
+// cleanup will run the post-stop actions of input container, once it exited.
+// Mounts are not undone, as they all live in the container's mount namespace
+// and are gone with it.
+func cleanup(config utils.Config) {
+	if config.AutoRemove {
+		logging.LogDebug("removing container %s", config.Names)
+
+		err := os.RemoveAll(GetDir(config.ID))
+		if err != nil {
+			logging.LogWarning("cannot remove container %s: %v", config.Names, err)
+		}
 	}
+}
 
-	logging.LogDebug("ready to start the container")
+// GetLogFile returns the log file of input container, rotated as configured.
+func GetLogFile(config utils.Config) *logging.LogFile {
+	return &logging.LogFile{
+		Path:     filepath.Join(GetDir(config.ID), "current-logs"),
+		MaxSize:  config.LogMaxSize,
+		MaxFiles: config.LogMaxFiles,
+	}
+}
 
-	cmd, err := generateEnterCommand(config)
+// setRunning will save in the state of input container that it is running
+// with input init pid, supervised by us, after input number of restarts.
+func setRunning(name string, pid int, restarts int) {
+	startTime, err := procutils.GetStartTime(pid)
 	if err != nil {
-		logging.LogError("failed to generate enter cmd: %v", err)
+		logging.LogWarning("cannot get start time of pid %d: %v", pid, err)
+	}
 
-		return err
+	err = utils.UpdateState(GetStatePath(name), func(state *utils.State) {
+		*state = utils.State{
+			Status:       utils.StateRunning,
+			Pid:          pid,
+			StartTime:    startTime,
+			StartedAt:    time.Now(),
+			MonitorPid:   os.Getpid(),
+			RestartCount: restarts,
+		}
+	})
+	if err != nil {
+		logging.LogWarning("cannot save state of %s: %v", name, err)
 	}
+}
 
-	logging.LogDebug("container is starting with %+v", cmd.SysProcAttr)
+// setExited will save in the state of input container that it exited, with the
+// exit status found in input error returned by cmd.Wait and the resource usage
+// found in input process state, if input pid is still the one of its init process.
+func setExited(name string, pid int, waitErr error, processState *os.ProcessState) {
+	if pid == 0 {
+		return
+	}
 
-	logging.LogDebug("starting the container, executing %v", cmd.Args)
+	code, signal := procutils.GetExitStatus(waitErr)
 
-	// tty = interactive+tty, we allocate a terminal and pass it
-	if tty {
-		cmd.Args = append(cmd.Args, "--tty")
+	err := utils.UpdateState(GetStatePath(name), func(state *utils.State) {
+		if state.Pid == pid {
+			state.Status = utils.StateExited
+			state.ExitCode = code
+			state.Signal = signal
+			state.FinishedAt = time.Now()
 
-		return procutils.RunWithTTY(cmd)
+			if processState != nil {
+				state.UserTime = processState.UserTime()
+				state.SystemTime = processState.SystemTime()
+
+				usage, ok := processState.SysUsage().(*syscall.Rusage)
+				if ok {
+					state.MaxRSS = usage.Maxrss
+				}
+			}
+		}
+	})
+	if err != nil {
+		logging.LogWarning("cannot save state of %s: %v", name, err)
 	}
+}
 
-	// in case we want interactive mode, but no tty
-	// just run the command and exchange outputs
-	if interactive && !tty {
-		return procutils.RunInteractive(cmd)
+// Exec will execute the entrypoint of input config inside the namespaces of the
+// target container, in a new exec session supervised by a monitor, with the
+// same console options as Start.
+func Exec(opts ConsoleOptions, config utils.Config) error {
+	configArg, err := json.Marshal(config)
+	if err != nil {
+		return errors.New("invalid config")
 	}
 
-	logfile := filepath.Join(path, "../current-logs")
+	session := make([]byte, 6)
 
-	return procutils.RunDetached(cmd, logfile)
+	_, err = rand.Read(session)
+	if err != nil {
+		return err
+	}
+
+	sessionID := fmt.Sprintf("%x", session)
+
+	args := append(opts.args(), "--exec", sessionID, "--config", string(configArg), config.ID)
+
+	return runMonitor(config.Names, args, opts, getExecConsolePath(config.ID, sessionID))
 }
 
-// Exec will enter the namespace of target container and execute the command needed.
-// This function will setup an nsenter command, that will connect to the container's namespace.
-func Exec(pid int, interactive bool, tty bool, config utils.Config) error {
+// prepareExec will return the command executing input config's entrypoint
+// inside the namespaces, and the cgroup, of the container with input pid.
+func prepareExec(pid int, tty bool, config utils.Config) (*exec.Cmd, error) {
 	containerPid := strconv.Itoa(pid)
 
 	logging.LogDebug("entering namespace of pid: %s", containerPid)
-	logging.LogDebug("setting up nsenter flags")
 
-	cmd := generateExecCommand(containerPid, tty, config)
-	if tty {
-		return procutils.RunWithTTY(cmd)
+	// the container could have been started with an older agent
+	err := injectAgent(filepath.Join("/proc", containerPid, "root"))
+	if err != nil {
+		logging.LogWarning("cannot update pty agent: %v", err)
 	}
 
-	logging.LogDebug("tty not requested, setting up command pipes")
+	logging.LogDebug("setting up nsenter flags")
 
-	// in case we want interactive mode, but no tty
-	// just run the command and exchange outputs
-	if interactive && !tty {
-		return procutils.RunInteractive(cmd)
+	cmd, err := generateExecCommand(containerPid, tty, config)
+	if err != nil {
+		return nil, err
 	}
 
-	logfile := filepath.Join(GetDir(config.Names), "current-logs")
+	// exec sessions join the container's cgroup, so that they are subject to
+	// its limits too
+	if config.Resources != nil {
+		cgroup, err := cgrouputils.Open(pid)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return nil, fmt.Errorf("setup cgroup: %w", err)
+		}
+
+		cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: cgroup}
+	}
 
-	return procutils.RunDetached(cmd, logfile)
+	return cmd, nil
 }
 
-// Stop will find all the processes in given container and will stop them.
-func Stop(name string, force bool, timeout int) error {
+// Stop will send input signal to the main process of the container, and wait up to
+// timeout seconds for the container to exit, after which it is killed.
+// The container is marked as stopped by the user, so that it is not restarted,
+// this includes containers waiting to be restarted.
+func Stop(name string, signal syscall.Signal, timeout int) error {
 	logging.LogDebug("stopping container %s", name)
 
-	containerPid, err := GetPid(name)
+	// a container stopped by the user is never restarted
+	err := utils.UpdateState(GetStatePath(name), func(state *utils.State) {
+		state.StoppedByUser = true
+
+		if state.Status == utils.StateRestarting {
+			state.Status = utils.StateExited
+		}
+	})
 	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
 		return err
 	}
 
-	logging.LogDebug("container pid is %d", containerPid)
-	logging.LogDebug("terminating pid: %d", containerPid)
-
-	if force {
-		logging.LogDebug("killing process with pid: %d", containerPid)
-
-		return syscall.Kill(containerPid, syscall.SIGKILL)
+	if !IsRunning(name) {
+		return nil
 	}
 
-	logging.LogDebug("sending SIGTERM to pid: %d", containerPid)
+	return terminate(name, signal, timeout)
+}
 
-	err = syscall.Kill(containerPid, syscall.SIGTERM)
+// terminate will send input signal to the main process of the container, and
+// wait up to timeout seconds for the container to exit, after which it is killed.
+func terminate(name string, signal syscall.Signal, timeout int) error {
+	err := Kill(name, signal)
 	if err != nil {
 		return err
 	}
 
+	if signal == syscall.SIGKILL {
+		return nil
+	}
+
 	for {
 		if timeout <= 0 {
 			logging.LogWarning("timeout exceeded, force killing")
 
-			return syscall.Kill(containerPid, syscall.SIGKILL)
+			return Kill(name, syscall.SIGKILL)
 		}
 
 		time.Sleep(time.Second)
 
-		containerPid, _ = GetPid(name)
+		containerPid, _ := GetPid(name)
 		if containerPid < 1 {
 			break
 		}
@@ -482,6 +910,62 @@ func Stop(name string, force bool, timeout int) error {
 	return nil
 }
 
+// Kill will send input signal to the main process of the container.
+func Kill(name string, signal syscall.Signal) error {
+	containerPid, err := GetPid(name)
+	if err != nil {
+		return err
+	}
+
+	logging.LogDebug("sending signal %d to pid: %d", signal, containerPid)
+
+	return syscall.Kill(containerPid, signal)
+}
+
+// GetStopSignal returns the signal used to stop input container, defaulting to
+// SIGTERM if not valid.
+func GetStopSignal(config utils.Config) syscall.Signal {
+	signal, err := procutils.ParseSignal(config.Stopsignal)
+	if err != nil {
+		logging.LogWarning("%v, using SIGTERM", err)
+
+		return syscall.SIGTERM
+	}
+
+	return signal
+}
+
+// IsSystemd returns true if input container runs systemd as its init, following
+// its systemd mode: always, or true if its entrypoint is systemd or init, like
+// podman does.
+func IsSystemd(config utils.Config) bool {
+	switch config.Systemd {
+	case constants.SystemdAlways:
+		return true
+	case constants.TrueString:
+		if len(config.Entrypoint) == 0 {
+			return false
+		}
+
+		command := config.Entrypoint[0]
+
+		return filepath.Base(command) == "systemd" ||
+			slices.Contains([]string{"/sbin/init", "/usr/sbin/init", "/usr/local/sbin/init"}, command)
+	default:
+		return false
+	}
+}
+
+// GetStopTimeout returns the seconds to wait for input container to stop,
+// before killing it, 0 kills it right away.
+func GetStopTimeout(config utils.Config) int {
+	if config.StopTimeout != nil {
+		return *config.StopTimeout
+	}
+
+	return constants.DefaultStopTimeout
+}
+
 // Inspect will return a JSON or a formatted string describing the input containers.
 func Inspect(containers []string, size bool, format string) (string, error) {
 	result := ""
@@ -496,11 +980,12 @@ func Inspect(containers []string, size bool, format string) (string, error) {
 			return "", err
 		}
 
-		config.Status = "stopped"
+		state := GetState(container)
 
-		if IsRunning(config.Names) {
-			config.Status = "running"
-		}
+		config.Status = state.Status
+		config.State = &state
+		config.Capabilities = getCapabilities(config)
+		config.LandlockABI = securityutils.GetLandlockABI()
 
 		if size {
 			directorySize, err := fileutils.DiscUsageMegaBytes(
@@ -593,11 +1078,15 @@ func generateEnterCommand(config utils.Config) (*exec.Cmd, error) {
 		cloneFlags |= syscall.CLONE_NEWPID
 	}
 
-	if config.Cgroup == constants.Private {
+	// with resource limits, the cgroup namespace is created by RunContainer, as
+	// it must be rooted in the container's cgroup, and not in ours
+	if config.Cgroup == constants.Private && config.Resources == nil {
 		cloneFlags |= syscall.CLONE_NEWCGROUP
 	}
 
-	if config.Time == constants.Private {
+	// with offsets, the time namespace is created by RunContainer, as they
+	// cannot be set once a process is in it, see procutils.SetTimeOffsets
+	if config.Time == constants.Private && len(config.TimeOffsets) == 0 {
 		cloneFlags |= syscall.CLONE_NEWTIME
 	}
 
@@ -646,12 +1135,15 @@ func generateEnterCommand(config utils.Config) (*exec.Cmd, error) {
 // generateExecCommand will generate an nsenter command to be executed.
 // this command will respect the container's namespace configuration and will
 // let you execute an entrypoint in target namespace.
+// The user is resolved against the container's /etc/passwd and /etc/group, and
+// the agent is used to switch to it, as nsenter cannot set supplementary groups.
 //
 // Example nsenter command:
 //
-//	nsenter -m -u -U --preserve-credentials -i -n -p -S 1000 -G 1000 \
-//	    -r/proc/11111/root -w/proc/11111/root/tmp/ -t 11111 command-to-run
-func generateExecCommand(containerPid string, tty bool, config utils.Config) *exec.Cmd {
+//	nsenter -m -u -U --preserve-credentials -i -n -p -S 0 -G 0 \
+//	    -r/proc/11111/root -w/proc/11111/root/tmp/ -t 11111 \
+//	    /sbin/pty --uid 1000 --gid 1000 --groups 1000,10 --no-tty -- command-to-run
+func generateExecCommand(containerPid string, tty bool, config utils.Config) (*exec.Cmd, error) {
 	args := []string{"-m", "-u", "-U", "--preserve-credentials"}
 
 	if config.Ipc == constants.Private {
@@ -666,10 +1158,20 @@ func generateExecCommand(containerPid string, tty bool, config utils.Config) *ex
 		args = append(args, "-p")
 	}
 
-	uid, gid := procutils.GetUIDGID(config.User)
+	// without offsets the time namespace is the same as the host's, and
+	// busybox's nsenter cannot enter it
+	if config.Time == constants.Private && len(config.TimeOffsets) > 0 {
+		args = append(args, "-T")
+	}
+
+	user, err := procutils.LookupUser(filepath.Join("/proc", containerPid, "root"), config.User, config.GroupAdd)
+	if err != nil {
+		return nil, err
+	}
 
-	args = append(args, []string{"-S", strconv.FormatInt(int64(uid), 10)}...)
-	args = append(args, []string{"-G", strconv.FormatInt(int64(gid), 10)}...)
+	// we enter as root, the agent will then become the user
+	args = append(args, []string{"-S", "0"}...)
+	args = append(args, []string{"-G", "0"}...)
 	args = append(args, []string{"-r" + filepath.Join("/proc", containerPid, "root")}...)
 	args = append(
 		args,
@@ -678,24 +1180,323 @@ func generateExecCommand(containerPid string, tty bool, config utils.Config) *ex
 
 	logging.LogDebug("nsenter flags: %v", args)
 
-	if tty {
-		logging.LogDebug(
-			"tty requested, execute command with agent: %s %v",
-			constants.PtyAgentPath,
-			config.Entrypoint,
-		)
+	groups := []string{}
+	for _, group := range user.Groups {
+		groups = append(groups, strconv.Itoa(group))
+	}
 
-		args = append(args, []string{constants.PtyAgentPath}...)
+	args = append(args, []string{
+		constants.PtyAgentPath,
+		"--uid", strconv.Itoa(user.UID),
+		"--gid", strconv.Itoa(user.GID),
+		"--groups", strings.Join(groups, ","),
+	}...)
+
+	if !tty {
+		args = append(args, "--no-tty")
+	}
+
+	// the session gets the same process attributes of the container, see setupProcess
+	if config.Umask != "" {
+		args = append(args, "--umask", config.Umask)
 	}
 
+	for _, input := range config.Ulimits {
+		ulimit, err := procutils.ParseUlimit(input)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, "--rlimit", ulimit.String())
+	}
+
+	if config.OomScoreAdj != nil {
+		args = append(args, "--oom-score-adj", strconv.Itoa(*config.OomScoreAdj))
+	}
+
+	// and the same capabilities, see RunContainer
+	caps := getCapabilities(config)
+	args = append(args, "--cap-bounding", joinInts(securityutils.GetCapabilityValues(caps)))
+
+	if user.UID != 0 {
+		ambient := securityutils.GetAmbientCapabilities(caps, config.CapAdd)
+		if len(ambient) > 0 {
+			args = append(args, "--cap-ambient", joinInts(securityutils.GetCapabilityValues(ambient)))
+		}
+	}
+
+	// the profiles are compiled here, as they're on the host
+	landlock, err := getLandlockRuleset(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if landlock != nil {
+		args = append(args, "--landlock", strconv.FormatUint(landlock.Handled, 10))
+
+		for _, rule := range landlock.Rules {
+			args = append(args, "--landlock-rule", strconv.FormatUint(rule.Access, 10)+"="+rule.Path)
+		}
+	}
+
+	seccomp, err := getSeccompFilter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if seccomp != nil {
+		args = append(args, "--seccomp", securityutils.EncodeSeccomp(seccomp))
+	}
+
+	if config.NoNewPrivileges {
+		args = append(args, "--no-new-privileges")
+	}
+
+	args = append(args, "--")
 	args = append(args, config.Entrypoint...)
 
 	logging.LogDebug("executing nsenter: %s %v", "nsenter", args)
 
 	cmd := exec.Command("nsenter", args...)
-	cmd.Env = config.Env
+	cmd.Env = user.Env(config.Env)
 
-	return cmd
+	return cmd, nil
+}
+
+// joinInts returns input numbers, comma separated, as accepted by the pty agent.
+func joinInts(values []int) string {
+	result := []string{}
+	for _, value := range values {
+		result = append(result, strconv.Itoa(value))
+	}
+
+	return strings.Join(result, ",")
+}
+
+// injectAgent will copy the pty agent in input rootfs, if missing or different
+// from the one in LilipodBinPath.
+// The agent is replaced atomically, as it could be running.
+func injectAgent(rootfs string) error {
+	logging.LogDebug("searching pty agent")
+
+	ptyFile, err := fileutils.ReadFile(filepath.Join(utils.LilipodBinPath, "pty"))
+	if err != nil {
+		logging.LogError("failed to read pty agent: %v", err)
+
+		return err
+	}
+
+	agentPath := filepath.Join(rootfs, constants.PtyAgentPath)
+
+	current, err := os.ReadFile(agentPath)
+	if err == nil && bytes.Equal(current, ptyFile) {
+		logging.LogDebug("pty agent already up to date")
+
+		return nil
+	}
+
+	logging.LogDebug("injecting pty agent")
+
+	err = os.MkdirAll(filepath.Dir(agentPath), 0o755)
+	if err != nil {
+		logging.LogError("failed to create path for pty agent: %v", err)
+
+		return err
+	}
+
+	err = os.WriteFile(agentPath+".new", ptyFile, 0o755)
+	if err != nil {
+		logging.LogError("failed to inject pty agent: %v", err)
+
+		return err
+	}
+
+	err = os.Rename(agentPath+".new", agentPath)
+	if err != nil {
+		logging.LogError("failed to inject pty agent: %v", err)
+
+		return fmt.Errorf("failed to inject agent in %s: %w", agentPath, err)
+	}
+
+	logging.LogDebug("pty agent injected")
+
+	return nil
+}
+
+// setupKeepIDUser will add entries for the host user to the container's
+// /etc/passwd and /etc/group, so that keep-id containers have a working user.
+// If sudo is specified, the user is also allowed to use sudo, if /etc/sudoers.d
+// is present, this is only done when creating the container.
+// Existing entries with the same name or ID are never modified.
+func setupKeepIDUser(config utils.Config, sudo bool) error {
+	if config.Userns != constants.KeepID || !config.Passwd || config.Uidmap == "" {
+		return nil
+	}
+
+	uid, err := strconv.Atoi(strings.Split(config.Uidmap, ":")[0])
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	gid, err := strconv.Atoi(strings.Split(config.Gidmap, ":")[0])
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	user, group := procutils.LookupHostUser(uid, gid)
+	if user.Name == "" {
+		logging.LogWarning("cannot resolve host user %d, skipping passwd entries", uid)
+
+		return nil
+	}
+
+	if user.Home == "" {
+		user.Home = "/"
+	}
+
+	if user.Shell == "" || !fileutils.Exist(GetRootfsPath(config, user.Shell, false)) {
+		user.Shell = "/bin/sh"
+	}
+
+	logging.LogDebug("adding passwd entries for %s", user.Name)
+
+	err = addPasswdEntry(config, "/etc/passwd", user.Name, uid,
+		fmt.Sprintf("%s:x:%d:%d:%s:%s:%s", user.Name, uid, gid, user.Name, user.Home, user.Shell))
+	if err != nil {
+		return err
+	}
+
+	err = addPasswdEntry(config, "/etc/group", group, gid,
+		fmt.Sprintf("%s:x:%d:%s", group, gid, user.Name))
+	if err != nil {
+		return err
+	}
+
+	sudoers := GetRootfsPath(config, "/etc/sudoers.d", false)
+	if !sudo || !fileutils.Exist(sudoers) {
+		return nil
+	}
+
+	sudoersFile := filepath.Join("/etc/sudoers.d", "lilipod-"+user.Name)
+	if fileutils.Exist(GetRootfsPath(config, sudoersFile, false)) {
+		return nil
+	}
+
+	logging.LogDebug("adding sudoers entry for %s", user.Name)
+
+	return writeRootfsFile(config, sudoersFile,
+		[]byte(user.Name+" ALL=(ALL:ALL) NOPASSWD: ALL\n"), 0o440, sudoers)
+}
+
+// setupMachineID will use the container's ID as its /etc/machine-id, that
+// systemd needs to boot, unless the rootfs already has one.
+func setupMachineID(config utils.Config) error {
+	current := GetRootfsPath(config, "/etc/machine-id", false)
+
+	info, err := os.Lstat(current)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		logging.LogDebug("machine-id is a symlink, leaving it as it is")
+
+		return nil
+	}
+
+	content, err := os.ReadFile(current)
+	if err == nil {
+		machineID := strings.TrimSpace(string(content))
+		if machineID != "" && machineID != "uninitialized" {
+			return nil
+		}
+	}
+
+	logging.LogDebug("setting up machine-id of %s", config.Names)
+
+	return writeRootfsFile(config, "/etc/machine-id", []byte(config.ID+"\n"), 0o444,
+		GetRootfsPath(config, "/etc", false))
+}
+
+// addPasswdEntry will append line to input passwd or group file in the container's
+// rootfs, unless an entry with the same name or ID is already present.
+func addPasswdEntry(config utils.Config, file, name string, id int, line string) error {
+	path := GetRootfsPath(config, file, false)
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	// entries are in the form of name:password:ID:...
+	for _, entry := range strings.Split(string(content), "\n") {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 3 {
+			continue
+		}
+
+		if fields[0] == name || fields[2] == strconv.Itoa(id) {
+			logging.LogDebug("entry for %s already present in %s", name, file)
+
+			return nil
+		}
+	}
+
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+
+	content = append(content, []byte(line+"\n")...)
+
+	reference := path
+	if !fileutils.Exist(reference) {
+		reference = GetRootfsPath(config, filepath.Dir(file), false)
+	}
+
+	return writeRootfsFile(config, file, content, 0o644, reference)
+}
+
+// writeRootfsFile will write content to input file in the container's rootfs.
+// Mode and ownership are taken from the reference path, so that files are owned
+// by the container's root like the rest of the rootfs. If reference is a
+// directory, input mode is used.
+func writeRootfsFile(config utils.Config, file string, content []byte, mode os.FileMode, reference string) error {
+	info, err := os.Stat(reference)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	if !info.IsDir() {
+		mode = info.Mode().Perm()
+	}
+
+	path := GetRootfsPath(config, file, true)
+
+	err = os.WriteFile(path, content, mode)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	// WriteFile does not change the mode of existing files
+	err = os.Chmod(path, mode)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	return os.Lchown(path, int(stat.Uid), int(stat.Gid))
 }
 
 // filterContainer will return true if a specified container's config respects
@@ -728,6 +1529,9 @@ func filterContainer(config utils.Config, filters map[string]string) bool {
 
 			if config.Status == filter {
 				matched++
+			} else if filter == utils.StateStopped &&
+				(config.Status == utils.StateCreated || config.Status == utils.StateExited) {
+				matched++
 			}
 		case "name":
 			logging.LogDebug("filtering names: %s, %s", config.Names, filter)
@@ -741,9 +1545,17 @@ func filterContainer(config utils.Config, filters map[string]string) bool {
 			if config.ID == filter {
 				matched++
 			}
+		case "restart-policy":
+			policy, _, _ := utils.ParseRestartPolicy(config.Restart)
+
+			logging.LogDebug("filtering restart policy: %s, %s", policy, filter)
+
+			if policy == filter {
+				matched++
+			}
 		default:
 			logging.LogWarning("invalid filter %s, skipping", name)
-			logging.LogWarning("valid filters are: label, status, name, id")
+			logging.LogWarning("valid filters are: label, status, name, id, restart-policy")
 		}
 	}
 
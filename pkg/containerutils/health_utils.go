@@ -0,0 +1,158 @@
+// Package containerutils contains helpers and utilities for managing and creating
+// containers.
+package containerutils
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/utils"
+)
+
+// RunHealthcheck will run the healthcheck of input container once, inside its
+// namespaces, and save the result in its state.
+// The result and the resulting health status of the container are returned.
+func RunHealthcheck(config utils.Config) (utils.HealthLog, string, error) {
+	result := utils.HealthLog{}
+
+	command, err := config.Healthcheck.Command()
+	if err != nil {
+		return result, "", fmt.Errorf("container %s has no healthcheck", config.Names)
+	}
+
+	pid, err := GetPid(config.ID)
+	if err != nil {
+		return result, "", err
+	}
+
+	// the check is run as the container's entrypoint would
+	config.Entrypoint = command
+
+	cmd, err := prepareExec(pid, false, config)
+	if err != nil {
+		return result, "", err
+	}
+
+	var output bytes.Buffer
+
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// the check is run in its own process group, so that it can be killed
+	// as a whole on timeout
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Setpgid = true
+
+	logging.LogDebug("running healthcheck of %s: %v", config.Names, command)
+
+	result.Start = time.Now()
+
+	err = cmd.Start()
+
+	if cmd.SysProcAttr.UseCgroupFD {
+		_ = syscall.Close(cmd.SysProcAttr.CgroupFD)
+	}
+
+	if err != nil {
+		return result, "", err
+	}
+
+	timeout := config.Healthcheck.GetTimeout()
+	timer := time.AfterFunc(timeout, func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+
+	err = cmd.Wait()
+	timedOut := !timer.Stop()
+
+	result.End = time.Now()
+	result.ExitCode, _ = procutils.GetExitStatus(err)
+	result.Output = output.String()
+
+	if timedOut {
+		result.ExitCode = -1
+		result.Output = fmt.Sprintf("healthcheck exceeded timeout (%s)", timeout)
+	}
+
+	var status string
+
+	err = utils.UpdateState(GetStatePath(config.ID), func(state *utils.State) {
+		if state.Pid == pid {
+			state.RecordHealth(*config.Healthcheck, result)
+			status = state.Health.Status
+		}
+	})
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return result, "", err
+	}
+
+	return result, status, nil
+}
+
+// superviseHealth will run the healthcheck of input container every interval,
+// while its init process is input pid, until done is closed.
+// When the container becomes unhealthy its HealthOnFailure action is taken:
+//   - kill kills the container, that is restarted following its restart policy
+//   - restart stops the container and calls input restart function, so that it is
+//     restarted regardless of its restart policy
+//   - stop stops the container, as the user would
+func superviseHealth(config utils.Config, pid int, done <-chan struct{}, restart func()) {
+	err := utils.UpdateState(GetStatePath(config.ID), func(state *utils.State) {
+		if state.Pid == pid {
+			state.Health = &utils.Health{Status: utils.HealthStarting}
+		}
+	})
+	if err != nil {
+		logging.LogWarning("cannot save state of %s: %v", config.Names, err)
+	}
+
+	previous := utils.HealthStarting
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(config.Healthcheck.GetInterval()):
+		}
+
+		_, status, err := RunHealthcheck(config)
+		if err != nil {
+			logging.LogDebug("cannot run healthcheck of %s: %v", config.Names, err)
+
+			continue
+		}
+
+		if status != utils.HealthUnhealthy || previous == utils.HealthUnhealthy {
+			previous = status
+
+			continue
+		}
+
+		previous = status
+
+		logging.LogDebug("container %s is unhealthy, action: %s", config.Names, config.HealthOnFailure)
+
+		switch config.HealthOnFailure {
+		case utils.HealthActionKill:
+			err = Kill(config.ID, syscall.SIGKILL)
+		case utils.HealthActionRestart:
+			restart()
+
+			err = terminate(config.ID, GetStopSignal(config), GetStopTimeout(config))
+		case utils.HealthActionStop:
+			err = Stop(config.ID, GetStopSignal(config), GetStopTimeout(config))
+		}
+
+		if err != nil {
+			logging.LogWarning("cannot %s unhealthy container %s: %v", config.HealthOnFailure, config.Names, err)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+// Package containerutils contains helpers and utilities for managing and creating
+// containers.
+package containerutils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/89luca89/lilipod/pkg/cgrouputils"
+	"github.com/89luca89/lilipod/pkg/constants"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/utils"
+)
+
+// MonitorReadyFd is the file descriptor the monitor uses to report to
+// startMonitor if its process started, it is the first of cmd.ExtraFiles.
+const MonitorReadyFd = 3
+
+// Restarted containers wait restartBackoffMin before being restarted, doubling
+// at each restart up to restartBackoffMax. The backoff is reset once a container
+// ran for more than restartBackoffReset.
+const (
+	restartBackoffMin   = time.Millisecond * 100
+	restartBackoffMax   = time.Minute
+	restartBackoffReset = time.Second * 10
+)
+
+// monitorReady is written on the ready pipe once the process started,
+// anything else is the error that prevented it to start.
+const monitorReady = "ready"
+
+// ConsoleOptions are the options of the console of a container or exec session
+// run by a monitor, see console.
+type ConsoleOptions struct {
+	// Tty runs the process in a pseudo-terminal.
+	Tty bool
+	// Interactive keeps the process' stdin open, for the attached clients.
+	Interactive bool
+	// Attach keeps the caller attached to the console until the process exits
+	// or DetachKeys are typed, else the process is left running in background.
+	Attach     bool
+	DetachKeys string
+}
+
+// args returns the monitor command flags for the console options.
+func (opts ConsoleOptions) args() []string {
+	result := []string{}
+
+	if opts.Tty {
+		result = append(result, "--tty")
+	}
+
+	if opts.Interactive {
+		result = append(result, "--interactive")
+	}
+
+	if opts.Attach {
+		result = append(result, "--attach")
+	}
+
+	return result
+}
+
+// runMonitor will execute a monitor with input arguments, for input container.
+// If attach is requested, we attach to the console in input socket path once it
+// is listening, and the monitor starts the process only then, so that no
+// output is lost. Else this returns once the process started.
+func runMonitor(name string, args []string, opts ConsoleOptions, socket string) error {
+	keys, err := ParseDetachKeys(opts.DetachKeys)
+	if err != nil {
+		return err
+	}
+
+	ready, err := startMonitor(args)
+	if err != nil {
+		return err
+	}
+
+	if !opts.Attach {
+		return waitReady(ready, name)
+	}
+
+	readyErr := make(chan error, 1)
+
+	go func() { readyErr <- waitReady(ready, name) }()
+
+	conn, err := dialConsole(socket, readyErr)
+	if err != nil {
+		return err
+	}
+
+	err = <-readyErr
+	if err != nil {
+		_ = conn.Close()
+
+		return err
+	}
+
+	return attachConsole(conn, opts.Interactive, keys)
+}
+
+// startMonitor will execute a monitor with input arguments in a new session,
+// so that it outlives us, and return the read end of its ready pipe.
+func startMonitor(args []string) (*os.File, error) {
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return nil, err
+	}
+
+	args = append([]string{"--log-level", logging.GetLogLevel(), "monitor"}, args...)
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = os.Environ()
+	cmd.ExtraFiles = []*os.File{readyW}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:     true,
+		Foreground: false,
+	}
+
+	logging.LogDebug("starting monitor, executing %v", cmd.Args)
+
+	err = cmd.Start()
+
+	// the monitor has its own copy of the write end, close ours so that
+	// we get EOF if it exits without reporting.
+	_ = readyW.Close()
+
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		_ = readyR.Close()
+
+		return nil, err
+	}
+
+	err = cmd.Process.Release()
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		_ = readyR.Close()
+
+		return nil, err
+	}
+
+	return readyR, nil
+}
+
+// waitReady will wait for the monitor of input container to report on input
+// ready pipe that its process started, returning the error it reported if not.
+func waitReady(ready *os.File, name string) error {
+	defer func() { _ = ready.Close() }()
+
+	message, err := io.ReadAll(ready)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	switch string(message) {
+	case monitorReady:
+		return nil
+	case "":
+		return fmt.Errorf("monitor of %s exited before starting", name)
+	default:
+		return errors.New(string(message))
+	}
+}
+
+// newNotifier returns the function reporting on input ready pipe that the
+// process started, or the error that prevented it to start. Only the first
+// report is sent, then the pipe is closed.
+func newNotifier(ready *os.File) func(message string) {
+	// ready must not leak into the process
+	syscall.CloseOnExec(int(ready.Fd()))
+
+	return func(message string) {
+		if ready == nil {
+			return
+		}
+
+		_, err := ready.WriteString(message)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+		}
+
+		_ = ready.Close()
+		ready = nil
+	}
+}
+
+// Monitor will start input container and supervise it until it exits.
+// This is run by the monitor command, in its own session, so that containers
+// do not depend on the process that started them:
+//   - the container's stdio is held by its console, where clients can attach
+//     to, and its output is saved in its logs, rotated as configured
+//   - the container's init process is reaped as soon as it exits, and its exit
+//     status and resource usage are saved in the container's state
+//   - the container is restarted following its restart policy, see shouldRestart
+//   - the container's healthcheck is run periodically, see superviseHealth
+//   - the container is started in its cgroup with resource limits, if any,
+//     that is removed once it exits
+//   - post-stop cleanup is run, like removing --rm containers
+//
+// Input ready file is notified once the container started, or with the error
+// that prevented it to start, and then closed.
+func Monitor(config utils.Config, opts ConsoleOptions, ready *os.File) error {
+	notify := newNotifier(ready)
+
+	// containers that fail to start are cleaned up too
+	fail := func(err error) error {
+		notify(err.Error())
+		cleanup(config)
+
+		return err
+	}
+
+	console, err := newConsole(GetConsolePath(config.ID), opts.Tty, opts.Interactive, GetLogFile(config))
+	if err != nil {
+		return fail(err)
+	}
+
+	defer console.close()
+
+	if opts.Attach {
+		err = console.waitAttached()
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	backoff := restartBackoffMin
+
+	for restarts := 0; ; restarts++ {
+		cmd, err := prepareStart(config)
+		if err != nil {
+			return fail(err)
+		}
+
+		if opts.Tty {
+			cmd.Args = append(cmd.Args, "--tty")
+		}
+
+		pid := 0
+		done := make(chan struct{})
+		restartRequested := atomic.Bool{}
+		started := func(containerPid int) {
+			pid = containerPid
+
+			setRunning(config.ID, containerPid, restarts)
+			notify(monitorReady)
+
+			if config.Healthcheck.Enabled() {
+				go superviseHealth(config, containerPid, done, func() { restartRequested.Store(true) })
+			}
+		}
+
+		startedAt := time.Now()
+
+		err = console.run(cmd, started)
+
+		close(done)
+
+		if cmd.SysProcAttr.UseCgroupFD {
+			_ = syscall.Close(cmd.SysProcAttr.CgroupFD)
+		}
+
+		if pid == 0 {
+			return fail(err)
+		}
+
+		logging.LogDebug("container %s exited: %v", config.Names, err)
+
+		setExited(config.ID, pid, err, cmd.ProcessState)
+
+		// the cgroup is created again at each start
+		if config.Resources != nil {
+			removeErr := cgrouputils.Remove(config.ID)
+			if removeErr != nil {
+				logging.LogWarning("cannot remove cgroup of %s: %v", config.Names, removeErr)
+			}
+		}
+
+		code, _ := procutils.GetExitStatus(err)
+
+		if !shouldRestart(config, restarts, err, restartRequested.Load()) {
+			// attached clients return once the container is gone
+			cleanup(config)
+			console.exit(code)
+
+			return nil
+		}
+
+		console.exit(code)
+
+		// containers that ran for a while are restarted right away
+		if time.Since(startedAt) > restartBackoffReset {
+			backoff = restartBackoffMin
+		}
+
+		logging.LogDebug("restarting container %s in %s", config.Names, backoff)
+
+		setRestarting(config.ID, pid)
+		time.Sleep(backoff)
+
+		backoff = min(backoff*2, restartBackoffMax)
+
+		// the container could have been stopped, removed or started by
+		// someone else in the meantime
+		state := GetState(config.ID)
+		if state.Status != utils.StateRestarting || state.MonitorPid != os.Getpid() {
+			logging.LogDebug("container %s is %s, not restarting it", config.Names, state.Status)
+
+			return nil
+		}
+	}
+}
+
+// MonitorExec will run input exec session in the running container of input
+// config, holding its stdio in a console like Monitor does, until it exits.
+// Its output is not saved in the container's logs.
+func MonitorExec(config utils.Config, session string, opts ConsoleOptions, ready *os.File) error {
+	notify := newNotifier(ready)
+
+	console, err := newConsole(getExecConsolePath(config.ID, session), opts.Tty, opts.Interactive, nil)
+	if err != nil {
+		notify(err.Error())
+
+		return err
+	}
+
+	defer console.close()
+
+	if opts.Attach {
+		err = console.waitAttached()
+		if err != nil {
+			notify(err.Error())
+
+			return err
+		}
+	}
+
+	pid, err := GetPid(config.ID)
+	if err != nil {
+		err = fmt.Errorf("container %s is not running", config.Names)
+
+		notify(err.Error())
+
+		return err
+	}
+
+	cmd, err := prepareExec(pid, opts.Tty, config)
+	if err != nil {
+		notify(err.Error())
+
+		return err
+	}
+
+	started := false
+
+	err = console.run(cmd, func(int) {
+		started = true
+
+		notify(monitorReady)
+	})
+
+	if cmd.SysProcAttr.UseCgroupFD {
+		_ = syscall.Close(cmd.SysProcAttr.CgroupFD)
+	}
+
+	if !started {
+		notify(err.Error())
+
+		return err
+	}
+
+	logging.LogDebug("exec session %s of %s exited: %v", session, config.Names, err)
+
+	code, _ := procutils.GetExitStatus(err)
+	console.exit(code)
+
+	return nil
+}
+
+// shouldRestart returns true if input container, that exited with input error
+// after input number of restarts, is to be restarted following its restart policy:
+//   - on-failure restarts it if it exited with a non-zero exit code, up to N times if specified
+//   - always and unless-stopped always restart it
+//
+// Containers stopped by the user are never restarted, while requested restarts
+// are done regardless of the restart policy.
+func shouldRestart(config utils.Config, restarts int, waitErr error, requested bool) bool {
+	if GetState(config.ID).StoppedByUser {
+		return false
+	}
+
+	if requested {
+		return true
+	}
+
+	policy, maxRetries, err := utils.ParseRestartPolicy(config.Restart)
+	if err != nil {
+		logging.LogWarning("%v, not restarting %s", err, config.Names)
+
+		return false
+	}
+
+	if policy == constants.RestartNo {
+		return false
+	}
+
+	if policy == constants.RestartOnFailure {
+		code, _ := procutils.GetExitStatus(waitErr)
+
+		return code != 0 && (maxRetries == 0 || restarts < maxRetries)
+	}
+
+	return true
+}
+
+// setRestarting will save in the state of input container that it is waiting
+// to be restarted, if input pid is still the one of its init process.
+func setRestarting(name string, pid int) {
+	err := utils.UpdateState(GetStatePath(name), func(state *utils.State) {
+		if state.Pid == pid && state.Status == utils.StateExited && !state.StoppedByUser {
+			state.Status = utils.StateRestarting
+		}
+	})
+	if err != nil {
+		logging.LogWarning("cannot save state of %s: %v", name, err)
+	}
+}
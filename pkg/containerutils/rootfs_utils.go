@@ -3,6 +3,7 @@
 package containerutils
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -15,8 +16,9 @@ import (
 	"github.com/89luca89/lilipod/pkg/imageutils"
 	"github.com/89luca89/lilipod/pkg/logging"
 	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/89luca89/lilipod/pkg/securityutils"
 	"github.com/89luca89/lilipod/pkg/utils"
-	"github.com/moby/sys/capability"
+	"golang.org/x/sys/unix"
 )
 
 // Limit access to host's kernel stuff -> /dev/null.
@@ -83,20 +85,48 @@ func setupCgroupfs(conf utils.Config) error {
 	}
 
 	// move our process to a dedicated scope, so that eventual init systems
-	// won't encour problems with unknown PIDs
-	err = os.MkdirAll("/sys/fs/cgroup/container-"+conf.Names+".scope", 0o755)
+	// won't encour problems with unknown PIDs.
+	// systemd is moved where it would move itself, so that the rest of the
+	// tree is left to it.
+	scope := "container-" + conf.Names + ".scope"
+	if IsSystemd(conf) {
+		scope = "init.scope"
+	}
+
+	err = os.MkdirAll(filepath.Join("/sys/fs/cgroup", scope), 0o755)
 	if err != nil {
 		return err
 	}
 
-	file, err := os.Create("/sys/fs/cgroup/container-" + conf.Names + ".scope/cgroup.procs")
+	err = os.WriteFile(filepath.Join("/sys/fs/cgroup", scope, "cgroup.procs"), []byte("0"), 0o644)
 	if err != nil {
 		return err
 	}
 
-	_, err = fmt.Fprint(file, 0)
+	if IsSystemd(conf) {
+		delegateControllers("/sys/fs/cgroup")
+	}
 
-	return err
+	return nil
+}
+
+// delegateControllers will enable all the controllers available in input
+// cgroup for its children, so that systemd can manage its own tree.
+// Controllers that are not delegated to us are skipped.
+func delegateControllers(cgroup string) {
+	controllers, err := os.ReadFile(filepath.Join(cgroup, "cgroup.controllers"))
+	if err != nil {
+		logging.LogWarning("cannot read controllers of %s: %v", cgroup, err)
+
+		return
+	}
+
+	for _, controller := range strings.Fields(string(controllers)) {
+		err := os.WriteFile(filepath.Join(cgroup, "cgroup.subtree_control"), []byte("+"+controller), 0o644)
+		if err != nil {
+			logging.LogDebug("cannot delegate controller %s: %v", controller, err)
+		}
+	}
 }
 
 // we need to setup the /dev/pts mountpoint, by mounting a new devpts filesystem
@@ -126,11 +156,15 @@ func setupPTY(path string) error {
 
 // this is in case of an unprivileged container, we want to make sure that these
 // mountpoints are either read-only, or masked, by being bind-mounted to /dev/null
-// or to empty tmpfs.
-func setupMaskedMounts(path string) error {
+// or to empty tmpfs. Input unmasked paths are skipped.
+func setupMaskedMounts(path string, unmask []string) error {
 	logging.LogDebug("setting up read only and masked mounts")
 
 	for _, mount := range linuxReadOnlyPaths {
+		if securityutils.IsUnmasked(mount, unmask) {
+			continue
+		}
+
 		if fileutils.Exist(mount) {
 			logging.LogDebug("mounting dir %s to %s as readonly", mount, filepath.Join(path, mount))
 
@@ -144,6 +178,10 @@ func setupMaskedMounts(path string) error {
 	}
 
 	for _, mount := range linuxMaskedFiles {
+		if securityutils.IsUnmasked(mount, unmask) {
+			continue
+		}
+
 		if fileutils.Exist(mount) {
 			logging.LogDebug("mounting /dev/null to %s", filepath.Join(path, mount))
 
@@ -157,6 +195,10 @@ func setupMaskedMounts(path string) error {
 	}
 
 	for _, mount := range linuxMaskedDirs {
+		if securityutils.IsUnmasked(mount, unmask) {
+			continue
+		}
+
 		if fileutils.Exist(mount) {
 			logging.LogDebug("mounting empty tmpfs to %s", filepath.Join(path, mount))
 
@@ -172,6 +214,35 @@ func setupMaskedMounts(path string) error {
 	return nil
 }
 
+// setupMasks will mask input paths, if they exist in the rootfs, like the ones
+// of setupMaskedMounts.
+func setupMasks(path string, mask []string) error {
+	for _, mount := range mask {
+		info, err := os.Stat(filepath.Join(path, mount))
+		if err != nil {
+			logging.LogDebug("skipping masked path %s: %v", mount, err)
+
+			continue
+		}
+
+		logging.LogDebug("masking %s", filepath.Join(path, mount))
+
+		if info.IsDir() {
+			err = fileutils.MountTmpfs(filepath.Join(path, mount))
+		} else {
+			err = fileutils.MountBindRO("/dev/null", filepath.Join(path, mount))
+		}
+
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return fmt.Errorf("error setting masked path %s: %w", mount, err)
+		}
+	}
+
+	return nil
+}
+
 // this will setup all the basic mountpoints needed for the container to work.
 // depending on the container's config, it will either bind-mount host's directories
 // (eg in case of pid==host, it will bind-mount host's /proc) or by mounting new
@@ -232,6 +303,20 @@ func setupMounts(path string, conf utils.Config) error {
 		return fmt.Errorf("error setting /tmp: %w", err)
 	}
 
+	// systemd expects its runtime directories to be empty at boot
+	if IsSystemd(conf) {
+		for _, mount := range []string{"/run", "/run/lock"} {
+			logging.LogDebug("setting up tmpfs on %s", mount)
+
+			err = fileutils.MountTmpfs(filepath.Join(path, mount))
+			if err != nil {
+				logging.LogDebug("error: %+v", err)
+
+				return fmt.Errorf("error setting %s: %w", mount, err)
+			}
+		}
+	}
+
 	// if we share IPC, we mount host's ipc dirs
 	if conf.Ipc == constants.Private {
 		logging.LogDebug("setting up private IPC namespace")
@@ -297,25 +382,36 @@ func setupMounts(path string, conf utils.Config) error {
 		}
 	}
 
-	// unprivileged has less access to filesystem kernel and so on
-	if !conf.Privileged {
-		logging.LogDebug("container is not privileged, setting up masked mounts")
-
-		err = setupMaskedMounts(path)
-		if err != nil {
-			logging.LogDebug("error: %+v", err)
+	return nil
+}
 
-			return err
+// getMountDestination returns the destination path inside the container of
+// input mount or volume, in the same formats accepted by setupVolumes.
+func getMountDestination(volume string) string {
+	mounts := strings.Split(volume, ",")
+	if len(mounts) > 1 {
+		for _, mount := range mounts {
+			if strings.HasPrefix(mount, "destination") {
+				return strings.Split(mount, "=")[1]
+			}
 		}
+
+		return ""
 	}
 
-	return nil
+	mountings := strings.Split(volume, ":")
+	if len(mountings) <= 1 {
+		return volume
+	}
+
+	return mountings[1]
 }
 
 // here we setup the custom mounts/volumes specified during creation. Reference
 // config is utils.Config.Mounts.
 // Specified mounts are in the form of src:dest:mode
-// For anonymous mountpoints, we create an empty dir in LILIPOD_HOME/volumes/ID/path.
+// For anonymous mountpoints, we create a dir in LILIPOD_HOME/volumes/ID/path,
+// populated with the content of the path in the rootfs on first use.
 func setupVolumes(path string, conf utils.Config) error {
 	for _, volume := range conf.Mounts {
 		if strings.Compare(volume, "") == 0 {
@@ -412,6 +508,9 @@ func setupVolumes(path string, conf utils.Config) error {
 			src := filepath.Join(utils.GetLilipodHome(), "volumes", conf.ID, volume)
 			dest := filepath.Join(path, volume)
 
+			// populate new volumes with the rootfs content, like docker does
+			populate := !fileutils.Exist(src) && fileutils.Exist(dest)
+
 			// we now create the volume in LILIPOD_HOME
 			err := os.MkdirAll(src, os.ModePerm)
 			if err != nil {
@@ -420,6 +519,17 @@ func setupVolumes(path string, conf utils.Config) error {
 				return fmt.Errorf("error creating anonyous mount %s: %w", volume, err)
 			}
 
+			if populate {
+				logging.LogDebug("populating volume %s with %s", src, dest)
+
+				out, err := exec.Command("cp", "-a", dest+"/.", src).CombinedOutput()
+				if err != nil {
+					logging.LogDebug("error: %+v", err)
+
+					return fmt.Errorf("error populating anonyous mount %s: %w: %s", volume, err, string(out))
+				}
+			}
+
 			err = fileutils.MountBind(src, dest)
 			if err != nil {
 				logging.LogDebug("error: %+v", err)
@@ -471,15 +581,283 @@ func setupVolumes(path string, conf utils.Config) error {
 	return nil
 }
 
+// setupExternalRootfs will mount the external rootfs directory of the container,
+// if any, on path.
+// Bind rootfs are simply bind-mounted, while overlay rootfs are mounted using
+// the directory as lower dir, so that it is never modified.
+func setupExternalRootfs(path string, conf utils.Config) error {
+	switch conf.Rootfs {
+	case constants.RootfsBind:
+		logging.LogDebug("bind mounting rootfs %s on %s", conf.Image, path)
+
+		err := syscall.Mount(conf.Image, path, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return fmt.Errorf("cannot mount rootfs %s: %w", conf.Image, err)
+		}
+	case constants.RootfsOverlay:
+		options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+			conf.Image,
+			filepath.Join(GetOverlayDir(conf.ID), "upper"),
+			filepath.Join(GetOverlayDir(conf.ID), "work"))
+
+		logging.LogDebug("mounting overlay rootfs on %s with %s", path, options)
+
+		// in a user namespace overlay needs to use user xattrs, but older
+		// kernels do not support the option, so let's retry without it
+		err := syscall.Mount("overlay", path, "overlay", 0, options+",userxattr")
+		if err != nil {
+			logging.LogDebug("cannot mount overlay with userxattr, retrying: %v", err)
+
+			err = syscall.Mount("overlay", path, "overlay", 0, options)
+		}
+
+		if err != nil {
+			return fmt.Errorf("cannot mount overlay rootfs %s: %w", conf.Image, err)
+		}
+	}
+
+	return nil
+}
+
+// setupTimezone will bind-mount a copy of the host's zoneinfo of input container's
+// timezone, kept in the container's dir, on /etc/localtime of the rootfs in path.
+// The image's /etc/localtime is usually a symlink to its own zoneinfo, the mount
+// is done on its target, resolved in the rootfs, so that the rootfs is left as is.
+// A missing /etc/localtime is created, like the volumes' mount points.
+func setupTimezone(path string, conf utils.Config) error {
+	zoneinfo, err := fileutils.GetZoneinfo(conf.Timezone)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(zoneinfo)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	source := filepath.Join(GetDir(conf.ID), "localtime")
+
+	err = os.WriteFile(source, content, 0o644)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	localtime, err := resolveInRootfs(path, "/etc/localtime")
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	info, err := os.Stat(localtime)
+	if err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("/etc/localtime of the container is not a file")
+	}
+
+	if err != nil {
+		_ = os.MkdirAll(filepath.Dir(localtime), 0o755)
+
+		file, err := os.OpenFile(localtime, os.O_RDONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return err
+		}
+
+		_ = file.Close()
+	}
+
+	logging.LogDebug("mounting %s on %s", source, localtime)
+
+	return syscall.Mount(source, localtime, "bind", syscall.MS_BIND|syscall.MS_PRIVATE, "")
+}
+
+// maxSymlinks is the number of symlinks followed resolving a path, like the kernel.
+const maxSymlinks = 40
+
+// resolveInRootfs returns the path of input target in the rootfs in path, with
+// its symlinks resolved as the container would, so that they cannot point
+// outside of the rootfs. Missing paths are returned as they are.
+func resolveInRootfs(path string, target string) (string, error) {
+	resolved := "/"
+	pending := strings.Split(filepath.Clean("/"+target), "/")
+	links := 0
+
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+
+		link, err := os.Readlink(filepath.Join(path, next))
+		if err != nil {
+			// not a symlink, or missing
+			resolved = next
+
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", target)
+		}
+
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+
+		pending = append(strings.Split(link, "/"), pending...)
+	}
+
+	return filepath.Join(path, resolved), nil
+}
+
+// setupSysctls will set the container's sysctls, this must be done once in the
+// container's namespaces, and before setupMaskedMounts makes /proc/sys read-only.
+func setupSysctls(conf utils.Config) error {
+	for key, value := range conf.Sysctls {
+		logging.LogDebug("setting sysctl %s to %s", key, value)
+
+		err := procutils.SetSysctl(key, value)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return fmt.Errorf("error setting sysctl %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// setupProcess will set the container's ulimits and OOM score adjustment on the
+// current process, so that they are inherited by the entrypoint. This must be
+// done before dropping privileges, as raising them requires them.
+func setupProcess(conf utils.Config) error {
+	for _, input := range conf.Ulimits {
+		ulimit, err := procutils.ParseUlimit(input)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return err
+		}
+
+		logging.LogDebug("setting ulimit %s", input)
+
+		err = ulimit.Apply()
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return fmt.Errorf("error setting ulimit %s: %w", input, err)
+		}
+	}
+
+	if conf.OomScoreAdj != nil {
+		logging.LogDebug("setting oom score adjustment to %d", *conf.OomScoreAdj)
+
+		err := procutils.SetOomScoreAdj(*conf.OomScoreAdj)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return fmt.Errorf("error setting oom score adjustment: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// getCapabilities returns the container's capabilities, computed from the
+// defaults for containers created before they were saved in their config.
+func getCapabilities(conf utils.Config) []string {
+	if conf.Capabilities != nil {
+		return conf.Capabilities
+	}
+
+	caps, err := securityutils.GetCapabilities(nil, nil, conf.Privileged)
+	if err != nil {
+		return securityutils.DefaultCapabilities
+	}
+
+	return caps
+}
+
+// getSeccompFilter returns the container's seccomp filter, nil if unconfined.
+// The profile is read from the host, so this must be done before PivotRoot.
+// On architectures without seccomp support, the default profile is skipped.
+func getSeccompFilter(conf utils.Config) ([]unix.SockFilter, error) {
+	if conf.Privileged || conf.Seccomp == securityutils.Unconfined {
+		return nil, nil
+	}
+
+	filter, err := securityutils.CompileSeccomp(conf.Seccomp, getCapabilities(conf))
+	if errors.Is(err, securityutils.ErrSeccompUnsupported) && conf.Seccomp == "" {
+		logging.LogWarning("%v, running unconfined", err)
+
+		return nil, nil
+	}
+
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// getLandlockRuleset returns the container's landlock ruleset, nil if none.
+// The profile is read from the host, so this must be done before PivotRoot.
+// On kernels without landlock, the ruleset is skipped.
+func getLandlockRuleset(conf utils.Config) (*securityutils.LandlockRuleset, error) {
+	if conf.Landlock == "" {
+		return nil, nil
+	}
+
+	ruleset, err := securityutils.CompileLandlock(conf.Landlock)
+	if errors.Is(err, securityutils.ErrLandlockUnsupported) {
+		logging.LogWarning("%v, running without landlock", err)
+
+		return nil, nil
+	}
+
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return nil, err
+	}
+
+	return ruleset, nil
+}
+
 // SetupRootfs will set up the rootfs defined in conf into path.
 // This will also populate container's /run/.containerenv.
 func SetupRootfs(conf utils.Config) error {
 	path := GetRootfsDir(conf.ID)
+
+	err := setupExternalRootfs(path, conf)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
 	// this section will make sure that mounts are private in this mount
 	// namespace, so that even with root we do not have pending mounts.
 	logging.LogDebug("remounting %s as private", path)
 
-	err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, "")
+	err = syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, "")
 	if err != nil {
 		logging.LogDebug("error: %+v", err)
 
@@ -513,6 +891,17 @@ func SetupRootfs(conf utils.Config) error {
 		return err
 	}
 
+	if conf.Timezone != "" {
+		logging.LogDebug("setting up timezone %s", conf.Timezone)
+
+		err = setupTimezone(path, conf)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return fmt.Errorf("setup timezone: %w", err)
+		}
+	}
+
 	logging.LogDebug("setting up volumes")
 
 	err = setupVolumes(path, conf)
@@ -522,6 +911,26 @@ func SetupRootfs(conf utils.Config) error {
 		return err
 	}
 
+	// masks are set up after the volumes, so that their paths can be masked
+	// unprivileged has less access to filesystem kernel and so on
+	if !conf.Privileged {
+		logging.LogDebug("container is not privileged, setting up masked mounts")
+
+		err = setupMaskedMounts(path, conf.Unmask)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return err
+		}
+	}
+
+	err = setupMasks(path, conf.Mask)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
 	logging.LogDebug("setting up PTY %s", path)
 
 	// setup the pty,
@@ -544,12 +953,17 @@ func SetupRootfs(conf utils.Config) error {
 
 	defer func() { _ = infoFile.Close() }()
 
+	imageID := imageutils.GetID(conf.Image)
+	if conf.Rootfs != "" {
+		imageID = ""
+	}
+
 	info := fmt.Sprintf(`engine="%s"
 name="%s"
 id="%s"
 image="%s"
 imageid="%s"
-`, "lilipod-"+constants.Version, conf.Names, GetID(conf.Names), conf.Image, imageutils.GetID(conf.Image))
+`, "lilipod-"+constants.Version, conf.Names, GetID(conf.Names), conf.Image, imageID)
 
 	_, err = infoFile.WriteString(info)
 	if err != nil {
@@ -631,16 +1045,68 @@ func PivotRoot(path string) error {
 
 // RunContainer will start specified container in path, with tty if enabled.
 // This will:
+//   - Set time namespace offsets according to input config
+//   - Create the cgroup namespace, with resource limits
+//   - Set sysctls according to input config
 //   - SetupRootfs
 //   - PivotRoot
 //   - Set Hostname according to input config
-//   - Set UID/GID according to input config
-//   - execve the entrypoint
+//   - Set ulimits and OOM score adjustment according to input config
+//   - Apply the landlock ruleset and the seccomp filter according to input config
+//   - Set UID/GID and umask according to input config
+//   - Set no_new_privs if enabled, so that setuid binaries can't gain privileges
+//   - execve the entrypoint, through the agent if tty or init are enabled,
+//     except for systemd containers, see IsSystemd
 func RunContainer(tty bool, conf utils.Config) error {
+	if conf.Time == constants.Private && len(conf.TimeOffsets) > 0 {
+		logging.LogDebug("setting time offsets: %v", conf.TimeOffsets)
+
+		err := procutils.SetTimeOffsets(conf.TimeOffsets)
+		if err != nil {
+			logging.LogError("error: %+v", err)
+
+			return fmt.Errorf("error setting time offsets: %w", err)
+		}
+	}
+
+	// we were started in the container's cgroup, see prepareStart, this is done
+	// from the main thread, from which the entrypoint is executed
+	if conf.Cgroup == constants.Private && conf.Resources != nil {
+		logging.LogDebug("creating cgroup namespace")
+
+		err := syscall.Unshare(syscall.CLONE_NEWCGROUP)
+		if err != nil {
+			logging.LogError("error: %+v", err)
+
+			return fmt.Errorf("error creating cgroup namespace: %w", err)
+		}
+	}
+
+	err := setupSysctls(conf)
+	if err != nil {
+		logging.LogError("error: %+v", err)
+
+		return err
+	}
+
+	seccomp, err := getSeccompFilter(conf)
+	if err != nil {
+		logging.LogError("error: %+v", err)
+
+		return fmt.Errorf("error loading seccomp profile: %w", err)
+	}
+
+	landlock, err := getLandlockRuleset(conf)
+	if err != nil {
+		logging.LogError("error: %+v", err)
+
+		return fmt.Errorf("error loading landlock profile: %w", err)
+	}
+
 	// setup mounts and stuff
 	logging.LogDebug("setting up rootfs in: %s", GetRootfsDir(conf.ID))
 
-	err := SetupRootfs(conf)
+	err = SetupRootfs(conf)
 	if err != nil {
 		logging.LogError("error: %+v", err)
 
@@ -666,6 +1132,9 @@ func RunContainer(tty bool, conf utils.Config) error {
 
 	logging.LogDebug("chdir to workdir: %s", conf.Workdir)
 
+	// like docker, ensure the workdir exists
+	_ = os.MkdirAll(conf.Workdir, 0o755)
+
 	err = syscall.Chdir(conf.Workdir)
 	if err != nil {
 		logging.LogDebug("error: %+v", err)
@@ -683,31 +1152,77 @@ func RunContainer(tty bool, conf utils.Config) error {
 		return fmt.Errorf("error setting hostname for namespace: %w", err)
 	}
 
-	logging.LogDebug("become user: %s", conf.User)
+	err = setupProcess(conf)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
 
-	// become the user that we're reuired to be
-	uid, gid := procutils.GetUIDGID(conf.User)
+		return err
+	}
 
-	err = syscall.Setgid(gid)
+	// we're now in the rootfs, so we resolve the user against its /etc/passwd,
+	// before the landlock ruleset can deny reading it
+	user, err := procutils.LookupUser("/", conf.User, conf.GroupAdd)
 	if err != nil {
 		logging.LogDebug("error: %+v", err)
 
 		return err
 	}
 
-	err = syscall.Setuid(uid)
+	// like seccomp, the ruleset is applied while we have CAP_SYS_ADMIN, before
+	// the filter, so that it doesn't need to allow the landlock syscalls.
+	if landlock != nil {
+		logging.LogDebug("applying landlock ruleset: %v", landlock.Rules)
+
+		// the agent must still be able to run, see ptyagent
+		landlock.Rules = append(landlock.Rules, securityutils.LandlockRule{
+			Path:   constants.PtyAgentPath,
+			Access: unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE,
+		})
+
+		err = securityutils.ApplyLandlock(landlock)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return err
+		}
+	}
+
+	// this is the last moment we have CAP_SYS_ADMIN, that allows installing the
+	// filter without no_new_privs, which would break setuid binaries. The filter
+	// must allow what's left until syscall.Exec, like runc does.
+	if seccomp != nil {
+		logging.LogDebug("installing seccomp filter")
+
+		err = securityutils.InstallSeccomp(seccomp)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return err
+		}
+	}
+
+	caps := getCapabilities(conf)
+
+	logging.LogDebug("setting capabilities: %v", caps)
+
+	// root in the container gets the bounding set at execve
+	err = securityutils.DropBoundingCapabilities(caps)
 	if err != nil {
 		logging.LogDebug("error: %+v", err)
 
 		return err
 	}
 
-	logging.LogDebug("setting up env variables")
+	logging.LogDebug("become user: %s", conf.User)
 
-	for _, v := range conf.Env {
-		en := strings.Split(v, "=")
+	// other users only get the added capabilities, as ambient ones
+	ambient := []string{}
+	if user.UID != 0 {
+		ambient = securityutils.GetAmbientCapabilities(caps, conf.CapAdd)
+	}
 
-		err = os.Setenv(en[0], en[1])
+	if len(ambient) > 0 {
+		err = securityutils.KeepCapabilities()
 		if err != nil {
 			logging.LogDebug("error: %+v", err)
 
@@ -715,83 +1230,116 @@ func RunContainer(tty bool, conf utils.Config) error {
 		}
 	}
 
-	command := conf.Entrypoint[0]
+	err = syscall.Setgroups(user.Groups)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
 
-	commandPath, err := exec.LookPath(command)
+		return err
+	}
+
+	err = syscall.Setgid(user.GID)
 	if err != nil {
 		logging.LogDebug("error: %+v", err)
 
 		return err
 	}
 
-	if err := setCapabilities(keepCaps...); err != nil {
-		fmt.Fprintf(os.Stderr, "error setting capabilities for process: %v\n", err)
-		os.Exit(1)
+	err = syscall.Setuid(user.UID)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
 	}
 
-	if tty {
-		args := append([]string{constants.PtyAgentPath}, conf.Entrypoint...)
+	if len(ambient) > 0 {
+		logging.LogDebug("setting ambient capabilities: %v", ambient)
 
-		logging.LogDebug("tty requested, execute entrypoint with agent: %s", args)
+		err = securityutils.RaiseAmbientCapabilities(ambient)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
 
-		return syscall.Exec(constants.PtyAgentPath, args, conf.Env)
+			return err
+		}
 	}
 
-	logging.LogDebug("execute entrypoint: %s", conf.Entrypoint)
+	conf.Env = user.Env(conf.Env)
 
-	return syscall.Exec(commandPath, conf.Entrypoint, conf.Env)
-}
+	// systemd detects containers from this variable
+	if IsSystemd(conf) {
+		conf.Env = utils.MergeEnv(conf.Env, []string{"container=lilipod"})
+	}
 
-var keepCaps = []string{
-	"chown",
-	"dac_override",
-	"fsetid",
-	"fowner",
-	"mknod",
-	"net_raw",
-	"setgid",
-	"setuid",
-	"setfcap",
-	"setpcap",
-	"net_bind_service",
-	"sys_chroot",
-	"kill",
-	"audit_write",
-}
+	logging.LogDebug("setting up env variables")
 
-func setCapabilities(keepCaps ...string) error {
-	caps, err := capability.NewPid2(0)
-	if err != nil {
-		return fmt.Errorf("reading capabilities of current process: %w", err)
+	for _, v := range conf.Env {
+		key, value, found := strings.Cut(v, "=")
+		if !found {
+			continue
+		}
+
+		err = os.Setenv(key, value)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return err
+		}
 	}
 
-	knownCapsList := capability.ListKnown()
+	command := conf.Entrypoint[0]
 
-	for _, capSpec := range keepCaps {
-		// nocap
-		capToSet := capability.Cap(-1)
+	commandPath, err := exec.LookPath(command)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
 
-		for _, c := range knownCapsList {
-			if strings.EqualFold(c.String(), capSpec) {
-				capToSet = c
+		return err
+	}
 
-				break
-			}
+	if conf.Umask != "" {
+		umask, err := procutils.ParseUmask(conf.Umask)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return err
 		}
 
-		caps.Set(capability.BOUNDING, capToSet)
-		caps.Set(capability.EFFECTIVE, capToSet)
-		caps.Set(capability.PERMITTED, capToSet)
+		logging.LogDebug("setting umask to %s", conf.Umask)
+
+		syscall.Umask(umask)
 	}
 
-	if err = caps.Apply(capability.CAPS | capability.BOUNDS | capability.AMBS); err != nil {
-		return fmt.Errorf("setting capabilities: %w", err)
+	if conf.NoNewPrivileges {
+		logging.LogDebug("setting no new privileges")
+
+		err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		if err != nil {
+			logging.LogDebug("error: %+v", err)
+
+			return fmt.Errorf("error setting no new privileges: %w", err)
+		}
 	}
 
-	_, err = capability.NewPid2(0)
-	if err != nil {
-		return fmt.Errorf("reading capabilities of current process: %w", err)
+	// systemd must be PID 1, and already has the console as its terminal
+	if (tty || conf.Init) && !IsSystemd(conf) {
+		args := []string{constants.PtyAgentPath}
+
+		// the agent stays as the container's init, see ptyagent
+		if conf.Init {
+			args = append(args, "--init")
+		}
+
+		if !tty {
+			args = append(args, "--no-tty")
+		}
+
+		args = append(args, "--")
+		args = append(args, conf.Entrypoint...)
+
+		logging.LogDebug("execute entrypoint with agent: %s", args)
+
+		return syscall.Exec(constants.PtyAgentPath, args, conf.Env)
 	}
 
-	return nil
+	logging.LogDebug("execute entrypoint: %s", conf.Entrypoint)
+
+	return syscall.Exec(commandPath, conf.Entrypoint, conf.Env)
 }
@@ -0,0 +1,64 @@
+package containerutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRootfs(t *testing.T) {
+	root := t.TempDir()
+
+	for _, dir := range []string{"etc", "usr/share/zoneinfo", "lib"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"etc/relative": "../usr/share/zoneinfo/UTC",
+		"etc/absolute": "/usr/share/zoneinfo/UTC",
+		"etc/escaping": "../../../../usr/share/zoneinfo/UTC",
+		"etc/chained":  "relative",
+		"etc/loop":     "loop",
+		"zoneinfo":     "usr/share/zoneinfo",
+		"usr/lib":      "/lib",
+	}
+
+	for name, target := range links {
+		err := os.Symlink(target, filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{target: "/etc/localtime", want: "/etc/localtime"},
+		{target: "/etc/relative", want: "/usr/share/zoneinfo/UTC"},
+		{target: "/etc/absolute", want: "/usr/share/zoneinfo/UTC"},
+		{target: "/etc/escaping", want: "/usr/share/zoneinfo/UTC"},
+		{target: "/etc/chained", want: "/usr/share/zoneinfo/UTC"},
+		{target: "/zoneinfo/UTC", want: "/usr/share/zoneinfo/UTC"},
+		{target: "/usr/lib/missing", want: "/lib/missing"},
+		{target: "/../../etc/relative", want: "/usr/share/zoneinfo/UTC"},
+		{target: "/etc/loop", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			got, err := resolveInRootfs(root, test.target)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("resolveInRootfs(%q) error = %v, wantErr %v", test.target, err, test.wantErr)
+			}
+
+			if !test.wantErr && got != filepath.Join(root, test.want) {
+				t.Errorf("resolveInRootfs(%q) = %s, want %s", test.target, got, filepath.Join(root, test.want))
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@
 package fileutils
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -16,6 +19,12 @@ import (
 	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/logging"
 	"github.com/89luca89/lilipod/pkg/procutils"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
 )
 
 // ReadFile will return the content of input file or error.
@@ -392,7 +401,64 @@ func MountBindRO(src, dest string) error {
 			syscall.MS_NOEXEC|syscall.MS_NODEV|syscall.MS_PRIVATE)
 }
 
+// GetZoneinfo returns the host's zoneinfo file of input timezone, like Europe/Rome,
+// local being the host's timezone.
+func GetZoneinfo(timezone string) (string, error) {
+	path := filepath.Join(constants.ZoneinfoDir, timezone)
+	if timezone == "local" {
+		path = "/etc/localtime"
+	} else if !strings.HasPrefix(path, constants.ZoneinfoDir+"/") {
+		return "", fmt.Errorf("invalid timezone %s", timezone)
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return "", fmt.Errorf("unknown timezone %s", timezone)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("unknown timezone %s", timezone)
+	}
+
+	return resolved, nil
+}
+
+// NewDecompressor returns a reader decompressing input reader.
+// The compression format is detected from the stream's magic bytes, so that
+// gzip, zstd and uncompressed streams are all supported.
+func NewDecompressor(reader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+
+	// we're ok with reading less than the magic, it will just be uncompressed
+	magic, _ := buffered.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		logging.LogDebug("detected gzip compressed stream")
+
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		logging.LogDebug("detected zstd compressed stream")
+
+		decoder, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+	default:
+		logging.LogDebug("detected uncompressed stream")
+
+		return io.NopCloser(buffered), nil
+	}
+}
+
 // UntarFile will untar target file to target directory.
+// The file can be either uncompressed, or gzip or zstd compressed, decompression
+// is performed here and the plain tar stream is passed to tar.
 // If userns is specified and it is keep-id, it will perform the
 // untarring in a new user namespace with user id maps set, in order to prevent
 // permission errors.
@@ -405,8 +471,28 @@ func UntarFile(path string, target string, userns string) error {
 		return err
 	}
 
+	file, err := os.Open(path)
+	if err != nil {
+		logging.LogError("%v", err)
+
+		return err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	tarStream, err := NewDecompressor(file)
+	if err != nil {
+		logging.LogError("%v", err)
+
+		return err
+	}
+
+	defer func() { _ = tarStream.Close() }()
+
 	if userns != constants.KeepID {
-		cmd := exec.Command("tar", "--exclude=dev/*", "-xf", path, "-C", target)
+		cmd := exec.Command("tar", "--exclude=dev/*", "-xf", "-", "-C", target)
+		cmd.Stdin = tarStream
+
 		logging.LogDebug("no keep-id specified, simply perform %v", cmd.Args)
 
 		out, err := cmd.CombinedOutput()
@@ -422,10 +508,11 @@ func UntarFile(path string, target string, userns string) error {
 		"-c",
 		"mkdir -p " + target + " &&" +
 			"chown -R root:root " + target + " &&" +
-			"tar --exclude=dev/* -xf " + path + " -C " + target,
+			"tar --exclude=dev/* -xf - -C " + target,
 	}
 
 	cmd := exec.Command(command, args...)
+	cmd.Stdin = tarStream
 
 	// we need to unpack using keep-id in order to keep consistency
 	cloneFlags := syscall.CLONE_NEWUTS | syscall.CLONE_NEWNS
@@ -0,0 +1,61 @@
+package fileutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNewDecompressor(t *testing.T) {
+	content := bytes.Repeat([]byte("layer content\n"), 100)
+
+	gzipped := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, _ = gzipWriter.Write(content)
+	_ = gzipWriter.Close()
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zstded := zstdEncoder.EncodeAll(content, nil)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "gzip", input: gzipped.Bytes(), want: content},
+		{name: "zstd", input: zstded, want: content},
+		{name: "uncompressed", input: content, want: content},
+		{name: "shorter than magic", input: []byte("ab"), want: []byte("ab")},
+		{name: "empty", input: nil, want: []byte{}},
+		{name: "truncated gzip", input: gzipped.Bytes()[:gzipped.Len()/2], wantErr: true},
+		{name: "truncated zstd", input: zstded[:len(zstded)/2], wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewDecompressor(bytes.NewReader(test.input))
+			if err == nil {
+				var got []byte
+
+				got, err = io.ReadAll(reader)
+				_ = reader.Close()
+
+				if err == nil && !bytes.Equal(got, test.want) {
+					t.Errorf("NewDecompressor() read %q, want %q", got, test.want)
+				}
+			}
+
+			if (err != nil) != test.wantErr {
+				t.Errorf("NewDecompressor() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -21,18 +21,64 @@ import (
 	"github.com/google/go-containerregistry/pkg/legacy"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/schollz/progressbar/v3"
 )
 
 // ImageDir is the default location for downloaded images.
 var ImageDir = filepath.Join(utils.GetLilipodHome(), "images")
 
+// AdditionalImageStoresFile is the system-wide file listing read-only image stores,
+// one path per line.
+const AdditionalImageStoresFile = "/etc/lilipod/additional-image-stores"
+
+// AdditionalImageStores is the list of read-only image stores searched after ImageDir.
+var AdditionalImageStores = GetAdditionalImageStores()
+
+// GetAdditionalImageStores returns the list of read-only image stores to search
+// after ImageDir.
+// Stores are read from the LILIPOD_ADDITIONAL_IMAGE_STORES environment variable,
+// as a colon separated list of paths, or if unset from AdditionalImageStoresFile.
+func GetAdditionalImageStores() []string {
+	var stores []string
+
+	input := os.Getenv("LILIPOD_ADDITIONAL_IMAGE_STORES")
+	if input != "" {
+		stores = strings.Split(input, ":")
+	} else {
+		file, err := os.ReadFile(AdditionalImageStoresFile)
+		if err != nil {
+			return nil
+		}
+
+		stores = strings.Split(string(file), "\n")
+	}
+
+	result := []string{}
+
+	for _, store := range stores {
+		store = strings.TrimSpace(store)
+
+		// skip empty lines, comments and our own store
+		if store == "" || strings.HasPrefix(store, "#") ||
+			filepath.Clean(store) == filepath.Clean(ImageDir) {
+			continue
+		}
+
+		result = append(result, filepath.Clean(store))
+	}
+
+	return result
+}
+
 // GetID returns the md5sum based ID for given image.
 // If a recognized ID is passed, it is returned.
 func GetID(image string) string {
 	// if an ID is already passed, just return
-	if fileutils.Exist(filepath.Join(ImageDir, image)) {
-		return image
+	for _, store := range append([]string{ImageDir}, AdditionalImageStores...) {
+		if fileutils.Exist(filepath.Join(store, image)) {
+			return image
+		}
 	}
 
 	// Normalize the name with full length registry
@@ -52,8 +98,57 @@ func GetID(image string) string {
 }
 
 // GetPath returns the path for given image name or id.
+// The user's ImageDir is searched first, then the AdditionalImageStores.
+// If the image is not found anywhere, the path inside ImageDir is returned.
 func GetPath(name string) string {
-	return filepath.Join(ImageDir, GetID(name))
+	id := GetID(name)
+
+	if fileutils.Exist(filepath.Join(ImageDir, id)) {
+		return filepath.Join(ImageDir, id)
+	}
+
+	for _, store := range AdditionalImageStores {
+		if fileutils.Exist(filepath.Join(store, id)) {
+			return filepath.Join(store, id)
+		}
+	}
+
+	return filepath.Join(ImageDir, id)
+}
+
+// IsReadOnly returns whether input image name or id is found in one of the
+// read-only AdditionalImageStores, and thus cannot be modified.
+func IsReadOnly(name string) bool {
+	return filepath.Dir(GetPath(name)) != filepath.Clean(ImageDir)
+}
+
+// List returns the paths of all the images available, first from ImageDir and
+// then from the AdditionalImageStores.
+// Images found in multiple stores are listed only once, the first store wins.
+func List() []string {
+	result := []string{}
+	found := map[string]bool{}
+
+	for _, store := range append([]string{ImageDir}, AdditionalImageStores...) {
+		images, err := os.ReadDir(store)
+		if err != nil {
+			logging.LogDebug("cannot read image store %s: %v", store, err)
+
+			continue
+		}
+
+		for _, image := range images {
+			if found[image.Name()] || !image.IsDir() {
+				continue
+			}
+
+			found[image.Name()] = true
+
+			result = append(result, filepath.Join(store, image.Name()))
+		}
+	}
+
+	return result
 }
 
 // Pull will pull a given image and save it to ImageDir.
@@ -61,7 +156,13 @@ func GetPath(name string) string {
 // the image's manifest, and performs the downloading of each layer separately.
 // Each layer is deduplicated between images in order to save space, using hardlinks.
 // If quiet is specified, no output nor progress will be shown.
+// Images prefixed with ContainersStoragePrefix are imported from the local
+// containers/storage instead, see ImportContainersStorage.
 func Pull(image string, quiet bool) (string, error) {
+	if IsContainersStorage(image) {
+		return ImportContainersStorage(image, quiet)
+	}
+
 	// First we try to get the fully qualified uri of the image
 	// eg alpine:latest -> index.docker.io/library/alpine:latest
 	ref, err := name.ParseReference(image)
@@ -89,8 +190,9 @@ func Pull(image string, quiet bool) (string, error) {
 		return "", err
 	}
 
-	// Prepare the image path
-	targetDIR := GetPath(image)
+	// Prepare the image path, always in our own store as
+	// additional image stores are read-only
+	targetDIR := filepath.Join(ImageDir, GetID(image))
 	if !fileutils.Exist(targetDIR) {
 		err := os.MkdirAll(targetDIR, os.ModePerm)
 		if err != nil {
@@ -197,6 +299,22 @@ func Pull(image string, quiet bool) (string, error) {
 	return GetID(image), nil
 }
 
+// GetLayerFileName returns the file name used to store the layer described by
+// input descriptor, with an extension matching its compression:
+// .tar.gz for gzip, .tar.zst for zstd and .tar for uncompressed layers.
+func GetLayerFileName(layer v1.Descriptor) string {
+	switch layer.MediaType {
+	case types.OCILayerZStd:
+		return layer.Digest.Hex + ".tar.zst"
+	case types.OCIUncompressedLayer,
+		types.OCIUncompressedRestrictedLayer,
+		types.DockerUncompressedLayer:
+		return layer.Digest.Hex + ".tar"
+	default:
+		return layer.Digest.Hex + ".tar.gz"
+	}
+}
+
 // Inspect will return a JSON or a formatted string describing the input images.
 func Inspect(images []string, format string) (string, error) {
 	result := ""
@@ -273,8 +391,9 @@ func downloadLayer(targetDIR string, quiet bool, layer v1.Layer) (string, error)
 	defer func() { _ = os.RemoveAll(tmpdir) }()
 
 	layerDigest, _ := layer.Digest()
+	layerMediaType, _ := layer.MediaType()
 
-	layerFileName := strings.Split(layerDigest.String(), ":")[1] + ".tar.gz"
+	layerFileName := GetLayerFileName(v1.Descriptor{Digest: layerDigest, MediaType: layerMediaType})
 
 	if !quiet {
 		logging.Log("pulling layer %s", layerFileName)
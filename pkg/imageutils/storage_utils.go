@@ -0,0 +1,474 @@
+// Package imageutils contains helpers and utilities for managing and pulling
+// images.
+package imageutils
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/lilipod/pkg/constants"
+	"github.com/89luca89/lilipod/pkg/fileutils"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// ContainersStoragePrefix is the transport prefix used to import images from
+// a local containers/storage, as used by Podman and Buildah.
+const ContainersStoragePrefix = "containers-storage:"
+
+// storageImage is the subset of a containers/storage image entry,
+// as found in DRIVER-images/images.json, that we need.
+type storageImage struct {
+	ID       string   `json:"id"`
+	Names    []string `json:"names"`
+	TopLayer string   `json:"layer"`
+}
+
+// storageLayer is the subset of a containers/storage layer entry,
+// as found in DRIVER-layers/layers.json, that we need.
+type storageLayer struct {
+	ID         string `json:"id"`
+	Parent     string `json:"parent"`
+	DiffDigest string `json:"diff-digest"`
+}
+
+// IsContainersStorage returns whether input image reference points to a
+// local containers/storage.
+func IsContainersStorage(image string) bool {
+	return strings.HasPrefix(image, ContainersStoragePrefix)
+}
+
+// ImportContainersStorage will import an image from a local containers/storage
+// into ImageDir, without any network access.
+// Input reference is in the form of:
+//
+//	containers-storage:[DRIVER@GRAPHROOT]IMAGE
+//
+// If no storage is specified, the default Podman storage for the current user
+// is used, with the overlay driver.
+//
+// Image's config is copied as is, while each layer is reconstructed from the
+// layer's tar-split metadata and diff directory, and saved gzip compressed.
+// A new manifest is then generated for the imported layers.
+func ImportContainersStorage(reference string, quiet bool) (string, error) {
+	driver, graphRoot, image := parseContainersStorageReference(reference)
+
+	logging.LogDebug("importing %s from %s storage in %s", image, driver, graphRoot)
+
+	storageImg, err := findStorageImage(graphRoot, driver, image)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	// use the normalized name of the image if we have one, else we use the
+	// storage ID
+	imageName := storageImg.ID
+	if len(storageImg.Names) > 0 {
+		imageName = storageImg.Names[0]
+
+		ref, err := name.ParseReference(imageName)
+		if err == nil {
+			imageName = ref.Name()
+		}
+	}
+
+	if !quiet {
+		fmt.Printf("importing image %s from %s\n", imageName, graphRoot)
+	}
+
+	// the image's config is saved as a big data item with the config digest
+	// as key, which is also the image ID
+	configPath := filepath.Join(graphRoot, driver+"-images", storageImg.ID,
+		storageBigDataName("sha256:"+storageImg.ID))
+
+	rawConfig, err := fileutils.ReadFile(configPath)
+	if err != nil {
+		logging.LogError("cannot find config for image %s: %+v", imageName, err)
+
+		return "", err
+	}
+
+	var config v1.ConfigFile
+
+	err = json.Unmarshal(rawConfig, &config)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	layers, err := getStorageLayerChain(graphRoot, driver, storageImg.TopLayer)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	if len(layers) != len(config.RootFS.DiffIDs) {
+		return "", fmt.Errorf("image %s has %d layers in storage, but %d in its config",
+			imageName, len(layers), len(config.RootFS.DiffIDs))
+	}
+
+	targetDIR := filepath.Join(ImageDir, GetID(imageName))
+
+	err = os.MkdirAll(targetDIR, os.ModePerm)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: types.OCIConfigJSON,
+			Size:      int64(len(rawConfig)),
+			Digest: v1.Hash{
+				Algorithm: "sha256",
+				Hex:       fmt.Sprintf("%x", sha256.Sum256(rawConfig)),
+			},
+		},
+	}
+
+	keepFiles := map[string]bool{}
+
+	for i, layer := range layers {
+		if layer.DiffDigest != config.RootFS.DiffIDs[i].String() {
+			return "", fmt.Errorf("layer %s does not match image config diff id %s",
+				layer.ID, config.RootFS.DiffIDs[i].String())
+		}
+
+		if !quiet {
+			logging.Log("importing layer %s", layer.DiffDigest)
+		}
+
+		descriptor, err := importStorageLayer(graphRoot, driver, layer, targetDIR)
+		if err != nil {
+			logging.LogError("%+v", err)
+
+			return "", err
+		}
+
+		manifest.Layers = append(manifest.Layers, descriptor)
+		keepFiles[GetLayerFileName(descriptor)] = true
+	}
+
+	logging.LogDebug("cleaning up unwanted files")
+
+	fileList, err := os.ReadDir(targetDIR)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	for _, file := range fileList {
+		if !keepFiles[file.Name()] {
+			logging.LogDebug("found unwanted file %s, removing", file.Name())
+
+			_ = os.RemoveAll(filepath.Join(targetDIR, file.Name()))
+		}
+	}
+
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	if !quiet {
+		fmt.Printf("saving manifest for %s\n", imageName)
+	}
+
+	err = fileutils.WriteFile(filepath.Join(targetDIR, "manifest.json"), rawManifest, 0o644)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	if !quiet {
+		fmt.Printf("saving config for %s\n", imageName)
+	}
+
+	err = fileutils.WriteFile(filepath.Join(targetDIR, "config.json"), rawConfig, 0o644)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	if !quiet {
+		fmt.Printf("saving metadata for %s\n", imageName)
+	}
+
+	err = fileutils.WriteFile(filepath.Join(targetDIR, "image_name"), []byte(imageName), 0o644)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	if !quiet {
+		fmt.Println("done")
+	}
+
+	return GetID(imageName), nil
+}
+
+// ----------------------------------------------------------------------------
+
+// parseContainersStorageReference will split a containers-storage reference into
+// the storage driver, the storage graph root and the image.
+func parseContainersStorageReference(reference string) (string, string, string) {
+	reference = strings.TrimPrefix(reference, ContainersStoragePrefix)
+
+	driver := "overlay"
+	graphRoot := getDefaultStorageRoot()
+
+	// case of containers-storage:[overlay@/var/lib/containers/storage+/run/containers/storage]alpine
+	if strings.HasPrefix(reference, "[") && strings.Contains(reference, "]") {
+		store := reference[1:strings.Index(reference, "]")]
+		reference = reference[strings.Index(reference, "]")+1:]
+
+		// drop the run root and options, we don't need them
+		store, _, _ = strings.Cut(store, "+")
+		store, _, _ = strings.Cut(store, ":")
+
+		if before, after, found := strings.Cut(store, "@"); found {
+			driver = before
+			store = after
+		}
+
+		if store != "" {
+			graphRoot = store
+		}
+	}
+
+	return driver, graphRoot, reference
+}
+
+// getDefaultStorageRoot returns the default containers/storage graph root for
+// the running user.
+func getDefaultStorageRoot() string {
+	if os.Getenv("ROOTFUL") == constants.TrueString {
+		return "/var/lib/containers/storage"
+	}
+
+	if os.Getenv("XDG_DATA_HOME") != "" {
+		return filepath.Join(os.Getenv("XDG_DATA_HOME"), "containers/storage")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".local/share/containers/storage")
+}
+
+// storageBigDataName returns the file name containers/storage uses to save
+// an image's big data item with input key.
+// Keys with characters other than lowercase letters, digits and dots are
+// saved base64 encoded, with a "=" prefix.
+func storageBigDataName(key string) string {
+	for _, char := range key {
+		if char != '.' && (char < '0' || char > '9') && (char < 'a' || char > 'z') {
+			return "=" + base64.StdEncoding.EncodeToString([]byte(key))
+		}
+	}
+
+	return key
+}
+
+// findStorageImage will search the storage's images.json for an image matching
+// input image name or ID.
+func findStorageImage(graphRoot, driver, image string) (storageImage, error) {
+	imagesFile, err := fileutils.ReadFile(filepath.Join(graphRoot, driver+"-images", "images.json"))
+	if err != nil {
+		return storageImage{}, fmt.Errorf("cannot read %s storage in %s: %w", driver, graphRoot, err)
+	}
+
+	var storageImages []storageImage
+
+	err = json.Unmarshal(imagesFile, &storageImages)
+	if err != nil {
+		return storageImage{}, err
+	}
+
+	// normalize the name so that alpine matches docker.io/library/alpine:latest
+	imageRef := ""
+
+	ref, err := name.ParseReference(image)
+	if err == nil {
+		imageRef = ref.Name()
+	}
+
+	for _, storageImg := range storageImages {
+		if len(image) >= 3 && strings.HasPrefix(storageImg.ID, strings.TrimPrefix(image, "sha256:")) {
+			return storageImg, nil
+		}
+
+		for _, storageName := range storageImg.Names {
+			ref, err := name.ParseReference(storageName)
+			if err == nil && imageRef != "" && ref.Name() == imageRef {
+				return storageImg, nil
+			}
+		}
+	}
+
+	return storageImage{}, fmt.Errorf("image %s not found in %s", image, graphRoot)
+}
+
+// getStorageLayerChain will return the layers composing an image, from the
+// base layer to input top layer.
+func getStorageLayerChain(graphRoot, driver, topLayer string) ([]storageLayer, error) {
+	layersFile, err := fileutils.ReadFile(filepath.Join(graphRoot, driver+"-layers", "layers.json"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s storage layers in %s: %w", driver, graphRoot, err)
+	}
+
+	var storageLayers []storageLayer
+
+	err = json.Unmarshal(layersFile, &storageLayers)
+	if err != nil {
+		return nil, err
+	}
+
+	layersByID := map[string]storageLayer{}
+	for _, layer := range storageLayers {
+		layersByID[layer.ID] = layer
+	}
+
+	result := []storageLayer{}
+
+	for current := topLayer; current != ""; {
+		layer, ok := layersByID[current]
+		if !ok {
+			return nil, fmt.Errorf("layer %s not found in %s", current, graphRoot)
+		}
+
+		result = append([]storageLayer{layer}, result...)
+		current = layer.Parent
+	}
+
+	return result, nil
+}
+
+// getStorageLayerDiffDir returns the directory holding the content of input
+// layer, depending on the storage driver.
+func getStorageLayerDiffDir(graphRoot, driver, layer string) string {
+	if driver == "vfs" {
+		return filepath.Join(graphRoot, driver, "dir", layer)
+	}
+
+	return filepath.Join(graphRoot, driver, layer, "diff")
+}
+
+// importStorageLayer will reconstruct the original tar stream of input layer,
+// using its tar-split metadata and its diff directory, and save it gzip
+// compressed into targetDIR.
+// The uncompressed stream is verified against the layer's diff digest.
+func importStorageLayer(
+	graphRoot, driver string,
+	layer storageLayer,
+	targetDIR string,
+) (v1.Descriptor, error) {
+	tarSplitFile, err := os.Open(filepath.Join(graphRoot, driver+"-layers", layer.ID+".tar-split.gz"))
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("cannot find tar-split for layer %s: %w", layer.ID, err)
+	}
+
+	defer func() { _ = tarSplitFile.Close() }()
+
+	tarSplit, err := gzip.NewReader(tarSplitFile)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	tarStream := asm.NewOutputTarStream(
+		storage.NewPathFileGetter(getStorageLayerDiffDir(graphRoot, driver, layer.ID)),
+		storage.NewJSONUnpacker(tarSplit),
+	)
+
+	defer func() { _ = tarStream.Close() }()
+
+	// we use this as a path to save layers, in order to
+	// verify them and ensure we do not leave broken files
+	tmpdir := filepath.Join(targetDIR, ".temp")
+
+	_ = os.RemoveAll(tmpdir)
+
+	err = os.MkdirAll(tmpdir, 0o750)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	savedLayer, err := os.Create(filepath.Join(tmpdir, "layer"))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	defer func() { _ = savedLayer.Close() }()
+
+	compressedHasher := sha256.New()
+	uncompressedHasher := sha256.New()
+	counter := &countingWriter{}
+
+	layerWriter := io.MultiWriter(savedLayer, compressedHasher, counter)
+
+	compressor := gzip.NewWriter(layerWriter)
+
+	_, err = io.Copy(io.MultiWriter(compressor, uncompressedHasher), tarStream)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("cannot reconstruct layer %s: %w", layer.ID, err)
+	}
+
+	err = compressor.Close()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	if "sha256:"+fmt.Sprintf("%x", uncompressedHasher.Sum(nil)) != layer.DiffDigest {
+		return v1.Descriptor{}, errors.New("reconstructed layer " + layer.ID + " does not match its digest")
+	}
+
+	descriptor := v1.Descriptor{
+		MediaType: types.OCILayer,
+		Size:      counter.size,
+		Digest:    v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", compressedHasher.Sum(nil))},
+	}
+
+	err = os.Rename(filepath.Join(tmpdir, "layer"), filepath.Join(targetDIR, GetLayerFileName(descriptor)))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	logging.LogDebug("successfully imported layer %s as %s", layer.ID, GetLayerFileName(descriptor))
+
+	return descriptor, nil
+}
+
+// countingWriter is a writer that only counts the bytes written to it.
+type countingWriter struct {
+	size int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+
+	return len(p), nil
+}
@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -193,6 +194,79 @@ func AppendStringToFile(path string, input string) error {
 	return syscall.Close(fd)
 }
 
+// LogFile is a log file that is rotated once it grows over MaxSize bytes,
+// keeping up to MaxFiles rotated files named path.1, path.2 and so on, path.1
+// being the most recent. A MaxSize of 0 never rotates the file.
+type LogFile struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+
+	mutex sync.Mutex
+}
+
+// Append will append input string to the log file, rotating it first if needed.
+func (l *LogFile) Append(input string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.MaxSize > 0 {
+		info, err := os.Stat(l.Path)
+		if err == nil && info.Size()+int64(len(input)) > l.MaxSize {
+			err = l.rotate()
+			if err != nil {
+				LogDebug("error: %+v", err)
+
+				return err
+			}
+		}
+	}
+
+	return AppendStringToFile(l.Path, input)
+}
+
+// rotate will shift the rotated files by one, dropping the oldest ones, and
+// move the current log file to path.1.
+func (l *LogFile) rotate() error {
+	maxFiles := max(l.MaxFiles, 1)
+
+	for i := maxFiles; i > 1; i-- {
+		err := os.Rename(l.Path+"."+strconv.Itoa(i-1), l.Path+"."+strconv.Itoa(i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// files beyond MaxFiles are leftovers of a previous setting
+	for i := maxFiles + 1; ; i++ {
+		err := os.Remove(l.Path + "." + strconv.Itoa(i))
+		if err != nil {
+			break
+		}
+	}
+
+	return os.Rename(l.Path, l.Path+".1")
+}
+
+// GetLogFiles returns the existing files of input log, the rotated ones first,
+// from the oldest to the most recent, and the log file itself last.
+func GetLogFiles(path string) []string {
+	result := []string{path}
+
+	for i := 1; ; i++ {
+		rotated := path + "." + strconv.Itoa(i)
+
+		_, err := os.Stat(rotated)
+		if err != nil {
+			break
+		}
+
+		result = append([]string{rotated}, result...)
+	}
+
+	return result
+}
+
 // LogError will create an error log in the form of:
 // callerfile.go:line [error] message...
 func LogError(format string, v ...any) {
@@ -0,0 +1,243 @@
+// Package procutils contains helpers and utilities for managing processes.
+package procutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/89luca89/lilipod/pkg/constants"
+	"golang.org/x/sys/unix"
+)
+
+// rlimits maps the ulimit names, like in docker, to their resource.
+var rlimits = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// ipcSysctls are the sysctls living in the IPC namespace, with the fs.mqueue ones.
+var ipcSysctls = []string{
+	"kernel.msgmax",
+	"kernel.msgmnb",
+	"kernel.msgmni",
+	"kernel.sem",
+	"kernel.shm_rmid_forced",
+	"kernel.shmall",
+	"kernel.shmmax",
+	"kernel.shmmni",
+}
+
+// utsSysctls are the sysctls living in the UTS namespace, that is always private.
+// kernel.hostname is not here, as the hostname is set with --hostname.
+var utsSysctls = []string{
+	"kernel.domainname",
+}
+
+// Ulimit is a resource limit to set for a process.
+type Ulimit struct {
+	Resource int
+	Soft     uint64
+	Hard     uint64
+}
+
+// ParseUlimit will parse input ulimit, in the form of name=soft[:hard], where
+// name is one of the rlimits without the RLIMIT_ prefix, in lower case, and
+// values are numbers, or -1 and unlimited for no limit. Without hard limit,
+// it is the same as the soft one.
+func ParseUlimit(input string) (Ulimit, error) {
+	name, values, ok := strings.Cut(input, "=")
+	if !ok {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %s, must be name=soft[:hard]", input)
+	}
+
+	resource, ok := rlimits[name]
+	if !ok {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %s: unknown resource %s", input, name)
+	}
+
+	soft, hard, ok := strings.Cut(values, ":")
+	if !ok {
+		hard = soft
+	}
+
+	result := Ulimit{Resource: resource}
+
+	var err error
+
+	result.Soft, err = parseRlimitValue(soft)
+	if err != nil {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %s: %w", input, err)
+	}
+
+	result.Hard, err = parseRlimitValue(hard)
+	if err != nil {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %s: %w", input, err)
+	}
+
+	if result.Soft > result.Hard {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %s: soft limit is greater than hard limit", input)
+	}
+
+	return result, nil
+}
+
+// parseRlimitValue will parse a limit value, -1 and unlimited are no limit.
+func parseRlimitValue(input string) (uint64, error) {
+	if input == "unlimited" || input == "-1" {
+		return unix.RLIM_INFINITY, nil
+	}
+
+	return strconv.ParseUint(input, 10, 64)
+}
+
+// Apply will set the ulimit for the current process, and its future children.
+func (u Ulimit) Apply() error {
+	return unix.Setrlimit(u.Resource, &unix.Rlimit{Cur: u.Soft, Max: u.Hard})
+}
+
+// String returns the ulimit in the form of resource=soft:hard, with numeric
+// values, as accepted by the pty agent.
+func (u Ulimit) String() string {
+	return fmt.Sprintf("%d=%d:%d", u.Resource, u.Soft, u.Hard)
+}
+
+// ParseUmask will parse input octal umask, eg: 0022.
+func ParseUmask(input string) (int, error) {
+	umask, err := strconv.ParseUint(input, 8, 32)
+	if err != nil || umask > 0o777 {
+		return 0, fmt.Errorf("invalid umask %s, must be an octal number up to 0777", input)
+	}
+
+	return int(umask), nil
+}
+
+// ValidateOomScoreAdj returns an error if input OOM score adjustment is not
+// in the range accepted by the kernel.
+func ValidateOomScoreAdj(score int) error {
+	if score < -1000 || score > 1000 {
+		return fmt.Errorf("invalid oom score adjustment %d, must be between -1000 and 1000", score)
+	}
+
+	return nil
+}
+
+// SetOomScoreAdj will set the OOM score adjustment of the current process, that
+// is inherited by its children.
+func SetOomScoreAdj(score int) error {
+	return os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(score)), 0o644)
+}
+
+// ValidateSysctl returns an error if input sysctl is not namespaced, or its namespace
+// is not private following input ipc and network modes, as setting it would change
+// the host's value. Keys can be separated by dots or slashes.
+func ValidateSysctl(key, ipc, network string) error {
+	key = strings.ReplaceAll(key, "/", ".")
+
+	switch {
+	case slices.Contains(ipcSysctls, key) || strings.HasPrefix(key, "fs.mqueue."):
+		if ipc != constants.Private {
+			return fmt.Errorf("sysctl %s requires a private ipc namespace", key)
+		}
+	case strings.HasPrefix(key, "net."):
+		if network != constants.Private {
+			return fmt.Errorf("sysctl %s requires a private network namespace", key)
+		}
+	case slices.Contains(utsSysctls, key):
+	case key == "kernel.hostname":
+		return fmt.Errorf("sysctl %s is not supported, use --hostname instead", key)
+	default:
+		return fmt.Errorf("sysctl %s is not namespaced", key)
+	}
+
+	return nil
+}
+
+// SetSysctl will set input sysctl for the namespaces of the current process.
+func SetSysctl(key, value string) error {
+	key = strings.ReplaceAll(key, ".", "/")
+
+	return os.WriteFile(filepath.Join("/proc/sys", key), []byte(value), 0o644)
+}
+
+// ParseTimeOffsets will parse input time namespace offsets, in the form of
+// monotonic=SECONDS,boottime=SECONDS, seconds can be negative.
+func ParseTimeOffsets(input string) (map[string]int64, error) {
+	result := map[string]int64{}
+
+	for _, offset := range strings.Split(input, ",") {
+		clock, value, ok := strings.Cut(offset, "=")
+		if !ok || (clock != "monotonic" && clock != "boottime") {
+			return nil, fmt.Errorf("invalid time offset %s, must be monotonic=SECONDS or boottime=SECONDS", offset)
+		}
+
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time offset %s: %w", offset, err)
+		}
+
+		result[clock] = seconds
+	}
+
+	return result, nil
+}
+
+// TimeOffsetsKernel is the first kernel moving a process into the time namespace
+// it created at its next execve, older ones only move its children.
+const TimeOffsetsKernel = "5.18"
+
+// CheckTimeOffsets returns an error if the running kernel can't set time offsets
+// as SetTimeOffsets does.
+func CheckTimeOffsets() error {
+	if !KernelAtLeast(TimeOffsetsKernel) {
+		return fmt.Errorf("time offsets require linux %s or newer", TimeOffsetsKernel)
+	}
+
+	return nil
+}
+
+// SetTimeOffsets will create a new time namespace with input offsets, that the
+// current process enters at its next execve, as its children do.
+// This must be called from the main thread, the one the offsets are set for,
+// and the execve must happen from it. Older kernels don't move the process at
+// execve, so an error is returned on them, see CheckTimeOffsets.
+func SetTimeOffsets(offsets map[string]int64) error {
+	err := CheckTimeOffsets()
+	if err != nil {
+		return err
+	}
+
+	err = unix.Unshare(unix.CLONE_NEWTIME)
+	if err != nil {
+		return err
+	}
+
+	content := ""
+
+	for _, clock := range []string{"monotonic", "boottime"} {
+		seconds, ok := offsets[clock]
+		if ok {
+			content += fmt.Sprintf("%s %d 0\n", clock, seconds)
+		}
+	}
+
+	// offsets can only be written before any process enters the namespace
+	return os.WriteFile("/proc/self/timens_offsets", []byte(content), 0o644)
+}
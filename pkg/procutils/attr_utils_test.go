@@ -0,0 +1,150 @@
+package procutils
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/89luca89/lilipod/pkg/constants"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseUlimit(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Ulimit
+		wantErr bool
+	}{
+		{input: "nofile=1024:2048", want: Ulimit{Resource: unix.RLIMIT_NOFILE, Soft: 1024, Hard: 2048}},
+		{input: "nofile=1024", want: Ulimit{Resource: unix.RLIMIT_NOFILE, Soft: 1024, Hard: 1024}},
+		{input: "core=0", want: Ulimit{Resource: unix.RLIMIT_CORE}},
+		{
+			input: "memlock=-1",
+			want:  Ulimit{Resource: unix.RLIMIT_MEMLOCK, Soft: unix.RLIM_INFINITY, Hard: unix.RLIM_INFINITY},
+		},
+		{
+			input: "stack=8192:unlimited",
+			want:  Ulimit{Resource: unix.RLIMIT_STACK, Soft: 8192, Hard: unix.RLIM_INFINITY},
+		},
+		{input: "nofile", wantErr: true},
+		{input: "NOFILE=1024", wantErr: true},
+		{input: "files=1024", wantErr: true},
+		{input: "nofile=", wantErr: true},
+		{input: "nofile=x", wantErr: true},
+		{input: "nofile=-2", wantErr: true},
+		{input: "nofile=1024:", wantErr: true},
+		{input: "nofile=2048:1024", wantErr: true},
+		{input: "nofile=unlimited:1024", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := ParseUlimit(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseUlimit(%q) error = %v, wantErr %v", test.input, err, test.wantErr)
+			}
+
+			if !test.wantErr && got != test.want {
+				t.Errorf("ParseUlimit(%q) = %+v, want %+v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseUmask(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{input: "0022", want: 0o022},
+		{input: "077", want: 0o077},
+		{input: "0", want: 0},
+		{input: "0777", want: 0o777},
+		{input: "1000", wantErr: true},
+		{input: "0018", wantErr: true},
+		{input: "", wantErr: true},
+		{input: "-1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := ParseUmask(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseUmask(%q) error = %v, wantErr %v", test.input, err, test.wantErr)
+			}
+
+			if !test.wantErr && got != test.want {
+				t.Errorf("ParseUmask(%q) = %o, want %o", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateSysctl(t *testing.T) {
+	tests := []struct {
+		key     string
+		ipc     string
+		network string
+		wantErr bool
+	}{
+		{key: "kernel.shmmax", ipc: constants.Private},
+		{key: "kernel/msgmax", ipc: constants.Private},
+		{key: "fs.mqueue.msg_max", ipc: constants.Private},
+		{key: "kernel.shmmax", ipc: "host", wantErr: true},
+		{key: "fs.mqueue.msg_max", ipc: "host", wantErr: true},
+		{key: "net.ipv4.ip_forward", network: constants.Private},
+		{key: "net/ipv4/ping_group_range", network: constants.Private},
+		{key: "net.ipv4.ip_forward", network: "host", wantErr: true},
+		{key: "kernel.domainname", ipc: "host", network: "host"},
+		{key: "kernel.hostname", ipc: constants.Private, network: constants.Private, wantErr: true},
+		{key: "kernel.pid_max", ipc: constants.Private, network: constants.Private, wantErr: true},
+		{key: "vm.swappiness", ipc: constants.Private, network: constants.Private, wantErr: true},
+		{key: "fs.file-max", ipc: constants.Private, network: constants.Private, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key+"/"+test.ipc+"/"+test.network, func(t *testing.T) {
+			err := ValidateSysctl(test.key, test.ipc, test.network)
+			if (err != nil) != test.wantErr {
+				t.Errorf("ValidateSysctl(%q, %q, %q) error = %v, wantErr %v",
+					test.key, test.ipc, test.network, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTimeOffsets(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]int64
+		wantErr bool
+	}{
+		{input: "monotonic=3600", want: map[string]int64{"monotonic": 3600}},
+		{input: "boottime=-60", want: map[string]int64{"boottime": -60}},
+		{
+			input: "monotonic=10,boottime=20",
+			want:  map[string]int64{"monotonic": 10, "boottime": 20},
+		},
+		{input: "monotonic=1,monotonic=2", want: map[string]int64{"monotonic": 2}},
+		{input: "", wantErr: true},
+		{input: "monotonic", wantErr: true},
+		{input: "realtime=10", wantErr: true},
+		{input: "monotonic=", wantErr: true},
+		{input: "monotonic=1.5", wantErr: true},
+		{input: "monotonic=1s", wantErr: true},
+		{input: "monotonic=1,", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := ParseTimeOffsets(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseTimeOffsets(%q) error = %v, wantErr %v", test.input, err, test.wantErr)
+			}
+
+			if !test.wantErr && !maps.Equal(got, test.want) {
+				t.Errorf("ParseTimeOffsets(%q) = %v, want %v", test.input, got, test.want)
+			}
+		})
+	}
+}
@@ -2,21 +2,22 @@
 package procutils
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/logging"
+	"golang.org/x/sys/unix"
 )
 
 // EnsureFakeRoot will ensure process is executed with rootless-helper.
@@ -74,10 +75,16 @@ func EnsureFakeRoot(interactive bool) (bool, error) {
 	logging.LogDebug("executing %v", cmd.Args)
 
 	if interactive {
-		err := RunWithTTY(cmd)
+		err := RunWithTTY(cmd, nil)
 		if err != nil {
 			logging.LogDebug("error: %+v", err)
 
+			// the child already reported its errors, just propagate its exit code
+			code, _ := GetExitStatus(err)
+			if code > 0 {
+				return false, &ExitCodeError{Code: code}
+			}
+
 			return false, err
 		}
 
@@ -88,9 +95,10 @@ func EnsureFakeRoot(interactive bool) (bool, error) {
 		cmd.SysProcAttr = &syscall.SysProcAttr{}
 	}
 
-	// this is needed to completely detach a process
+	// this is needed to completely detach a process, that needs to outlive us
 	cmd.SysProcAttr.Foreground = false
 	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Pdeathsig = 0
 
 	logging.LogDebug("tty not specified, using cmd.Start")
 
@@ -116,78 +124,239 @@ func EnsureFakeRoot(interactive bool) (bool, error) {
 	return true, nil
 }
 
-// GetUIDGID will return a couple of uid/gid integers for input user.
+// User contains the resolved credentials of a user inside a container.
+type User struct {
+	Name   string
+	UID    int
+	GID    int
+	Groups []int
+	Home   string
+	Shell  string
+}
+
+// passwdEntry is a parsed line of an /etc/passwd or /etc/group file,
+// split by ':'.
+type passwdEntry []string
+
+// LookupUser will resolve input user against the /etc/passwd and /etc/group
+// files found in input rootfs, following docker semantics.
 // Input user can be in the form of username:group, or uid:gid or a mix of that.
-func GetUIDGID(username string) (int, int) {
-	logging.LogDebug("getting uid and gid for %s", username)
+// Usernames and groups that are not found are an error, while numeric IDs
+// are always accepted, as are root user and group. If no group is specified, the
+// user's primary group is used.
+// Supplementary groups are the groups listing the user as member, plus
+// input additional groups, either names or IDs.
+func LookupUser(rootfs, input string, groupAdd []string) (User, error) {
+	logging.LogDebug("looking up user %s in %s", input, rootfs)
+
+	username, groupname, hasGroup := strings.Cut(input, ":")
+	if username == "" {
+		username = "0"
+	}
+
+	passwd := readPasswdFile(filepath.Join(rootfs, "etc", "passwd"))
+	groups := readPasswdFile(filepath.Join(rootfs, "etc", "group"))
 
-	groupname := username
+	result := User{Home: "/"}
 
-	// check if we're in the format user:group or 1234:1234
-	if strings.Contains(username, ":") {
-		logging.LogDebug("splitting %s by ':'", username)
+	// passwd entries are in the form of name:password:UID:GID:GECOS:home:shell
+	uid, err := strconv.Atoi(username)
+	if err == nil {
+		result.UID = uid
 
-		split := strings.Split(username, ":")
-		username = split[0]
-		groupname = split[1]
+		for _, entry := range passwd {
+			if entry[2] == username {
+				result.Name = entry[0]
+				result.GID, _ = strconv.Atoi(entry[3])
+				result.Home = entry[5]
+				result.Shell = entry[6]
 
-		logging.LogDebug("username=%s groupname=%s", username, groupname)
+				break
+			}
+		}
+	} else {
+		found := false
+
+		for _, entry := range passwd {
+			if entry[0] == username {
+				result.Name = entry[0]
+				result.UID, _ = strconv.Atoi(entry[2])
+				result.GID, _ = strconv.Atoi(entry[3])
+				result.Home = entry[5]
+				result.Shell = entry[6]
+				found = true
+
+				break
+			}
+		}
+
+		// root is always uid 0, even in images without a passwd file
+		if !found && username == "root" {
+			result.Name = username
+			result.Home = "/root"
+			found = true
+		}
+
+		if !found {
+			return User{}, fmt.Errorf("unable to find user %s: no matching entries in passwd file", username)
+		}
 	}
 
-	logging.LogDebug("checking if input username is numeric")
-	// if we're passed numeric IDs, just convert and return
-	uid, err := strconv.ParseInt(username, 10, 32)
-	if err != nil {
-		uid = -1
+	if hasGroup && groupname != "" {
+		result.GID, err = lookupGroup(groups, groupname)
+		if err != nil {
+			return User{}, err
+		}
 	}
 
-	logging.LogDebug("checking if input groupname is numeric")
-	// if we're passed numeric IDs, just convert and return
-	gid, err := strconv.ParseInt(groupname, 10, 32)
-	if err != nil {
-		gid = -1
+	// group entries are in the form of name:password:GID:user1,user2
+	result.Groups = []int{result.GID}
+
+	if result.Name != "" {
+		for _, entry := range groups {
+			if len(entry) < 4 {
+				continue
+			}
+
+			for _, member := range strings.Split(entry[3], ",") {
+				if member == result.Name {
+					gid, err := strconv.Atoi(entry[2])
+					if err == nil {
+						result.Groups = append(result.Groups, gid)
+					}
+				}
+			}
+		}
 	}
 
-	// return converted IDs
-	if uid > 0 && gid > 0 {
-		logging.LogDebug("input username and groupname were numeric, returning %d %d", uid, gid)
+	for _, group := range groupAdd {
+		gid, err := lookupGroup(groups, group)
+		if err != nil {
+			return User{}, err
+		}
 
-		return int(uid), int(gid)
+		result.Groups = append(result.Groups, gid)
 	}
 
-	logging.LogDebug("input username and groupname were not numeric, looking up")
+	slices.Sort(result.Groups)
+	result.Groups = slices.Compact(result.Groups)
 
-	// if we're here it is because they were not numbers
-	// so we'll need to lookup them
-	user, err := user.Lookup(username)
-	if err != nil {
-		return 0, 0
+	logging.LogDebug("resolved user %s to %+v", input, result)
+
+	return result, nil
+}
+
+// Env returns input env with HOME and USER set for the user, if not
+// already specified.
+func (u User) Env(env []string) []string {
+	hasHome := false
+	hasUser := false
+
+	for _, variable := range env {
+		hasHome = hasHome || strings.HasPrefix(variable, "HOME=")
+		hasUser = hasUser || strings.HasPrefix(variable, "USER=")
 	}
 
-	logging.LogDebug("parsing looked up username uid and gid")
+	if !hasHome {
+		env = append(env, "HOME="+u.Home)
+	}
 
-	// if we're passed numeric IDs, just convert and return
-	uid, err = strconv.ParseInt(user.Uid, 10, 32)
-	if err != nil {
-		uid = -1
+	if !hasUser && u.Name != "" {
+		env = append(env, "USER="+u.Name)
 	}
 
-	gid, err = strconv.ParseInt(user.Gid, 10, 32)
-	if err != nil {
-		gid = -1
+	return env
+}
+
+// LookupHostUser returns the host user with input UID and GID, and the name of
+// its primary group.
+// Name, home and shell are resolved from the host's /etc/passwd, falling back
+// to the USER, HOME and SHELL environment variables. The group name falls back
+// to the user's name.
+func LookupHostUser(uid, gid int) (User, string) {
+	result := User{
+		Name:   os.Getenv("USER"),
+		UID:    uid,
+		GID:    gid,
+		Groups: []int{gid},
+		Home:   os.Getenv("HOME"),
+		Shell:  os.Getenv("SHELL"),
 	}
 
-	// return converted IDs
-	if uid > 0 && gid > 0 {
-		logging.LogDebug("uid and gid parsed successfully, returning %d %s", uid, gid)
+	for _, entry := range readPasswdFile("/etc/passwd") {
+		if entry[2] == strconv.Itoa(uid) {
+			result.Name = entry[0]
+			result.Home = entry[5]
+			result.Shell = entry[6]
 
-		return int(uid), int(gid)
+			break
+		}
+	}
+
+	group := result.Name
+
+	for _, entry := range readPasswdFile("/etc/group") {
+		if entry[2] == strconv.Itoa(gid) {
+			group = entry[0]
+
+			break
+		}
+	}
+
+	return result, group
+}
+
+// lookupGroup returns the GID of input group name or ID.
+func lookupGroup(groups []passwdEntry, group string) (int, error) {
+	gid, err := strconv.Atoi(group)
+	if err == nil {
+		return gid, nil
+	}
+
+	for _, entry := range groups {
+		if entry[0] == group {
+			return strconv.Atoi(entry[2])
+		}
+	}
+
+	if group == "root" {
+		return 0, nil
+	}
+
+	return -1, fmt.Errorf("unable to find group %s: no matching entries in group file", group)
+}
+
+// readPasswdFile will parse an /etc/passwd or /etc/group file, skipping
+// comments and malformed lines. A missing file results in no entries.
+func readPasswdFile(path string) []passwdEntry {
+	result := []passwdEntry{}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		logging.LogDebug("cannot read %s: %v", path, err)
+
+		return result
 	}
 
-	// default to root
-	logging.LogDebug("parsing looked up uid/gid failed, defaulting to root 0:0")
+	for _, line := range strings.Split(string(file), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry := strings.Split(line, ":")
+		// group files have 4 fields, passwd files have 7
+		if len(entry) < 3 {
+			continue
+		}
+
+		if filepath.Base(path) == "passwd" && len(entry) < 7 {
+			continue
+		}
+
+		result = append(result, entry)
+	}
 
-	return 0, 0
+	return result
 }
 
 // GetSubIDRanges will return a slice of subUIDs and subGIDs for
@@ -305,6 +474,80 @@ func SetProcessKeepIDMaps(cmd *exec.Cmd, uidMap, gidMap string) error {
 	return nil
 }
 
+// Real time signals, as seen by glibc programs, which reserve the first two.
+const (
+	sigRTMin = 34
+	sigRTMax = 64
+)
+
+// ParseSignal will parse input signal, either a number or a name, with or
+// without the SIG prefix, eg: 15, TERM, SIGTERM, SIGRTMIN+3, RTMAX-1.
+func ParseSignal(input string) (syscall.Signal, error) {
+	signum, err := strconv.Atoi(input)
+	if err == nil {
+		if signum < 1 || signum > sigRTMax {
+			return 0, fmt.Errorf("invalid signal %s", input)
+		}
+
+		return syscall.Signal(signum), nil
+	}
+
+	name := strings.ToUpper(input)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	base := 0
+	offset := "0"
+
+	if rest, ok := strings.CutPrefix(name, "SIGRTMIN"); ok {
+		base = sigRTMin
+		offset = rest
+	} else if rest, ok := strings.CutPrefix(name, "SIGRTMAX"); ok {
+		base = sigRTMax
+		offset = rest
+	}
+
+	if base == 0 {
+		signal := unix.SignalNum(name)
+		if signal == 0 {
+			return 0, fmt.Errorf("invalid signal %s", input)
+		}
+
+		return signal, nil
+	}
+
+	if offset == "" {
+		offset = "0"
+	}
+
+	delta, err := strconv.Atoi(offset)
+	if err != nil || base+delta < sigRTMin || base+delta > sigRTMax {
+		return 0, fmt.Errorf("invalid signal %s", input)
+	}
+
+	return syscall.Signal(base + delta), nil
+}
+
+// GetStartTime returns the start time of input pid, in clock ticks after boot,
+// as found in /proc/PID/stat.
+// Together with the pid, this identifies a process even if the pid is reused.
+func GetStartTime(pid int) (uint64, error) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// the process name can contain spaces and parenthesis, so skip it entirely,
+	// remaining fields start from the 3rd, and starttime is the 22nd.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid stat file for pid %d", pid)
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
 // IsPidRunning will return whether or not the input pid is actually alive
 // and not stopped or a zombie process.
 func IsPidRunning(pid int) bool {
@@ -324,150 +567,83 @@ func IsPidRunning(pid int) bool {
 }
 
 // RunWithTTY will run input cmd using main process' stdin/out/err.
-func RunWithTTY(cmd *exec.Cmd) error {
+func RunWithTTY(cmd *exec.Cmd, started func(pid int)) error {
 	logging.LogDebug("tty specified, just use cmd.Run")
 
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	return cmd.Run()
-}
-
-// RunInteractive will run input cmd using main process' stdin, but
-// pipe stdout/err to main.
-//
-// This usually is used in combination with the ptyAgent inside a container.
-func RunInteractive(cmd *exec.Cmd) error {
-	logging.LogDebug("interactive but no tty, setting up pipes")
-
-	cmd.Stdin = os.Stdin
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
-
-	err = cmd.Start()
+	err := cmd.Start()
 	if err != nil {
 		return err
 	}
 
-	// Non-blockingly echo command output to terminal
-	go func() { _, _ = io.Copy(os.Stdout, stdout) }()
-	go func() { _, _ = io.Copy(os.Stderr, stderr) }()
+	notifyStarted(cmd, started)
 
 	return cmd.Wait()
 }
 
-// RunDetached will run input cmd and redurect all outputs to logfile.
-// No stdin is set up.
-func RunDetached(cmd *exec.Cmd, logfile string) error {
-	logging.LogDebug("no interactive and no tty, setting up process log file")
+// ExitCodeError is returned when a process exits with a non-zero exit code,
+// that should be used as our own exit code.
+type ExitCodeError struct {
+	Code int
+}
 
-	// non interactive mode, save stdout and stderr to file and disown
-	cmd.SysProcAttr.Foreground = false
-	cmd.SysProcAttr.Setsid = true
+func (e *ExitCodeError) Error() string {
+	return "exit status " + strconv.Itoa(e.Code)
+}
 
-	// ensure we either create the file, or truncate the existing one
-	// so that we always start fresh
-	_, err := os.Create(logfile)
-	if err != nil {
-		logging.LogDebug("%v", err)
+// GetExitStatus returns the exit code and the killing signal, if any, of a
+// process from the error returned by cmd.Wait.
+// Processes killed by a signal have exit code 128+signal, like in shells,
+// errors not related to the exit of the process have exit code -1.
+func GetExitStatus(err error) (int, int) {
+	if err == nil {
+		return 0, 0
 	}
 
-	logging.LogDebug("no interactive and no tty, setting up process pipes")
-
-	outR, outW := io.Pipe()
-	errR, errW := io.Pipe()
-	cmd.Stdout = io.Writer(outW)
-	cmd.Stderr = io.Writer(errW)
-
-	stdinLines := make(chan string)
-	stderrLines := make(chan string)
-
-	var wg sync.WaitGroup
-
-	wg.Add(5)
-
-	go func() {
-		defer wg.Done()
-
-		for line := range stdinLines {
-			line := fmt.Sprintf("%d:out:%s", time.Now().Unix(), line)
-
-			err := logging.AppendStringToFile(logfile, line)
-			if err != nil {
-				logging.LogError("could not log output: %v", err)
-			}
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		defer close(
-			stdinLines,
-		) // close on exit: when the scanner has no more to read, or has encountered an error.
-
-		scanner := bufio.NewScanner(outR)
-
-		for scanner.Scan() {
-			stdinLines <- scanner.Text()
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-
-		for line := range stderrLines {
-			line := fmt.Sprintf("%d:err:%s", time.Now().Unix(), line)
-
-			err := logging.AppendStringToFile(logfile, line)
-			if err != nil {
-				logging.LogError("could not log output: %v", err)
-			}
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		defer close(
-			stderrLines,
-		) // close on exit: when the scanner has no more to read, or has encountered an error.
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return -1, 0
+	}
 
-		scanner := bufio.NewScanner(errR)
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return 128 + int(status.Signal()), int(status.Signal())
+	}
 
-		for scanner.Scan() {
-			stderrLines <- scanner.Text()
-		}
-	}()
+	return exitErr.ExitCode(), 0
+}
 
-	// keep an eye on the child process, and exit if dead
-	go func() {
-		defer wg.Done()
+// KernelAtLeast returns if the running kernel is at least input version, as major.minor.
+func KernelAtLeast(version string) bool {
+	var major, minor, currentMajor, currentMinor int
 
-		for {
-			time.Sleep(time.Second * 5)
+	_, err := fmt.Sscanf(version, "%d.%d", &major, &minor)
+	if err != nil {
+		return false
+	}
 
-			if !IsPidRunning(cmd.Process.Pid) {
-				os.Exit(0)
-			}
-		}
-	}()
+	uname := unix.Utsname{}
 
-	logging.LogDebug("no interactive and no tty, start process in background")
+	err = unix.Uname(&uname)
+	if err != nil {
+		return false
+	}
 
-	err = cmd.Start()
+	_, err = fmt.Sscanf(unix.ByteSliceToString(uname.Release[:]), "%d.%d", &currentMajor, &currentMinor)
 	if err != nil {
-		return err
+		return false
 	}
 
-	wg.Wait()
+	return currentMajor > major || (currentMajor == major && currentMinor >= minor)
+}
 
-	return cmd.Wait()
+// notifyStarted will call input started function, if any, with the pid of the
+// started cmd.
+func notifyStarted(cmd *exec.Cmd, started func(pid int)) {
+	if started != nil {
+		started(cmd.Process.Pid)
+	}
 }
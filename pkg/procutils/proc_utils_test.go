@@ -0,0 +1,88 @@
+package procutils
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{input: "15", want: syscall.SIGTERM},
+		{input: "64", want: syscall.Signal(64)},
+		{input: "TERM", want: syscall.SIGTERM},
+		{input: "SIGTERM", want: syscall.SIGTERM},
+		{input: "sigkill", want: syscall.SIGKILL},
+		{input: "hup", want: syscall.SIGHUP},
+		{input: "SIGRTMIN", want: syscall.Signal(34)},
+		{input: "SIGRTMIN+3", want: syscall.Signal(37)},
+		{input: "RTMAX-1", want: syscall.Signal(63)},
+		{input: "rtmax", want: syscall.Signal(64)},
+		{input: "0", wantErr: true},
+		{input: "65", wantErr: true},
+		{input: "-1", wantErr: true},
+		{input: "SIGFOO", wantErr: true},
+		{input: "", wantErr: true},
+		{input: "SIGRTMIN-1", wantErr: true},
+		{input: "SIGRTMAX+1", wantErr: true},
+		{input: "SIGRTMIN+x", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := ParseSignal(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseSignal(%q) error = %v, wantErr %v", test.input, err, test.wantErr)
+			}
+
+			if !test.wantErr && got != test.want {
+				t.Errorf("ParseSignal(%q) = %d, want %d", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKernelAtLeast(t *testing.T) {
+	uname := unix.Utsname{}
+
+	err := unix.Uname(&uname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var major, minor int
+
+	_, err = fmt.Sscanf(unix.ByteSliceToString(uname.Release[:]), "%d.%d", &major, &minor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{version: fmt.Sprintf("%d.%d", major, minor), want: true},
+		{version: fmt.Sprintf("%d.%d", major, minor+1), want: false},
+		{version: fmt.Sprintf("%d.%d", major+1, 0), want: false},
+		{version: fmt.Sprintf("%d.%d", major-1, minor+100), want: true},
+		{version: "0.0", want: true},
+		{version: "5", want: false},
+		{version: "", want: false},
+		{version: "five.eighteen", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			got := KernelAtLeast(test.version)
+			if got != test.want {
+				t.Errorf("KernelAtLeast(%q) = %t, want %t", test.version, got, test.want)
+			}
+		})
+	}
+}
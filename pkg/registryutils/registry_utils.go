@@ -0,0 +1,869 @@
+// Package registryutils contains helpers and utilities to serve the local
+// image store as an OCI registry.
+package registryutils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/89luca89/lilipod/pkg/fileutils"
+	"github.com/89luca89/lilipod/pkg/imageutils"
+	"github.com/89luca89/lilipod/pkg/logging"
+	"github.com/89luca89/lilipod/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// UploadDir is the location where pushed blobs are stored until their
+// manifest is pushed.
+var UploadDir = filepath.Join(utils.GetLilipodHome(), "uploads")
+
+// maxManifestSize is the maximum size accepted for a pushed manifest.
+const maxManifestSize = 4 * 1024 * 1024
+
+// pushedFile marks the images pushed to the registry, it contains the registry
+// name so that pushes only replace images pushed to the same registry.
+const pushedFile = "pushed_to"
+
+// Options contains the settings used to serve the registry.
+type Options struct {
+	// Address is the host:port to listen on.
+	Address string
+	// Credentials in the form of user:password, if empty no authentication is required.
+	Credentials string
+	// TLSCert and TLSKey are the paths to the certificate and key used to serve
+	// over https, if empty plain http is used.
+	TLSCert string
+	TLSKey  string
+	// Push enables pushing images into ImageDir.
+	Push bool
+	// Name is the registry host pushed images are named after, eg: laptop:5000,
+	// if empty Address is used, with localhost as host if it has none.
+	Name string
+	// Overwrite allows pushes to replace local images that were not pushed to
+	// this registry, like pulled ones.
+	Overwrite bool
+	// MaxUploadSize is the maximum size in bytes of a pushed blob, 0 means no limit.
+	MaxUploadSize int64
+}
+
+// registry implements the OCI distribution API on top of imageutils.ImageDir.
+type registry struct {
+	options Options
+	// mutex serializes writes to the image store and uploads
+	mutex sync.Mutex
+}
+
+// localImage is an image found in the local stores.
+type localImage struct {
+	path     string
+	tag      string
+	manifest []byte
+	digest   string
+}
+
+// routeRegex matches /v2/<name>/<manifests|blobs|tags>/<rest>, name can
+// contain slashes, so the last match wins.
+var routeRegex = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags)/(.*)$`)
+
+// Serve will serve the local image stores as an OCI registry using the input
+// options. This function blocks until the server fails.
+//
+// Images are served read-only, both from ImageDir and the additional image stores,
+// unless options.Push is set, in which case pushed images are saved in ImageDir
+// named after options.Name, eg: laptop:5000/alpine:latest.
+func Serve(options Options) error {
+	handler, err := newRegistry(options)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	// uploads are never resumed across runs, start clean
+	_ = os.RemoveAll(UploadDir)
+
+	if options.Push {
+		err := os.MkdirAll(filepath.Join(UploadDir, "blobs"), 0o750)
+		if err != nil {
+			logging.LogError("%+v", err)
+
+			return err
+		}
+
+		defer func() { _ = os.RemoveAll(UploadDir) }()
+	}
+
+	server := &http.Server{
+		Addr:              options.Address,
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	if options.TLSCert != "" {
+		logging.Log("serving registry on https://%s", options.Address)
+
+		return server.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+	}
+
+	logging.Log("serving registry on http://%s", options.Address)
+
+	return server.ListenAndServe()
+}
+
+// newRegistry returns a registry serving with input options, after validating
+// them and filling the default name.
+func newRegistry(options Options) (*registry, error) {
+	if (options.TLSCert == "") != (options.TLSKey == "") {
+		return nil, errors.New("both a tls certificate and key are needed to serve over https")
+	}
+
+	if options.Credentials != "" && !strings.Contains(options.Credentials, ":") {
+		return nil, errors.New("credentials must be in the form of user:password")
+	}
+
+	if options.MaxUploadSize < 0 {
+		return nil, errors.New("the maximum upload size cannot be negative")
+	}
+
+	if options.Name == "" {
+		host, port, err := net.SplitHostPort(options.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", options.Address, err)
+		}
+
+		// listening on all the addresses, there's no host to name images after
+		if host == "" || net.ParseIP(host).IsUnspecified() {
+			host = "localhost"
+		}
+
+		options.Name = net.JoinHostPort(host, port)
+	}
+
+	// the name must be the registry of the images named after it, eg: laptop
+	// alone would be a docker hub repository
+	ref, err := name.ParseReference(options.Name + "/image")
+	if err != nil || ref.Context().RegistryStr() != options.Name {
+		return nil, fmt.Errorf("invalid registry name %s, use host:port or a domain name", options.Name)
+	}
+
+	return &registry{options: options}, nil
+}
+
+// ServeHTTP will authenticate and route requests to the right handler.
+func (r *registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	logging.LogDebug("%s %s", request.Method, request.URL.Path)
+
+	writer.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if !r.authenticate(request) {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="lilipod"`)
+		writeError(writer, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+
+		return
+	}
+
+	path := request.URL.Path
+
+	switch {
+	case path == "/v2/" || path == "/v2":
+		writer.Header().Set("Content-Type", "application/json")
+		_, _ = writer.Write([]byte("{}"))
+	case path == "/v2/_catalog":
+		r.handleCatalog(writer, request)
+	case routeRegex.MatchString(path):
+		match := routeRegex.FindStringSubmatch(path)
+
+		switch match[2] {
+		case "manifests":
+			r.handleManifest(writer, request, match[1], match[3])
+		case "blobs":
+			if strings.HasPrefix(match[3], "uploads") {
+				r.handleUpload(writer, request, match[1], strings.Trim(strings.TrimPrefix(match[3], "uploads"), "/"))
+			} else {
+				r.handleBlob(writer, request, match[1], match[3])
+			}
+		case "tags":
+			r.handleTags(writer, request, match[1])
+		}
+	default:
+		writeError(writer, http.StatusNotFound, "NAME_UNKNOWN", "unknown path "+path)
+	}
+}
+
+// authenticate returns whether the request has valid basic auth credentials,
+// or if no credentials are configured.
+func (r *registry) authenticate(request *http.Request) bool {
+	if r.options.Credentials == "" {
+		return true
+	}
+
+	user, password, ok := request.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(r.options.Credentials)) == 1
+}
+
+// handleCatalog will list all the repositories available.
+func (r *registry) handleCatalog(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writeError(writer, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+
+		return
+	}
+
+	found := map[string]bool{}
+	repositories := []string{}
+
+	for _, imagePath := range imageutils.List() {
+		ref, err := getImageReference(imagePath)
+		if err != nil {
+			continue
+		}
+
+		repository := ref.Context().RepositoryStr()
+		if !found[repository] {
+			found[repository] = true
+
+			repositories = append(repositories, repository)
+		}
+	}
+
+	sort.Strings(repositories)
+
+	writeJSON(writer, map[string][]string{"repositories": repositories})
+}
+
+// handleTags will list all the tags available for input repository.
+func (r *registry) handleTags(writer http.ResponseWriter, request *http.Request, repository string) {
+	if request.Method != http.MethodGet {
+		writeError(writer, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+
+		return
+	}
+
+	images := findImages(repository)
+	if len(images) == 0 {
+		writeError(writer, http.StatusNotFound, "NAME_UNKNOWN", "repository "+repository+" not found")
+
+		return
+	}
+
+	tags := []string{}
+
+	for _, image := range images {
+		if image.tag != "" {
+			tags = append(tags, image.tag)
+		}
+	}
+
+	sort.Strings(tags)
+
+	writeJSON(writer, map[string]any{"name": repository, "tags": tags})
+}
+
+// handleManifest will serve, or save if push is enabled, the manifest for
+// input repository and reference, reference can be either a tag or a digest.
+func (r *registry) handleManifest(
+	writer http.ResponseWriter,
+	request *http.Request,
+	repository, reference string,
+) {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		for _, image := range findImages(repository) {
+			if image.tag != reference && image.digest != reference {
+				continue
+			}
+
+			var manifest v1.Manifest
+
+			_ = json.Unmarshal(image.manifest, &manifest)
+
+			mediaType := manifest.MediaType
+			if mediaType == "" {
+				mediaType = types.OCIManifestSchema1
+			}
+
+			writer.Header().Set("Content-Type", string(mediaType))
+			writer.Header().Set("Content-Length", strconv.Itoa(len(image.manifest)))
+			writer.Header().Set("Docker-Content-Digest", image.digest)
+
+			if request.Method == http.MethodGet {
+				_, _ = writer.Write(image.manifest)
+			}
+
+			return
+		}
+
+		writeError(writer, http.StatusNotFound, "MANIFEST_UNKNOWN",
+			"manifest "+repository+":"+reference+" not found")
+	case http.MethodPut:
+		if !r.options.Push {
+			writeError(writer, http.StatusMethodNotAllowed, "UNSUPPORTED", "registry is read-only")
+
+			return
+		}
+
+		r.putManifest(writer, request, repository, reference)
+	default:
+		writeError(writer, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+	}
+}
+
+// putManifest will save a pushed image in ImageDir, using the blobs already
+// uploaded or already present in the repository.
+func (r *registry) putManifest(
+	writer http.ResponseWriter,
+	request *http.Request,
+	repository, reference string,
+) {
+	rawManifest, err := io.ReadAll(io.LimitReader(request.Body, maxManifestSize))
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+
+		return
+	}
+
+	var manifest v1.Manifest
+
+	err = json.Unmarshal(rawManifest, &manifest)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+
+		return
+	}
+
+	if manifest.MediaType == "" {
+		manifest.MediaType = types.MediaType(request.Header.Get("Content-Type"))
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(rawManifest))
+
+	// manifests pushed by digest must match it
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		writeError(writer, http.StatusBadRequest, "DIGEST_INVALID", "manifest does not match digest "+reference)
+
+		return
+	}
+
+	if manifest.MediaType != types.OCIManifestSchema1 && manifest.MediaType != types.DockerManifestSchema2 {
+		writeError(writer, http.StatusBadRequest, "MANIFEST_INVALID",
+			"unsupported manifest type "+string(manifest.MediaType))
+
+		return
+	}
+
+	// name the image after the registry, never after the request, so that
+	// clients can't choose which local image to replace
+	imageName := r.options.Name + "/" + repository + ":" + reference
+	if strings.HasPrefix(reference, "sha256:") {
+		imageName = r.options.Name + "/" + repository + "@" + reference
+	}
+
+	_, err = name.ParseReference(imageName)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "NAME_INVALID", err.Error())
+
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id := imageutils.GetID(imageName)
+	targetDIR := filepath.Join(imageutils.ImageDir, id)
+
+	if !r.options.Overwrite && fileutils.Exist(targetDIR) {
+		pushedTo, err := fileutils.ReadFile(filepath.Join(targetDIR, pushedFile))
+		if err != nil || string(pushedTo) != r.options.Name {
+			writeError(writer, http.StatusForbidden, "DENIED",
+				"image "+imageName+" exists and was not pushed to this registry")
+
+			return
+		}
+	}
+
+	// assemble the image in the upload dir first, so that we do not leave
+	// broken images behind, then move it in place
+	tmpdir := filepath.Join(UploadDir, "images", id)
+
+	_ = os.RemoveAll(tmpdir)
+
+	err = os.MkdirAll(tmpdir, 0o755)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	defer func() { _ = os.RemoveAll(tmpdir) }()
+
+	files := map[string]v1.Hash{"config.json": manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		files[imageutils.GetLayerFileName(layer)] = layer.Digest
+	}
+
+	for file, digest := range files {
+		blob := r.findBlob(repository, digest.String())
+		if blob == "" {
+			writeError(writer, http.StatusBadRequest, "BLOB_UNKNOWN", "blob "+digest.String()+" not found")
+
+			return
+		}
+
+		err = linkFile(blob, filepath.Join(tmpdir, file))
+		if err != nil {
+			writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+			return
+		}
+	}
+
+	err = fileutils.WriteFile(filepath.Join(tmpdir, "manifest.json"), rawManifest, 0o644)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	err = fileutils.WriteFile(filepath.Join(tmpdir, "image_name"), []byte(imageName), 0o644)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	err = fileutils.WriteFile(filepath.Join(tmpdir, pushedFile), []byte(r.options.Name), 0o644)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	_ = os.RemoveAll(targetDIR)
+	_ = os.MkdirAll(imageutils.ImageDir, 0o755)
+
+	err = os.Rename(tmpdir, targetDIR)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	logging.Log("saved pushed image %s", imageName)
+
+	writer.Header().Set("Location", "/v2/"+repository+"/manifests/"+digest)
+	writer.Header().Set("Docker-Content-Digest", digest)
+	writer.WriteHeader(http.StatusCreated)
+}
+
+// handleBlob will serve input blob from the images in input repository.
+func (r *registry) handleBlob(
+	writer http.ResponseWriter,
+	request *http.Request,
+	repository, digest string,
+) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writeError(writer, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+
+		return
+	}
+
+	blob := r.findBlob(repository, digest)
+	if blob == "" {
+		writeError(writer, http.StatusNotFound, "BLOB_UNKNOWN", "blob "+digest+" not found")
+
+		return
+	}
+
+	file, err := os.Open(blob)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Docker-Content-Digest", digest)
+
+	http.ServeContent(writer, request, "", info.ModTime(), file)
+}
+
+// handleUpload will manage blob uploads, both monolithic and chunked,
+// and cross-repository mounts.
+func (r *registry) handleUpload(
+	writer http.ResponseWriter,
+	request *http.Request,
+	repository, uuid string,
+) {
+	if !r.options.Push {
+		writeError(writer, http.StatusMethodNotAllowed, "UNSUPPORTED", "registry is read-only")
+
+		return
+	}
+
+	query := request.URL.Query()
+
+	switch {
+	case request.Method == http.MethodPost && uuid == "":
+		// cross-repository mount, if we have the blob just link it
+		if query.Get("mount") != "" {
+			blob := r.findBlob(query.Get("from"), query.Get("mount"))
+			if blob != "" && validDigest(query.Get("mount")) {
+				err := linkFile(blob, filepath.Join(UploadDir, "blobs", query.Get("mount")))
+				if err == nil {
+					blobCreated(writer, repository, query.Get("mount"))
+
+					return
+				}
+			}
+		}
+
+		uuid = newUUID()
+
+		file, err := os.Create(filepath.Join(UploadDir, uuid))
+		if err != nil {
+			writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+			return
+		}
+
+		_ = file.Close()
+
+		// monolithic upload
+		if query.Get("digest") != "" {
+			r.appendUpload(writer, request, repository, uuid, true)
+
+			return
+		}
+
+		uploadAccepted(writer, repository, uuid, 0)
+	case !fileutils.Exist(filepath.Join(UploadDir, filepath.Base(uuid))):
+		writeError(writer, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload "+uuid+" not found")
+	case request.Method == http.MethodGet:
+		info, err := os.Stat(filepath.Join(UploadDir, filepath.Base(uuid)))
+		if err != nil {
+			writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+			return
+		}
+
+		writer.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+uuid)
+		writer.Header().Set("Range", fmt.Sprintf("0-%d", max(info.Size()-1, 0)))
+		writer.Header().Set("Docker-Upload-UUID", uuid)
+		writer.WriteHeader(http.StatusNoContent)
+	case request.Method == http.MethodPatch:
+		r.appendUpload(writer, request, repository, filepath.Base(uuid), false)
+	case request.Method == http.MethodPut:
+		r.appendUpload(writer, request, repository, filepath.Base(uuid), true)
+	case request.Method == http.MethodDelete:
+		_ = os.Remove(filepath.Join(UploadDir, filepath.Base(uuid)))
+
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(writer, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+	}
+}
+
+// appendUpload will append the request body to input upload, if finalize
+// is specified the upload is verified against the digest query parameter and
+// moved to the uploaded blobs.
+func (r *registry) appendUpload(
+	writer http.ResponseWriter,
+	request *http.Request,
+	repository, uuid string,
+	finalize bool,
+) {
+	uploadPath := filepath.Join(UploadDir, uuid)
+
+	file, err := os.OpenFile(uploadPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	body := request.Body
+	if r.options.MaxUploadSize > 0 {
+		body = http.MaxBytesReader(writer, request.Body, r.options.MaxUploadSize-info.Size())
+	}
+
+	written, err := io.Copy(file, body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			_ = os.Remove(uploadPath)
+
+			writeError(writer, http.StatusRequestEntityTooLarge, "SIZE_INVALID",
+				fmt.Sprintf("upload exceeds the maximum size of %d bytes", r.options.MaxUploadSize))
+
+			return
+		}
+
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	if !finalize {
+		uploadAccepted(writer, repository, uuid, info.Size()+written)
+
+		return
+	}
+
+	digest := request.URL.Query().Get("digest")
+	if !validDigest(digest) || !fileutils.CheckFileDigest(uploadPath, digest) {
+		_ = os.Remove(uploadPath)
+
+		writeError(writer, http.StatusBadRequest, "DIGEST_INVALID", "upload does not match digest "+digest)
+
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err = os.Rename(uploadPath, filepath.Join(UploadDir, "blobs", digest))
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	blobCreated(writer, repository, digest)
+}
+
+// ----------------------------------------------------------------------------
+
+// getImageReference returns the parsed name of the image in input path.
+func getImageReference(imagePath string) (name.Reference, error) {
+	imageName, err := fileutils.ReadFile(filepath.Join(imagePath, "image_name"))
+	if err != nil {
+		return nil, err
+	}
+
+	return name.ParseReference(strings.TrimSpace(string(imageName)))
+}
+
+// findImages returns all the local images matching input repository.
+// Images from Docker Hub are also matched without the library/ prefix and
+// all images are matched with their registry as part of the repository,
+// eg: alpine, library/alpine and index.docker.io/library/alpine all match.
+func findImages(repository string) []localImage {
+	result := []localImage{}
+
+	for _, imagePath := range imageutils.List() {
+		ref, err := getImageReference(imagePath)
+		if err != nil {
+			continue
+		}
+
+		imageRepository := ref.Context().RepositoryStr()
+
+		if repository != imageRepository &&
+			repository != strings.TrimPrefix(imageRepository, "library/") &&
+			repository != ref.Context().Name() {
+			continue
+		}
+
+		manifest, err := fileutils.ReadFile(filepath.Join(imagePath, "manifest.json"))
+		if err != nil {
+			continue
+		}
+
+		image := localImage{
+			path:     imagePath,
+			manifest: manifest,
+			digest:   fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)),
+		}
+
+		if tag, ok := ref.(name.Tag); ok {
+			image.tag = tag.TagStr()
+		}
+
+		result = append(result, image)
+	}
+
+	return result
+}
+
+// findBlob returns the path of the blob with input digest, searching the
+// images in input repository, then the uploaded blobs if push is enabled.
+// An empty string is returned if the blob is not found.
+func (r *registry) findBlob(repository, digest string) string {
+	if !validDigest(digest) {
+		return ""
+	}
+
+	for _, image := range findImages(repository) {
+		var manifest v1.Manifest
+
+		err := json.Unmarshal(image.manifest, &manifest)
+		if err != nil {
+			continue
+		}
+
+		if manifest.Config.Digest.String() == digest {
+			return filepath.Join(image.path, "config.json")
+		}
+
+		for _, layer := range manifest.Layers {
+			if layer.Digest.String() != digest {
+				continue
+			}
+
+			layerFile := filepath.Join(image.path, imageutils.GetLayerFileName(layer))
+			if !fileutils.Exist(layerFile) {
+				layerFile = filepath.Join(image.path, layer.Digest.Hex+".tar.gz")
+			}
+
+			if fileutils.Exist(layerFile) {
+				return layerFile
+			}
+		}
+	}
+
+	if !r.options.Push {
+		return ""
+	}
+
+	return findUploadedBlob(digest)
+}
+
+// findUploadedBlob returns the path of the uploaded blob with input digest,
+// or an empty string if not found.
+func findUploadedBlob(digest string) string {
+	if !validDigest(digest) {
+		return ""
+	}
+
+	blob := filepath.Join(UploadDir, "blobs", digest)
+	if fileutils.Exist(blob) {
+		return blob
+	}
+
+	return ""
+}
+
+// linkFile will hardlink src to dest, falling back to a copy if
+// they're not on the same filesystem.
+func linkFile(src, dest string) error {
+	_ = os.Remove(dest)
+
+	err := os.Link(src, dest)
+	if err == nil {
+		return nil
+	}
+
+	logging.LogDebug("cannot link %s, copying: %v", src, err)
+
+	input, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = input.Close() }()
+
+	output, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = output.Close() }()
+
+	_, err = io.Copy(output, input)
+
+	return err
+}
+
+// validDigest returns whether input is a well formed sha256 digest, this
+// ensures digests can be safely used as file names.
+func validDigest(digest string) bool {
+	hash, err := v1.NewHash(digest)
+
+	return err == nil && hash.Algorithm == "sha256"
+}
+
+// newUUID returns a random identifier for uploads.
+func newUUID() string {
+	buf := make([]byte, 16)
+
+	_, _ = rand.Read(buf)
+
+	return fmt.Sprintf("%x", buf)
+}
+
+func uploadAccepted(writer http.ResponseWriter, repository, uuid string, size int64) {
+	writer.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+uuid)
+	writer.Header().Set("Range", fmt.Sprintf("0-%d", max(size-1, 0)))
+	writer.Header().Set("Docker-Upload-UUID", uuid)
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+func blobCreated(writer http.ResponseWriter, repository, digest string) {
+	writer.Header().Set("Location", "/v2/"+repository+"/blobs/"+digest)
+	writer.Header().Set("Docker-Content-Digest", digest)
+	writer.WriteHeader(http.StatusCreated)
+}
+
+func writeJSON(writer http.ResponseWriter, content any) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "UNKNOWN", err.Error())
+
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	_, _ = writer.Write(data)
+}
+
+// writeError will write an error response as described by the OCI distribution spec.
+func writeError(writer http.ResponseWriter, status int, code, message string) {
+	logging.LogDebug("registry error %d %s: %s", status, code, message)
+
+	data, _ := json.Marshal(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_, _ = writer.Write(data)
+}
@@ -0,0 +1,543 @@
+package registryutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/89luca89/lilipod/pkg/imageutils"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// testImage is an image made of a config and a single layer.
+type testImage struct {
+	config   []byte
+	layer    []byte
+	manifest []byte
+}
+
+func newTestImage(t *testing.T, content string) testImage {
+	t.Helper()
+
+	image := testImage{
+		config: []byte(`{"architecture": "amd64", "os": "linux", "comment": "` + content + `"}`),
+		layer:  []byte("layer of " + content),
+	}
+
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: types.OCIConfigJSON,
+			Size:      int64(len(image.config)),
+			Digest:    hash(image.config),
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: types.OCILayer,
+			Size:      int64(len(image.layer)),
+			Digest:    hash(image.layer),
+		}},
+	}
+
+	var err error
+
+	image.manifest, err = json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return image
+}
+
+func hash(content []byte) v1.Hash {
+	return v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", sha256.Sum256(content))}
+}
+
+// save will save input image in ImageDir with input name, like a pull does.
+func (image testImage) save(t *testing.T, imageName string) string {
+	t.Helper()
+
+	path := filepath.Join(imageutils.ImageDir, imageutils.GetID(imageName))
+
+	files := map[string][]byte{
+		"image_name":                      []byte(imageName),
+		"manifest.json":                   image.manifest,
+		"config.json":                     image.config,
+		hash(image.layer).Hex + ".tar.gz": image.layer,
+	}
+
+	err := os.MkdirAll(path, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, content := range files {
+		err = os.WriteFile(filepath.Join(path, file), content, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+// newTestServer returns a registry server using input options, on empty image
+// and upload dirs.
+func newTestServer(t *testing.T, options Options) *httptest.Server {
+	t.Helper()
+
+	imageDir, uploadDir, additionalStores := imageutils.ImageDir, UploadDir, imageutils.AdditionalImageStores
+
+	t.Cleanup(func() {
+		imageutils.ImageDir, UploadDir, imageutils.AdditionalImageStores = imageDir, uploadDir, additionalStores
+	})
+
+	imageutils.ImageDir = filepath.Join(t.TempDir(), "images")
+	UploadDir = filepath.Join(t.TempDir(), "uploads")
+	imageutils.AdditionalImageStores = nil
+
+	err := os.MkdirAll(filepath.Join(UploadDir, "blobs"), 0o750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.Address == "" {
+		options.Address = "127.0.0.1:5000"
+	}
+
+	handler, err := newRegistry(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// do will perform a request on input server and return the response and its body.
+func do(t *testing.T, server *httptest.Server, method, path string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+
+	request, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(path, "/manifests/") {
+		request.Header.Set("Content-Type", string(types.OCIManifestSchema1))
+	}
+
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = response.Body.Close() }()
+
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response, content
+}
+
+// expect will fail the test if input response doesn't have input status.
+func expect(t *testing.T, response *http.Response, body []byte, status int) {
+	t.Helper()
+
+	if response.StatusCode != status {
+		t.Fatalf("%s %s = %d %s, want %d",
+			response.Request.Method, response.Request.URL.Path, response.StatusCode, body, status)
+	}
+}
+
+// pushBlob will push input blob in a single request.
+func pushBlob(t *testing.T, server *httptest.Server, repository string, blob []byte) {
+	t.Helper()
+
+	response, body := do(t, server, http.MethodPost,
+		"/v2/"+repository+"/blobs/uploads/?digest="+hash(blob).String(), blob)
+	expect(t, response, body, http.StatusCreated)
+}
+
+// push will push input image as repository:tag.
+func push(t *testing.T, server *httptest.Server, image testImage, repository, tag string) (*http.Response, []byte) {
+	t.Helper()
+
+	pushBlob(t, server, repository, image.config)
+	pushBlob(t, server, repository, image.layer)
+
+	return do(t, server, http.MethodPut, "/v2/"+repository+"/manifests/"+tag, image.manifest)
+}
+
+func TestRegistryPull(t *testing.T) {
+	server := newTestServer(t, Options{})
+	image := newTestImage(t, "alpine")
+	image.save(t, "docker.io/library/alpine:latest")
+
+	response, body := do(t, server, http.MethodGet, "/v2/", nil)
+	expect(t, response, body, http.StatusOK)
+
+	for _, repository := range []string{"alpine", "library/alpine", "index.docker.io/library/alpine"} {
+		for _, reference := range []string{"latest", hash(image.manifest).String()} {
+			response, body = do(t, server, http.MethodGet, "/v2/"+repository+"/manifests/"+reference, nil)
+			expect(t, response, body, http.StatusOK)
+
+			if !bytes.Equal(body, image.manifest) {
+				t.Errorf("manifest %s:%s = %s, want %s", repository, reference, body, image.manifest)
+			}
+
+			if response.Header.Get("Docker-Content-Digest") != hash(image.manifest).String() {
+				t.Errorf("manifest %s:%s digest = %s, want %s", repository, reference,
+					response.Header.Get("Docker-Content-Digest"), hash(image.manifest))
+			}
+		}
+	}
+
+	for _, blob := range [][]byte{image.config, image.layer} {
+		response, body = do(t, server, http.MethodGet, "/v2/alpine/blobs/"+hash(blob).String(), nil)
+		expect(t, response, body, http.StatusOK)
+
+		if !bytes.Equal(body, blob) {
+			t.Errorf("blob %s = %s, want %s", hash(blob), body, blob)
+		}
+	}
+
+	response, body = do(t, server, http.MethodGet, "/v2/alpine/tags/list", nil)
+	expect(t, response, body, http.StatusOK)
+
+	if string(body) != `{"name":"alpine","tags":["latest"]}` {
+		t.Errorf("tags = %s", body)
+	}
+
+	response, body = do(t, server, http.MethodGet, "/v2/_catalog", nil)
+	expect(t, response, body, http.StatusOK)
+
+	if string(body) != `{"repositories":["library/alpine"]}` {
+		t.Errorf("catalog = %s", body)
+	}
+
+	notFound := []string{
+		"/v2/alpine/manifests/edge",
+		"/v2/debian/manifests/latest",
+		"/v2/alpine/blobs/" + hash([]byte("missing")).String(),
+		"/v2/alpine/blobs/sha256:..%2f..%2fimage_name",
+		"/v2/debian/tags/list",
+		"/v3/",
+	}
+
+	for _, path := range notFound {
+		response, body = do(t, server, http.MethodGet, path, nil)
+		expect(t, response, body, http.StatusNotFound)
+	}
+}
+
+func TestRegistryReadOnly(t *testing.T) {
+	server := newTestServer(t, Options{})
+	image := newTestImage(t, "alpine")
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{method: http.MethodPost, path: "/v2/alpine/blobs/uploads/"},
+		{method: http.MethodPost, path: "/v2/alpine/blobs/uploads/?digest=" + hash(image.layer).String()},
+		{method: http.MethodPatch, path: "/v2/alpine/blobs/uploads/0123"},
+		{method: http.MethodPut, path: "/v2/alpine/manifests/latest"},
+		{method: http.MethodDelete, path: "/v2/alpine/manifests/latest"},
+	}
+
+	for _, request := range requests {
+		response, body := do(t, server, request.method, request.path, image.layer)
+		expect(t, response, body, http.StatusMethodNotAllowed)
+	}
+
+	entries, err := os.ReadDir(UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("uploads = %v, want only the blobs dir", entries)
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	server := newTestServer(t, Options{Credentials: "user:secret"})
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		noAuth   bool
+		want     int
+	}{
+		{name: "no credentials", noAuth: true, want: http.StatusUnauthorized},
+		{name: "wrong password", user: "user", password: "wrong", want: http.StatusUnauthorized},
+		{name: "wrong user", user: "root", password: "secret", want: http.StatusUnauthorized},
+		{name: "partial password", user: "user", password: "secre", want: http.StatusUnauthorized},
+		{name: "valid", user: "user", password: "secret", want: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, server.URL+"/v2/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.noAuth {
+				request.SetBasicAuth(test.user, test.password)
+			}
+
+			response, err := server.Client().Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = response.Body.Close()
+
+			if response.StatusCode != test.want {
+				t.Errorf("status = %d, want %d", response.StatusCode, test.want)
+			}
+
+			if test.want == http.StatusUnauthorized && response.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestRegistryPush(t *testing.T) {
+	server := newTestServer(t, Options{Push: true, Address: ":5000"})
+	image := newTestImage(t, "app")
+
+	// chunked upload of the layer
+	response, body := do(t, server, http.MethodPost, "/v2/test/app/blobs/uploads/", nil)
+	expect(t, response, body, http.StatusAccepted)
+
+	location := response.Header.Get("Location")
+
+	response, body = do(t, server, http.MethodPatch, location, image.layer[:5])
+	expect(t, response, body, http.StatusAccepted)
+
+	if response.Header.Get("Range") != "0-4" {
+		t.Errorf("range = %s, want 0-4", response.Header.Get("Range"))
+	}
+
+	response, body = do(t, server, http.MethodPut, location+"?digest="+hash(image.layer).String(), image.layer[5:])
+	expect(t, response, body, http.StatusCreated)
+
+	// monolithic upload of the config
+	pushBlob(t, server, "test/app", image.config)
+
+	// the image is named after the registry, whatever the request host is
+	request, err := http.NewRequest(http.MethodPut, server.URL+"/v2/test/app/manifests/v1",
+		bytes.NewReader(image.manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request.Host = "docker.io"
+	request.Header.Set("Content-Type", string(types.OCIManifestSchema1))
+
+	response, err = server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("push manifest = %d, want %d", response.StatusCode, http.StatusCreated)
+	}
+
+	if response.Header.Get("Docker-Content-Digest") != hash(image.manifest).String() {
+		t.Errorf("manifest digest = %s, want %s", response.Header.Get("Docker-Content-Digest"), hash(image.manifest))
+	}
+
+	path := filepath.Join(imageutils.ImageDir, imageutils.GetID("localhost:5000/test/app:v1"))
+
+	for file, want := range map[string][]byte{
+		"image_name":                      []byte("localhost:5000/test/app:v1"),
+		"manifest.json":                   image.manifest,
+		"config.json":                     image.config,
+		hash(image.layer).Hex + ".tar.gz": image.layer,
+	} {
+		got, err := os.ReadFile(filepath.Join(path, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s = %s, want %s", file, got, want)
+		}
+	}
+
+	// pushed images are served, and can be pushed again
+	response, body = do(t, server, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+	expect(t, response, body, http.StatusOK)
+
+	response, body = push(t, server, image, "test/app", "v1")
+	expect(t, response, body, http.StatusCreated)
+
+	// by digest too, but only if it matches
+	response, body = do(t, server, http.MethodPut, "/v2/test/app/manifests/"+hash(image.manifest).String(),
+		image.manifest)
+	expect(t, response, body, http.StatusCreated)
+
+	response, body = do(t, server, http.MethodPut, "/v2/test/app/manifests/"+hash(image.layer).String(),
+		image.manifest)
+	expect(t, response, body, http.StatusBadRequest)
+
+	// manifests referencing missing blobs are refused
+	response, body = do(t, server, http.MethodPut, "/v2/other/manifests/v1", newTestImage(t, "other").manifest)
+	expect(t, response, body, http.StatusBadRequest)
+}
+
+func TestRegistryPushBadDigest(t *testing.T) {
+	server := newTestServer(t, Options{Push: true})
+	image := newTestImage(t, "app")
+
+	for _, digest := range []string{hash(image.config).String(), "sha256:invalid", "md5:0123", "../../blobs"} {
+		response, body := do(t, server, http.MethodPost, "/v2/app/blobs/uploads/?digest="+digest, image.layer)
+		expect(t, response, body, http.StatusBadRequest)
+
+		if !strings.Contains(string(body), "DIGEST_INVALID") {
+			t.Errorf("upload with digest %s = %s, want DIGEST_INVALID", digest, body)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(UploadDir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("blobs = %v, want none", entries)
+	}
+
+	// the blobs were never uploaded
+	response, body := do(t, server, http.MethodPut, "/v2/app/manifests/latest", image.manifest)
+	expect(t, response, body, http.StatusBadRequest)
+}
+
+func TestRegistryPushOverwrite(t *testing.T) {
+	pulled := newTestImage(t, "pulled")
+	pushed := newTestImage(t, "pushed")
+
+	for _, overwrite := range []bool{false, true} {
+		t.Run(fmt.Sprintf("overwrite=%t", overwrite), func(t *testing.T) {
+			server := newTestServer(t, Options{Push: true, Name: "laptop:5000", Overwrite: overwrite})
+
+			docker := pulled.save(t, "docker.io/library/alpine:latest")
+			local := pulled.save(t, "laptop:5000/alpine:latest")
+
+			// pushes can only target images named after the registry
+			response, body := push(t, server, pushed, "library/alpine", "latest")
+			expect(t, response, body, http.StatusCreated)
+
+			manifest, err := os.ReadFile(filepath.Join(docker, "manifest.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(manifest, pulled.manifest) {
+				t.Errorf("docker.io/library/alpine was replaced")
+			}
+
+			want := http.StatusForbidden
+			if overwrite {
+				want = http.StatusCreated
+			}
+
+			response, body = push(t, server, pushed, "alpine", "latest")
+			expect(t, response, body, want)
+
+			manifest, err = os.ReadFile(filepath.Join(local, "manifest.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Equal(manifest, pushed.manifest) != overwrite {
+				t.Errorf("laptop:5000/alpine replaced = %t, want %t", !overwrite, overwrite)
+			}
+		})
+	}
+}
+
+func TestRegistryUploadLimit(t *testing.T) {
+	server := newTestServer(t, Options{Push: true, MaxUploadSize: 10})
+
+	blob := []byte("0123456789")
+
+	pushBlob(t, server, "app", blob)
+
+	response, body := do(t, server, http.MethodPost, "/v2/app/blobs/uploads/?digest="+hash(append(blob, '!')).String(),
+		append(blob, '!'))
+	expect(t, response, body, http.StatusRequestEntityTooLarge)
+
+	// the limit applies to the whole blob, not to each chunk
+	response, body = do(t, server, http.MethodPost, "/v2/app/blobs/uploads/", nil)
+	expect(t, response, body, http.StatusAccepted)
+
+	location := response.Header.Get("Location")
+
+	response, body = do(t, server, http.MethodPatch, location, blob[:6])
+	expect(t, response, body, http.StatusAccepted)
+
+	response, body = do(t, server, http.MethodPatch, location, blob[:6])
+	expect(t, response, body, http.StatusRequestEntityTooLarge)
+
+	response, body = do(t, server, http.MethodGet, location, nil)
+	expect(t, response, body, http.StatusNotFound)
+}
+
+func TestNewRegistry(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  Options
+		wantName string
+		wantErr  bool
+	}{
+		{name: "address", options: Options{Address: "127.0.0.1:5000"}, wantName: "127.0.0.1:5000"},
+		{name: "hostname", options: Options{Address: "laptop.lan:5000"}, wantName: "laptop.lan:5000"},
+		{name: "no host", options: Options{Address: ":5000"}, wantName: "localhost:5000"},
+		{name: "unspecified", options: Options{Address: "0.0.0.0:5000"}, wantName: "localhost:5000"},
+		{name: "unspecified ipv6", options: Options{Address: "[::]:5000"}, wantName: "localhost:5000"},
+		{name: "name", options: Options{Address: ":5000", Name: "laptop:5000"}, wantName: "laptop:5000"},
+		{name: "domain name", options: Options{Address: ":5000", Name: "registry.lan"}, wantName: "registry.lan"},
+		{name: "name without port", options: Options{Address: ":5000", Name: "laptop"}, wantErr: true},
+		{name: "name with path", options: Options{Address: ":5000", Name: "laptop:5000/foo"}, wantErr: true},
+		{name: "docker hub name", options: Options{Address: ":5000", Name: "docker.io"}, wantErr: true},
+		{name: "invalid address", options: Options{Address: "5000"}, wantErr: true},
+		{name: "invalid credentials", options: Options{Address: ":5000", Credentials: "user"}, wantErr: true},
+		{name: "missing tls key", options: Options{Address: ":5000", TLSCert: "cert.pem"}, wantErr: true},
+		{name: "negative upload size", options: Options{Address: ":5000", MaxUploadSize: -1}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := newRegistry(test.options)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newRegistry(%+v) error = %v, wantErr %v", test.options, err, test.wantErr)
+			}
+
+			if !test.wantErr && got.options.Name != test.wantName {
+				t.Errorf("newRegistry(%+v) name = %s, want %s", test.options, got.options.Name, test.wantName)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+// Package securityutils contains helpers and utilities for confining containers.
+package securityutils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/moby/sys/capability"
+	"golang.org/x/sys/unix"
+)
+
+// AllCapabilities is the value of --cap-add and --cap-drop meaning every capability.
+const AllCapabilities = "ALL"
+
+// DefaultCapabilities are the capabilities of unprivileged containers, like in docker.
+var DefaultCapabilities = []string{
+	"CAP_AUDIT_WRITE",
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_MKNOD",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_RAW",
+	"CAP_SETFCAP",
+	"CAP_SETGID",
+	"CAP_SETPCAP",
+	"CAP_SETUID",
+	"CAP_SYS_CHROOT",
+}
+
+// ParseCapabilities returns input capabilities as CAP_NAME, they can be specified
+// with or without the CAP_ prefix, in any case, ALL is kept as is.
+func ParseCapabilities(input []string) ([]string, error) {
+	result := []string{}
+
+	for _, name := range input {
+		if strings.EqualFold(name, AllCapabilities) {
+			result = append(result, AllCapabilities)
+
+			continue
+		}
+
+		c, ok := getCap(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %s", name)
+		}
+
+		result = append(result, formatCap(c))
+	}
+
+	return result, nil
+}
+
+// GetCapabilities returns the capabilities of a container, the default ones with
+// input ones added and dropped, both can contain ALL. Explicitly added capabilities
+// win over dropped ones. Privileged containers get all the capabilities, like in docker.
+func GetCapabilities(add, drop []string, privileged bool) ([]string, error) {
+	add, err := ParseCapabilities(add)
+	if err != nil {
+		return nil, err
+	}
+
+	drop, err = ParseCapabilities(drop)
+	if err != nil {
+		return nil, err
+	}
+
+	if privileged {
+		return listCaps(), nil
+	}
+
+	caps := DefaultCapabilities
+
+	// like in docker, adding ALL wins over dropping ALL, not over single drops
+	switch {
+	case slices.Contains(add, AllCapabilities):
+		caps = listCaps()
+	case slices.Contains(drop, AllCapabilities):
+		caps = []string{}
+	}
+
+	result := []string{}
+
+	for _, c := range listCaps() {
+		if slices.Contains(add, c) || (slices.Contains(caps, c) && !slices.Contains(drop, c)) {
+			result = append(result, c)
+		}
+	}
+
+	return result, nil
+}
+
+// GetAmbientCapabilities returns the capabilities granted to non-root users, as
+// ambient capabilities: the explicitly added ones, among input caps.
+func GetAmbientCapabilities(caps, add []string) []string {
+	add, err := ParseCapabilities(add)
+	if err != nil || slices.Contains(add, AllCapabilities) {
+		return caps
+	}
+
+	result := []string{}
+
+	for _, c := range caps {
+		if slices.Contains(add, c) {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
+
+// GetCapabilityValues returns the numeric values of input capabilities, the
+// unknown ones are skipped.
+func GetCapabilityValues(caps []string) []int {
+	result := []int{}
+
+	for _, name := range caps {
+		c, ok := getCap(name)
+		if ok {
+			result = append(result, int(c))
+		}
+	}
+
+	return result
+}
+
+// DropBoundingCapabilities will drop from the bounding set of the current thread
+// the capabilities not in input ones, so that they can't be gained anymore, not
+// even by root. This requires CAP_SETPCAP.
+func DropBoundingCapabilities(caps []string) error {
+	capabilities, err := capability.NewPid2(0)
+	if err != nil {
+		return fmt.Errorf("reading capabilities of current process: %w", err)
+	}
+
+	for _, name := range caps {
+		c, ok := getCap(name)
+		if ok {
+			capabilities.Set(capability.BOUNDING, c)
+		}
+	}
+
+	err = capabilities.Apply(capability.BOUNDS)
+	if err != nil {
+		return fmt.Errorf("dropping bounding capabilities: %w", err)
+	}
+
+	return nil
+}
+
+// KeepCapabilities will keep the permitted capabilities of the current thread
+// when switching to a non-root user, until the next execve.
+func KeepCapabilities() error {
+	return unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0)
+}
+
+// RaiseAmbientCapabilities will set input capabilities as the only permitted,
+// effective, inheritable and ambient ones of the current thread, so that they
+// are kept by a non-root user across execve. Only the permitted ones are
+// raised, see KeepCapabilities.
+func RaiseAmbientCapabilities(caps []string) error {
+	current, err := capability.NewPid2(0)
+	if err != nil {
+		return fmt.Errorf("reading capabilities of current process: %w", err)
+	}
+
+	err = current.Load()
+	if err != nil {
+		return fmt.Errorf("reading capabilities of current process: %w", err)
+	}
+
+	capabilities, err := capability.NewPid2(0)
+	if err != nil {
+		return fmt.Errorf("reading capabilities of current process: %w", err)
+	}
+
+	// capabilities missing from our bounding set can't be raised
+	for _, name := range caps {
+		c, ok := getCap(name)
+		if ok && current.Get(capability.PERMITTED, c) {
+			capabilities.Set(capability.CAPS|capability.AMBIENT, c)
+		}
+	}
+
+	err = capabilities.Apply(capability.CAPS | capability.AMBS)
+	if err != nil {
+		return fmt.Errorf("setting ambient capabilities: %w", err)
+	}
+
+	return nil
+}
+
+// getCap returns the capability with input name, with or without CAP_ prefix.
+func getCap(name string) (capability.Cap, bool) {
+	name = strings.TrimPrefix(strings.ToLower(name), "cap_")
+
+	for _, c := range capability.ListKnown() {
+		if c.String() == name {
+			return c, true
+		}
+	}
+
+	return 0, false
+}
+
+// listCaps returns all the capabilities supported by the kernel, as CAP_NAME.
+func listCaps() []string {
+	supported, err := capability.ListSupported()
+	if err != nil {
+		supported = capability.ListKnown()
+	}
+
+	result := []string{}
+
+	for _, c := range supported {
+		result = append(result, formatCap(c))
+	}
+
+	return result
+}
+
+func formatCap(c capability.Cap) string {
+	return "CAP_" + strings.ToUpper(c.String())
+}
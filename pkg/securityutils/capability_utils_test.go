@@ -0,0 +1,154 @@
+package securityutils
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", input: nil, want: []string{}},
+		{name: "prefixed", input: []string{"CAP_NET_ADMIN"}, want: []string{"CAP_NET_ADMIN"}},
+		{name: "unprefixed", input: []string{"sys_admin"}, want: []string{"CAP_SYS_ADMIN"}},
+		{name: "mixed case", input: []string{"Cap_Kill", "chown"}, want: []string{"CAP_KILL", "CAP_CHOWN"}},
+		{name: "all", input: []string{"all"}, want: []string{AllCapabilities}},
+		{name: "unknown", input: []string{"CAP_FOO"}, wantErr: true},
+		{name: "unknown after known", input: []string{"KILL", "FOO"}, wantErr: true},
+		{name: "empty name", input: []string{""}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseCapabilities(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseCapabilities(%q) error = %v, wantErr %v", test.input, err, test.wantErr)
+			}
+
+			if !test.wantErr && !slices.Equal(got, test.want) {
+				t.Errorf("ParseCapabilities(%q) = %q, want %q", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	all := listCaps()
+
+	without := func(caps []string, drop ...string) []string {
+		return slices.DeleteFunc(slices.Clone(caps), func(c string) bool {
+			return slices.Contains(drop, c)
+		})
+	}
+
+	tests := []struct {
+		name       string
+		add        []string
+		drop       []string
+		privileged bool
+		want       []string
+		wantErr    bool
+	}{
+		{name: "default", want: DefaultCapabilities},
+		{
+			name: "add",
+			add:  []string{"net_admin", "CAP_SYS_PTRACE"},
+			want: append(slices.Clone(DefaultCapabilities), "CAP_NET_ADMIN", "CAP_SYS_PTRACE"),
+		},
+		{
+			name: "drop",
+			drop: []string{"CAP_NET_RAW", "mknod"},
+			want: without(DefaultCapabilities, "CAP_NET_RAW", "CAP_MKNOD"),
+		},
+		{name: "drop not granted", drop: []string{"SYS_ADMIN"}, want: DefaultCapabilities},
+		{name: "add all", add: []string{"ALL"}, want: all},
+		{
+			name: "add all drop some",
+			add:  []string{"ALL"},
+			drop: []string{"SYS_ADMIN", "CAP_KILL"},
+			want: without(all, "CAP_SYS_ADMIN", "CAP_KILL"),
+		},
+		{name: "drop all", drop: []string{"all"}, want: []string{}},
+		{
+			name: "drop all add some",
+			add:  []string{"CHOWN", "CAP_SETUID"},
+			drop: []string{"ALL"},
+			want: []string{"CAP_CHOWN", "CAP_SETUID"},
+		},
+		{
+			name: "add wins over drop",
+			add:  []string{"CAP_KILL", "NET_ADMIN"},
+			drop: []string{"KILL", "NET_ADMIN"},
+			want: append(slices.Clone(DefaultCapabilities), "CAP_NET_ADMIN"),
+		},
+		{name: "add and drop all", add: []string{"ALL"}, drop: []string{"ALL"}, want: all},
+		{
+			name: "add and drop all drop some",
+			add:  []string{"ALL"},
+			drop: []string{"ALL", "SYS_ADMIN"},
+			want: without(all, "CAP_SYS_ADMIN"),
+		},
+		{name: "privileged", privileged: true, want: all},
+		{name: "privileged ignores drop", drop: []string{"ALL"}, privileged: true, want: all},
+		{name: "unknown add", add: []string{"CAP_FOO"}, wantErr: true},
+		{name: "unknown drop", drop: []string{"FOO"}, wantErr: true},
+		{name: "unknown privileged", add: []string{"FOO"}, privileged: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := GetCapabilities(test.add, test.drop, test.privileged)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("GetCapabilities(%q, %q, %t) error = %v, wantErr %v",
+					test.add, test.drop, test.privileged, err, test.wantErr)
+			}
+
+			if test.wantErr {
+				return
+			}
+
+			// the result follows the capability numbers, not the input order
+			want := slices.Sorted(slices.Values(test.want))
+			if !slices.Equal(slices.Sorted(slices.Values(got)), want) {
+				t.Errorf("GetCapabilities(%q, %q, %t) = %q, want %q",
+					test.add, test.drop, test.privileged, got, want)
+			}
+
+			if !slices.IsSortedFunc(got, func(a, b string) int {
+				return slices.Index(all, a) - slices.Index(all, b)
+			}) {
+				t.Errorf("GetCapabilities(%q, %q, %t) = %q, not in capability order",
+					test.add, test.drop, test.privileged, got)
+			}
+		})
+	}
+}
+
+func TestGetAmbientCapabilities(t *testing.T) {
+	caps := []string{"CAP_CHOWN", "CAP_KILL", "CAP_NET_ADMIN"}
+
+	tests := []struct {
+		name string
+		add  []string
+		want []string
+	}{
+		{name: "none added", add: nil, want: []string{}},
+		{name: "added", add: []string{"net_admin", "CAP_KILL"}, want: []string{"CAP_KILL", "CAP_NET_ADMIN"}},
+		{name: "added not granted", add: []string{"SYS_ADMIN"}, want: []string{}},
+		{name: "all", add: []string{"ALL"}, want: caps},
+		{name: "unknown", add: []string{"FOO"}, want: caps},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := GetAmbientCapabilities(caps, test.add)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("GetAmbientCapabilities(%q, %q) = %q, want %q", caps, test.add, got, test.want)
+			}
+		})
+	}
+}
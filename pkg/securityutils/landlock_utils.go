@@ -0,0 +1,227 @@
+// Package securityutils contains helpers and utilities for confining containers.
+package securityutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLandlockUnsupported is returned when compiling a profile on a kernel without landlock.
+var ErrLandlockUnsupported = errors.New("landlock is not supported by the kernel")
+
+// landlockAccess maps the profile access rights to the landlock ones, ro and rw
+// are shortcuts for reading and executing, and for everything.
+var landlockAccess = map[string]uint64{
+	"execute":     unix.LANDLOCK_ACCESS_FS_EXECUTE,
+	"write_file":  unix.LANDLOCK_ACCESS_FS_WRITE_FILE,
+	"read_file":   unix.LANDLOCK_ACCESS_FS_READ_FILE,
+	"read_dir":    unix.LANDLOCK_ACCESS_FS_READ_DIR,
+	"remove_dir":  unix.LANDLOCK_ACCESS_FS_REMOVE_DIR,
+	"remove_file": unix.LANDLOCK_ACCESS_FS_REMOVE_FILE,
+	"make_char":   unix.LANDLOCK_ACCESS_FS_MAKE_CHAR,
+	"make_dir":    unix.LANDLOCK_ACCESS_FS_MAKE_DIR,
+	"make_reg":    unix.LANDLOCK_ACCESS_FS_MAKE_REG,
+	"make_sock":   unix.LANDLOCK_ACCESS_FS_MAKE_SOCK,
+	"make_fifo":   unix.LANDLOCK_ACCESS_FS_MAKE_FIFO,
+	"make_block":  unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK,
+	"make_sym":    unix.LANDLOCK_ACCESS_FS_MAKE_SYM,
+	"refer":       unix.LANDLOCK_ACCESS_FS_REFER,
+	"truncate":    unix.LANDLOCK_ACCESS_FS_TRUNCATE,
+	"ioctl_dev":   unix.LANDLOCK_ACCESS_FS_IOCTL_DEV,
+	"ro": unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR,
+	"rw": landlockAccessAll,
+}
+
+// landlockAccessAll are all the filesystem access rights known.
+const landlockAccessAll = unix.LANDLOCK_ACCESS_FS_IOCTL_DEV<<1 - 1
+
+// landlockAccessFile are the access rights that apply to files, the others only
+// apply to directories.
+const landlockAccessFile = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+	unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE |
+	unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+	unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+// landlockABIAccess are the filesystem access rights supported by each landlock
+// ABI, newer ABIs support all the known ones.
+var landlockABIAccess = []uint64{
+	1: unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1,
+	2: unix.LANDLOCK_ACCESS_FS_REFER<<1 - 1,
+	3: unix.LANDLOCK_ACCESS_FS_TRUNCATE<<1 - 1,
+	4: unix.LANDLOCK_ACCESS_FS_TRUNCATE<<1 - 1,
+}
+
+// landlockProfile is a landlock profile, like:
+//
+//	{"rules": [{"paths": ["/usr", "/etc"], "access": ["ro"]}, {"paths": ["/tmp"], "access": ["rw"]}]}
+type landlockProfile struct {
+	Rules []landlockProfileRule `json:"rules"`
+}
+
+type landlockProfileRule struct {
+	Paths  []string `json:"paths"`
+	Access []string `json:"access"`
+}
+
+// LandlockRuleset is a landlock profile compiled for the running kernel, the
+// handled access rights are denied outside of the rules.
+type LandlockRuleset struct {
+	Handled uint64
+	Rules   []LandlockRule
+}
+
+// LandlockRule allows access rights to a path, and to what's beneath it.
+type LandlockRule struct {
+	Path   string
+	Access uint64
+}
+
+// GetLandlockABI returns the landlock ABI version of the kernel, 0 if unsupported.
+func GetLandlockABI() int {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+
+	return int(abi)
+}
+
+// CompileLandlock will compile input landlock profile for the running kernel,
+// access rights the kernel doesn't support are left out.
+// The profile is validated even if landlock is not supported, in that case
+// ErrLandlockUnsupported is returned.
+func CompileLandlock(path string) (*LandlockRuleset, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading landlock profile: %w", err)
+	}
+
+	profile := landlockProfile{}
+
+	err = json.Unmarshal(content, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("parsing landlock profile %s: %w", path, err)
+	}
+
+	return profile.compile(GetLandlockABI())
+}
+
+// compile will compile the profile for input landlock ABI, 0 meaning that
+// landlock is not supported, see CompileLandlock.
+func (p landlockProfile) compile(abi int) (*LandlockRuleset, error) {
+	handled := uint64(landlockAccessAll)
+	if abi < len(landlockABIAccess) {
+		handled = landlockABIAccess[abi]
+	}
+
+	ruleset := &LandlockRuleset{Handled: handled}
+
+	for _, rule := range p.Rules {
+		access := uint64(0)
+
+		for _, name := range rule.Access {
+			value, ok := landlockAccess[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown landlock access right %s", name)
+			}
+
+			access |= value
+		}
+
+		for _, item := range rule.Paths {
+			if !filepath.IsAbs(item) {
+				return nil, fmt.Errorf("landlock path %s is not absolute", item)
+			}
+
+			ruleset.Rules = append(ruleset.Rules, LandlockRule{
+				Path:   filepath.Clean(item),
+				Access: access & handled,
+			})
+		}
+	}
+
+	if abi == 0 {
+		return nil, ErrLandlockUnsupported
+	}
+
+	return ruleset, nil
+}
+
+// ApplyLandlock will restrict the current thread, and its future children, with
+// input ruleset. Rules of missing paths are skipped.
+// This requires either CAP_SYS_ADMIN or no_new_privs.
+func ApplyLandlock(ruleset *LandlockRuleset) error {
+	attr := unix.LandlockRulesetAttr{Access_fs: ruleset.Handled}
+
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("creating landlock ruleset: %w", errno)
+	}
+
+	defer unix.Close(int(fd))
+
+	for _, rule := range ruleset.Rules {
+		err := addLandlockRule(int(fd), rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, _, errno = unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("applying landlock ruleset: %w", errno)
+	}
+
+	return nil
+}
+
+// addLandlockRule will add input rule to the ruleset fd, only the file access
+// rights are allowed on files.
+func addLandlockRule(fd int, rule LandlockRule) error {
+	pathFd, err := unix.Open(rule.Path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("opening landlock path %s: %w", rule.Path, err)
+	}
+
+	defer unix.Close(pathFd)
+
+	stat := unix.Stat_t{}
+
+	err = unix.Fstat(pathFd, &stat)
+	if err != nil {
+		return fmt.Errorf("opening landlock path %s: %w", rule.Path, err)
+	}
+
+	access := rule.Access
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockAccessFile
+	}
+
+	if access == 0 {
+		return nil
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(pathFd)}
+
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(fd),
+		unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("adding landlock rule for %s: %w", rule.Path, errno)
+	}
+
+	return nil
+}
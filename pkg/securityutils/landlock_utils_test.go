@@ -0,0 +1,304 @@
+package securityutils
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const landlockRO = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+func TestLandlockCompile(t *testing.T) {
+	abi1 := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	abi2 := abi1 | unix.LANDLOCK_ACCESS_FS_REFER
+	abi3 := abi2 | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+
+	tests := []struct {
+		name    string
+		profile string
+		abi     int
+		want    *LandlockRuleset
+		wantErr error
+	}{
+		{name: "empty", profile: `{"rules": []}`, abi: 1, want: &LandlockRuleset{Handled: abi1}},
+		{
+			name:    "ro",
+			profile: `{"rules": [{"paths": ["/usr", "/etc"], "access": ["ro"]}]}`,
+			abi:     3,
+			want: &LandlockRuleset{Handled: abi3, Rules: []LandlockRule{
+				{Path: "/usr", Access: landlockRO},
+				{Path: "/etc", Access: landlockRO},
+			}},
+		},
+		{
+			name:    "access rights",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["read_dir", "make_dir", "remove_dir"]}]}`,
+			abi:     1,
+			want: &LandlockRuleset{Handled: abi1, Rules: []LandlockRule{{
+				Path: "/tmp",
+				Access: unix.LANDLOCK_ACCESS_FS_READ_DIR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+					unix.LANDLOCK_ACCESS_FS_REMOVE_DIR,
+			}}},
+		},
+		{
+			name:    "several rules",
+			profile: `{"rules": [{"paths": ["/usr"], "access": ["ro"]}, {"paths": ["/tmp"], "access": ["rw"]}]}`,
+			abi:     3,
+			want: &LandlockRuleset{Handled: abi3, Rules: []LandlockRule{
+				{Path: "/usr", Access: landlockRO},
+				{Path: "/tmp", Access: abi3},
+			}},
+		},
+		{
+			name:    "paths are cleaned",
+			profile: `{"rules": [{"paths": ["/tmp/../var/"], "access": ["ro"]}]}`,
+			abi:     1,
+			want:    &LandlockRuleset{Handled: abi1, Rules: []LandlockRule{{Path: "/var", Access: landlockRO}}},
+		},
+		{
+			name:    "rule without paths",
+			profile: `{"rules": [{"paths": [], "access": ["rw"]}]}`,
+			abi:     1,
+			want:    &LandlockRuleset{Handled: abi1},
+		},
+		{
+			name:    "rw on abi 1",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["rw"]}]}`,
+			abi:     1,
+			want:    &LandlockRuleset{Handled: abi1, Rules: []LandlockRule{{Path: "/tmp", Access: abi1}}},
+		},
+		{
+			name:    "rw on abi 2",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["rw"]}]}`,
+			abi:     2,
+			want:    &LandlockRuleset{Handled: abi2, Rules: []LandlockRule{{Path: "/tmp", Access: abi2}}},
+		},
+		{
+			name:    "rw on abi 4",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["rw"]}]}`,
+			abi:     4,
+			want:    &LandlockRuleset{Handled: abi3, Rules: []LandlockRule{{Path: "/tmp", Access: abi3}}},
+		},
+		{
+			name:    "rw on newer abis",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["rw"]}]}`,
+			abi:     100,
+			want: &LandlockRuleset{
+				Handled: landlockAccessAll,
+				Rules:   []LandlockRule{{Path: "/tmp", Access: landlockAccessAll}},
+			},
+		},
+		{
+			name:    "unsupported access right",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["truncate", "read_file"]}]}`,
+			abi:     2,
+			want: &LandlockRuleset{Handled: abi2, Rules: []LandlockRule{
+				{Path: "/tmp", Access: unix.LANDLOCK_ACCESS_FS_READ_FILE},
+			}},
+		},
+		{
+			name:    "only unsupported access rights",
+			profile: `{"rules": [{"paths": ["/dev"], "access": ["ioctl_dev"]}]}`,
+			abi:     3,
+			want:    &LandlockRuleset{Handled: abi3, Rules: []LandlockRule{{Path: "/dev", Access: 0}}},
+		},
+		{
+			name:    "unknown access right",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["ro", "write"]}]}`,
+			abi:     3,
+			wantErr: errors.New("unknown landlock access right write"),
+		},
+		{
+			name:    "access rights are case sensitive",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["RO"]}]}`,
+			abi:     3,
+			wantErr: errors.New("unknown landlock access right RO"),
+		},
+		{
+			name:    "relative path",
+			profile: `{"rules": [{"paths": ["/usr", "tmp"], "access": ["ro"]}]}`,
+			abi:     3,
+			wantErr: errors.New("landlock path tmp is not absolute"),
+		},
+		{
+			name:    "unsupported",
+			profile: `{"rules": [{"paths": ["/usr"], "access": ["ro"]}]}`,
+			abi:     0,
+			wantErr: ErrLandlockUnsupported,
+		},
+		{name: "unsupported empty", profile: `{"rules": []}`, abi: 0, wantErr: ErrLandlockUnsupported},
+		{
+			name:    "unsupported unknown access right",
+			profile: `{"rules": [{"paths": ["/tmp"], "access": ["write"]}]}`,
+			abi:     0,
+			wantErr: errors.New("unknown landlock access right write"),
+		},
+		{
+			name:    "unsupported relative path",
+			profile: `{"rules": [{"paths": ["tmp"], "access": ["ro"]}]}`,
+			abi:     0,
+			wantErr: errors.New("landlock path tmp is not absolute"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := landlockProfile{}
+
+			err := json.Unmarshal([]byte(test.profile), &profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := profile.compile(test.abi)
+			if test.wantErr != nil {
+				if err == nil || err.Error() != test.wantErr.Error() {
+					t.Fatalf("compile(%d) error = %v, want %v", test.abi, err, test.wantErr)
+				}
+
+				if errors.Is(err, ErrLandlockUnsupported) != errors.Is(test.wantErr, ErrLandlockUnsupported) {
+					t.Errorf("compile(%d) error = %v, is ErrLandlockUnsupported %t",
+						test.abi, err, !errors.Is(test.wantErr, ErrLandlockUnsupported))
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("compile(%d) error = %v", test.abi, err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("compile(%d) = %+v, want %+v", test.abi, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileLandlock(t *testing.T) {
+	dir := t.TempDir()
+
+	profiles := map[string]string{
+		"valid.json":     `{"rules": [{"paths": ["/usr"], "access": ["ro"]}]}`,
+		"malformed.json": `{"rules": [`,
+		"wrong.json":     `{"rules": {"paths": ["/usr"]}}`,
+	}
+
+	for name, content := range profiles {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"malformed.json", "wrong.json", "missing.json"} {
+		_, err := CompileLandlock(filepath.Join(dir, name))
+		if err == nil || errors.Is(err, ErrLandlockUnsupported) {
+			t.Errorf("CompileLandlock(%s) error = %v, want a validation error", name, err)
+		}
+	}
+
+	got, err := CompileLandlock(filepath.Join(dir, "valid.json"))
+
+	abi := GetLandlockABI()
+	if abi == 0 {
+		if !errors.Is(err, ErrLandlockUnsupported) {
+			t.Errorf("CompileLandlock(valid.json) error = %v, want %v", err, ErrLandlockUnsupported)
+		}
+
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("CompileLandlock(valid.json) error = %v", err)
+	}
+
+	want := &LandlockRuleset{Handled: handledAccess(abi), Rules: []LandlockRule{{Path: "/usr", Access: landlockRO}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CompileLandlock(valid.json) = %+v, want %+v", got, want)
+	}
+}
+
+func TestAddLandlockRule(t *testing.T) {
+	abi := GetLandlockABI()
+	if abi == 0 {
+		t.Skip("landlock is not supported by the kernel")
+	}
+
+	handled := handledAccess(abi)
+
+	// rules are only added to the ruleset, the test process is not restricted
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		t.Fatalf("creating landlock ruleset: %v", errno)
+	}
+
+	defer unix.Close(int(fd))
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+
+	err := os.WriteFile(file, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		rule    LandlockRule
+		wantErr bool
+	}{
+		{name: "directory", rule: LandlockRule{Path: dir, Access: handled}},
+		{name: "file", rule: LandlockRule{Path: file, Access: handled}},
+		{name: "file with directory rights", rule: LandlockRule{Path: file, Access: unix.LANDLOCK_ACCESS_FS_MAKE_DIR}},
+		{name: "missing path", rule: LandlockRule{Path: filepath.Join(dir, "missing"), Access: landlockRO}},
+		{name: "no access", rule: LandlockRule{Path: dir, Access: 0}},
+		{name: "access not handled", rule: LandlockRule{Path: dir, Access: 1 << 62}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := addLandlockRule(int(fd), test.rule)
+			if (err != nil) != test.wantErr {
+				t.Errorf("addLandlockRule(%+v) error = %v, wantErr %v", test.rule, err, test.wantErr)
+			}
+		})
+	}
+
+	// the kernel refuses directory rights on files, so they must be masked
+	pathFd, err := unix.Open(file, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unix.Close(pathFd)
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: handled, Parent_fd: int32(pathFd)}
+
+	_, _, errno = unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd,
+		unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if !errors.Is(errno, unix.EINVAL) {
+		t.Errorf("adding directory rights on a file error = %v, want %v", errno, unix.EINVAL)
+	}
+}
+
+// handledAccess returns the access rights handled by rulesets compiled for input ABI.
+func handledAccess(abi int) uint64 {
+	ruleset, err := landlockProfile{}.compile(abi)
+	if err != nil {
+		return 0
+	}
+
+	return ruleset.Handled
+}
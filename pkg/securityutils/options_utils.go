@@ -0,0 +1,168 @@
+// Package securityutils contains helpers and utilities for confining containers.
+package securityutils
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// UnmaskAll is the unmask option value removing all the masked and read-only paths.
+const UnmaskAll = "ALL"
+
+// SecurityOptions are the options set with --security-opt.
+type SecurityOptions struct {
+	Seccomp         string
+	Landlock        string
+	NoNewPrivileges bool
+	Mask            []string
+	Unmask          []string
+}
+
+// ParseSecurityOptions will parse input security options, in the form of:
+//   - seccomp=PATH|unconfined, the profile is validated and its path made absolute
+//   - landlock=PATH, like seccomp
+//   - no-new-privileges[=true|false]
+//   - mask=PATH[:PATH...]
+//   - unmask=ALL|PATH[:PATH...], paths can be globs, like /proc/*
+//   - label=VALUE and apparmor=VALUE, lilipod uses no LSM, they are accepted for
+//     compatibility, like with distrobox, and ignored
+func ParseSecurityOptions(input []string) (SecurityOptions, error) {
+	result := SecurityOptions{}
+
+	for _, opt := range input {
+		key, value, found := strings.Cut(opt, "=")
+
+		switch key {
+		case "seccomp":
+			seccomp, err := parseSeccomp(value)
+			if err != nil {
+				return SecurityOptions{}, fmt.Errorf("invalid security option %s: %w", opt, err)
+			}
+
+			result.Seccomp = seccomp
+		case "landlock":
+			landlock, err := parseLandlock(value)
+			if err != nil {
+				return SecurityOptions{}, fmt.Errorf("invalid security option %s: %w", opt, err)
+			}
+
+			result.Landlock = landlock
+		case "no-new-privileges":
+			result.NoNewPrivileges = true
+
+			if found {
+				noNewPrivileges, err := strconv.ParseBool(value)
+				if err != nil {
+					return SecurityOptions{}, fmt.Errorf("invalid security option %s: %w", opt, err)
+				}
+
+				result.NoNewPrivileges = noNewPrivileges
+			}
+		case "mask", "unmask":
+			paths, err := parsePaths(value, key == "unmask")
+			if err != nil {
+				return SecurityOptions{}, fmt.Errorf("invalid security option %s: %w", opt, err)
+			}
+
+			if key == "mask" {
+				result.Mask = append(result.Mask, paths...)
+			} else {
+				result.Unmask = append(result.Unmask, paths...)
+			}
+		case "label", "apparmor":
+			if !found {
+				return SecurityOptions{}, fmt.Errorf("invalid security option %s, must be %s=VALUE", opt, key)
+			}
+		default:
+			return SecurityOptions{}, fmt.Errorf("unsupported security option %s", opt)
+		}
+	}
+
+	return result, nil
+}
+
+// IsUnmasked returns if input path is unmasked by input unmask paths.
+func IsUnmasked(path string, unmask []string) bool {
+	for _, pattern := range unmask {
+		matched, _ := filepath.Match(pattern, path)
+		if pattern == UnmaskAll || matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseSeccomp returns the absolute path of input seccomp profile, after
+// validating it, or unconfined.
+func parseSeccomp(input string) (string, error) {
+	if input == "" {
+		return "", fmt.Errorf("must be seccomp=PATH|%s", Unconfined)
+	}
+
+	if input == Unconfined {
+		return input, nil
+	}
+
+	path, err := filepath.Abs(input)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = CompileSeccomp(path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// parseLandlock returns the absolute path of input landlock profile, after
+// validating it, even if the kernel doesn't support landlock.
+func parseLandlock(input string) (string, error) {
+	if input == "" {
+		return "", errors.New("must be landlock=PATH")
+	}
+
+	path, err := filepath.Abs(input)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = CompileLandlock(path)
+	if err != nil && !errors.Is(err, ErrLandlockUnsupported) {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// parsePaths returns input colon separated absolute paths, if glob is specified
+// they can be globs, or ALL.
+func parsePaths(input string, glob bool) ([]string, error) {
+	if input == "" {
+		return nil, fmt.Errorf("missing paths")
+	}
+
+	result := []string{}
+
+	for _, path := range strings.Split(input, ":") {
+		switch {
+		case glob && path == UnmaskAll:
+		case !filepath.IsAbs(path):
+			return nil, fmt.Errorf("path %s is not absolute", path)
+		case glob:
+			_, err := filepath.Match(path, "")
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %s: %w", path, err)
+			}
+		}
+
+		result = append(result, filepath.Clean(path))
+	}
+
+	return result, nil
+}
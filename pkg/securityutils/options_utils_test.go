@@ -0,0 +1,160 @@
+package securityutils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseSecurityOptions(t *testing.T) {
+	dir := t.TempDir()
+
+	profile := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	profiles := map[string]string{
+		"seccomp.json":          `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": []}`,
+		"seccomp-invalid.json":  `{"defaultAction": "SCMP_ACT_FOO", "syscalls": []}`,
+		"landlock.json":         `{"rules": [{"paths": ["/usr"], "access": ["ro"]}]}`,
+		"landlock-invalid.json": `{"rules": [{"paths": ["/usr"], "access": ["foo"]}]}`,
+		"malformed.json":        `{`,
+	}
+
+	for name, content := range profiles {
+		err := os.WriteFile(profile(name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relative, err := filepath.Rel(cwd, profile("seccomp.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		input   []string
+		want    SecurityOptions
+		wantErr bool
+	}{
+		{name: "empty", input: nil, want: SecurityOptions{}},
+		{
+			name:  "seccomp",
+			input: []string{"seccomp=" + profile("seccomp.json")},
+			want:  SecurityOptions{Seccomp: profile("seccomp.json")},
+		},
+		{
+			name:  "seccomp relative",
+			input: []string{"seccomp=" + relative},
+			want:  SecurityOptions{Seccomp: profile("seccomp.json")},
+		},
+		{name: "seccomp unconfined", input: []string{"seccomp=unconfined"}, want: SecurityOptions{Seccomp: Unconfined}},
+		{name: "seccomp invalid", input: []string{"seccomp=" + profile("seccomp-invalid.json")}, wantErr: true},
+		{name: "seccomp malformed", input: []string{"seccomp=" + profile("malformed.json")}, wantErr: true},
+		{name: "seccomp missing", input: []string{"seccomp=" + profile("missing.json")}, wantErr: true},
+		{name: "seccomp empty", input: []string{"seccomp="}, wantErr: true},
+		{name: "seccomp no value", input: []string{"seccomp"}, wantErr: true},
+		{
+			name:  "landlock",
+			input: []string{"landlock=" + profile("landlock.json")},
+			want:  SecurityOptions{Landlock: profile("landlock.json")},
+		},
+		{name: "landlock invalid", input: []string{"landlock=" + profile("landlock-invalid.json")}, wantErr: true},
+		{name: "landlock malformed", input: []string{"landlock=" + profile("malformed.json")}, wantErr: true},
+		{name: "landlock empty", input: []string{"landlock="}, wantErr: true},
+		{name: "no-new-privileges", input: []string{"no-new-privileges"}, want: SecurityOptions{NoNewPrivileges: true}},
+		{
+			name:  "no-new-privileges true",
+			input: []string{"no-new-privileges=true"},
+			want:  SecurityOptions{NoNewPrivileges: true},
+		},
+		{
+			name:  "no-new-privileges false",
+			input: []string{"no-new-privileges", "no-new-privileges=false"},
+			want:  SecurityOptions{},
+		},
+		{name: "no-new-privileges invalid", input: []string{"no-new-privileges=maybe"}, wantErr: true},
+		{
+			name:  "mask",
+			input: []string{"mask=/proc/kcore:/sys/firmware/", "mask=/tmp"},
+			want:  SecurityOptions{Mask: []string{"/proc/kcore", "/sys/firmware", "/tmp"}},
+		},
+		{name: "mask relative", input: []string{"mask=proc/kcore"}, wantErr: true},
+		{name: "mask all", input: []string{"mask=ALL"}, wantErr: true},
+		{name: "mask empty", input: []string{"mask="}, wantErr: true},
+		{
+			name:  "unmask",
+			input: []string{"unmask=/proc/*:/sys/firmware"},
+			want:  SecurityOptions{Unmask: []string{"/proc/*", "/sys/firmware"}},
+		},
+		{name: "unmask all", input: []string{"unmask=ALL"}, want: SecurityOptions{Unmask: []string{UnmaskAll}}},
+		{name: "unmask invalid glob", input: []string{"unmask=/proc/["}, wantErr: true},
+		{name: "unmask relative", input: []string{"unmask=proc"}, wantErr: true},
+		{name: "label", input: []string{"label=disable"}, want: SecurityOptions{}},
+		{name: "apparmor", input: []string{"apparmor=unconfined"}, want: SecurityOptions{}},
+		{name: "label no value", input: []string{"label"}, wantErr: true},
+		{name: "unsupported", input: []string{"systempaths=unconfined"}, wantErr: true},
+		{
+			name: "combined",
+			input: []string{
+				"seccomp=unconfined",
+				"no-new-privileges",
+				"mask=/proc/acpi",
+				"unmask=/proc/kcore",
+				"label=disable",
+			},
+			want: SecurityOptions{
+				Seccomp:         Unconfined,
+				NoNewPrivileges: true,
+				Mask:            []string{"/proc/acpi"},
+				Unmask:          []string{"/proc/kcore"},
+			},
+		},
+		{name: "error after valid", input: []string{"no-new-privileges", "foo=bar"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseSecurityOptions(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseSecurityOptions(%q) error = %v, wantErr %v", test.input, err, test.wantErr)
+			}
+
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseSecurityOptions(%q) = %+v, want %+v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsUnmasked(t *testing.T) {
+	tests := []struct {
+		path   string
+		unmask []string
+		want   bool
+	}{
+		{path: "/proc/kcore", unmask: nil, want: false},
+		{path: "/proc/kcore", unmask: []string{UnmaskAll}, want: true},
+		{path: "/proc/kcore", unmask: []string{"/proc/kcore"}, want: true},
+		{path: "/proc/kcore", unmask: []string{"/sys/firmware", "/proc/*"}, want: true},
+		{path: "/proc/sys/kernel", unmask: []string{"/proc/*"}, want: false},
+		{path: "/proc/keys", unmask: []string{"/proc/kcore"}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got := IsUnmasked(test.path, test.unmask)
+			if got != test.want {
+				t.Errorf("IsUnmasked(%q, %q) = %t, want %t", test.path, test.unmask, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+//go:build ignore
+
+// This program generates seccomp_syscalls.go, the syscall tables of the
+// architectures supported by the seccomp filters, from the zsysnum files of the
+// vendored golang.org/x/sys/unix. Run it with go generate after updating it.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// unixDir is the vendored golang.org/x/sys/unix, from this package's dir.
+const unixDir = "../../vendor/golang.org/x/sys/unix"
+
+// arches maps the seccomp architectures to their go ones, in output order.
+var arches = [][2]string{
+	{"SCMP_ARCH_X86_64", "amd64"},
+	{"SCMP_ARCH_X86", "386"},
+	{"SCMP_ARCH_AARCH64", "arm64"},
+	{"SCMP_ARCH_ARM", "arm"},
+}
+
+var syscallRegexp = regexp.MustCompile(`^\s+SYS_(\w+)\s+=\s+(\d+)$`)
+
+func main() {
+	output := bytes.Buffer{}
+
+	output.WriteString("// Code generated by seccomp_syscalls_gen.go from golang.org/x/sys/unix zsysnum files. " +
+		"DO NOT EDIT.\n\n")
+	output.WriteString("// Package securityutils contains helpers and utilities for confining containers.\n")
+	output.WriteString("package securityutils\n\n")
+	output.WriteString("// syscallTables maps the architectures supported by the seccomp filters to\n")
+	output.WriteString("// their syscall names and numbers.\n")
+	output.WriteString("var syscallTables = map[string]map[string]uint32{\n")
+
+	for _, arch := range arches {
+		table, err := readTable(filepath.Join(unixDir, "zsysnum_linux_"+arch[1]+".go"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		names := make([]string, 0, len(table))
+		for name := range table {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		fmt.Fprintf(&output, "%q: {\n", arch[0])
+
+		for _, name := range names {
+			fmt.Fprintf(&output, "%q: %s,\n", name, table[name])
+		}
+
+		output.WriteString("},\n")
+	}
+
+	output.WriteString("}\n")
+
+	content, err := format.Source(output.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.WriteFile("seccomp_syscalls.go", content, 0o644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readTable returns the syscall names, in lower case without the SYS_ prefix,
+// and numbers found in input zsysnum file.
+func readTable(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	table := map[string]string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		match := syscallRegexp.FindStringSubmatch(scanner.Text())
+		if match != nil {
+			table[strings.ToLower(match[1])] = match[2]
+		}
+	}
+
+	return table, scanner.Err()
+}
@@ -0,0 +1,476 @@
+// Package securityutils contains helpers and utilities for confining containers.
+package securityutils
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"unsafe"
+
+	"github.com/89luca89/lilipod/pkg/procutils"
+	"golang.org/x/sys/unix"
+)
+
+// Unconfined is the seccomp profile that disables the filter.
+const Unconfined = "unconfined"
+
+// ErrSeccompUnsupported is returned when compiling a profile for an architecture
+// without a syscall table.
+var ErrSeccompUnsupported = errors.New("seccomp is not supported on " + runtime.GOARCH)
+
+// defaultProfile is used when no profile is specified, it follows the docker one.
+//
+//go:embed seccomp.json
+var defaultProfile []byte
+
+// offsets of the fields of struct seccomp_data.
+const (
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+// x32SyscallBit marks the syscalls of the x32 ABI, that share the x86_64 audit arch.
+const x32SyscallBit = 0x40000000
+
+// jump targets of the argument checks, resolved once the rule is complete:
+// the following check or the next rule.
+const (
+	jumpPass = 0xfe
+	jumpFail = 0xff
+)
+
+// syscallTables is generated from the vendored golang.org/x/sys/unix.
+//
+//go:generate go run seccomp_syscalls_gen.go
+
+// nativeArches maps the go architectures to the seccomp ones.
+var nativeArches = map[string]string{
+	"386":   "SCMP_ARCH_X86",
+	"amd64": "SCMP_ARCH_X86_64",
+	"arm":   "SCMP_ARCH_ARM",
+	"arm64": "SCMP_ARCH_AARCH64",
+}
+
+// auditArches maps the seccomp architectures to the audit ones, as found in seccomp_data.
+var auditArches = map[string]uint32{
+	"SCMP_ARCH_X86":     unix.AUDIT_ARCH_I386,
+	"SCMP_ARCH_X86_64":  unix.AUDIT_ARCH_X86_64,
+	"SCMP_ARCH_ARM":     unix.AUDIT_ARCH_ARM,
+	"SCMP_ARCH_AARCH64": unix.AUDIT_ARCH_AARCH64,
+}
+
+// seccompProfile is a seccomp profile, in the JSON format used by docker and podman.
+type seccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint32          `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	ArchMap         []seccompArchMap `json:"archMap,omitempty"`
+	Syscalls        []seccompSyscall `json:"syscalls"`
+}
+
+type seccompArchMap struct {
+	Architecture     string   `json:"architecture"`
+	SubArchitectures []string `json:"subArchitectures"`
+}
+
+type seccompSyscall struct {
+	Name     string        `json:"name,omitempty"`
+	Names    []string      `json:"names,omitempty"`
+	Action   string        `json:"action"`
+	ErrnoRet *uint32       `json:"errnoRet,omitempty"`
+	Args     []seccompArg  `json:"args,omitempty"`
+	Includes seccompFilter `json:"includes,omitempty"`
+	Excludes seccompFilter `json:"excludes,omitempty"`
+}
+
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// seccompFilter restricts a rule to some capabilities, architectures or kernels.
+type seccompFilter struct {
+	Caps      []string `json:"caps,omitempty"`
+	Arches    []string `json:"arches,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// CompileSeccomp will compile input seccomp profile, in the JSON format used by
+// docker and podman, to a BPF filter for the current architecture and its
+// compatible ones. An empty path is the default profile.
+// Rules depending on capabilities are resolved against input caps.
+func CompileSeccomp(path string, caps []string) ([]unix.SockFilter, error) {
+	content := defaultProfile
+
+	if path != "" {
+		var err error
+
+		content, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	profile := seccompProfile{}
+
+	err := json.Unmarshal(content, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+
+	native, ok := nativeArches[runtime.GOARCH]
+	if !ok {
+		return nil, ErrSeccompUnsupported
+	}
+
+	filter, err := profile.compile(native, caps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+
+	return filter, nil
+}
+
+// InstallSeccomp will install input filter for all the threads of the current
+// process, it is inherited by its children and kept across execve.
+// Without no_new_privs, this requires CAP_SYS_ADMIN in the current user namespace.
+func InstallSeccomp(filter []unix.SockFilter) error {
+	if len(filter) == 0 || len(filter) > unix.BPF_MAXINSNS {
+		return fmt.Errorf("invalid seccomp filter of %d instructions", len(filter))
+	}
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	tid, _, errno := unix.Syscall(
+		unix.SYS_SECCOMP,
+		unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC,
+		uintptr(unsafe.Pointer(&prog)),
+	)
+	if errno != 0 {
+		return fmt.Errorf("installing seccomp filter: %w", errno)
+	}
+
+	if tid != 0 {
+		return fmt.Errorf("installing seccomp filter: cannot synchronize thread %d", tid)
+	}
+
+	return nil
+}
+
+// EncodeSeccomp returns input filter encoded as base64, to be passed to the pty agent.
+func EncodeSeccomp(filter []unix.SockFilter) string {
+	content, _ := binary.Append(nil, binary.NativeEndian, filter)
+
+	return base64.StdEncoding.EncodeToString(content)
+}
+
+// compile will compile the profile, with a section for each architecture.
+// The filter jumps to the section of the syscall's architecture, killing the
+// process for unknown ones.
+func (p seccompProfile) compile(native string, caps []string) ([]unix.SockFilter, error) {
+	defaultAction, err := getAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	syscalls := []seccompSyscall{}
+
+	for _, syscall := range p.Syscalls {
+		if syscall.Includes.matches(caps, true) && !syscall.Excludes.matches(caps, false) {
+			syscalls = append(syscalls, syscall)
+		}
+	}
+
+	sections := [][]unix.SockFilter{}
+	arches := p.getArches(native)
+
+	for _, arch := range arches {
+		section, err := compileArch(arch, syscalls, defaultAction)
+		if err != nil {
+			return nil, err
+		}
+
+		sections = append(sections, section)
+	}
+
+	filter := []unix.SockFilter{load(offsetArch)}
+
+	for i, arch := range arches {
+		// skip the following dispatch instructions and the previous sections
+		skip := 2*(len(arches)-i-1) + 1
+		for _, section := range sections[:i] {
+			skip += len(section)
+		}
+
+		filter = append(filter,
+			jump(unix.BPF_JEQ, auditArches[arch], 0, 1),
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA, K: uint32(skip)})
+	}
+
+	filter = append(filter, ret(unix.SECCOMP_RET_KILL_PROCESS))
+
+	for _, section := range sections {
+		filter = append(filter, section...)
+	}
+
+	if len(filter) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("too many rules, %d instructions", len(filter))
+	}
+
+	return filter, nil
+}
+
+// getArches returns the architectures of the profile to compile, starting with
+// the native one, skipping the ones without a syscall table.
+func (p seccompProfile) getArches(native string) []string {
+	arches := []string{native}
+	candidates := p.Architectures
+
+	for _, archMap := range p.ArchMap {
+		if archMap.Architecture == native {
+			candidates = append(candidates, archMap.SubArchitectures...)
+		}
+	}
+
+	for _, arch := range candidates {
+		_, ok := syscallTables[arch]
+		if ok && !slices.Contains(arches, arch) {
+			arches = append(arches, arch)
+		}
+	}
+
+	return arches
+}
+
+// matches returns if the filter applies to the current architecture, kernel and
+// input caps. An empty filter returns empty.
+func (f seccompFilter) matches(caps []string, empty bool) bool {
+	if len(f.Caps) == 0 && len(f.Arches) == 0 && f.MinKernel == "" {
+		return empty
+	}
+
+	for _, capability := range f.Caps {
+		if !slices.ContainsFunc(caps, func(c string) bool { return equalCap(c, capability) }) {
+			return false
+		}
+	}
+
+	if len(f.Arches) > 0 && !slices.Contains(f.Arches, runtime.GOARCH) {
+		return false
+	}
+
+	return f.MinKernel == "" || procutils.KernelAtLeast(f.MinKernel)
+}
+
+// compileArch will compile input syscall rules for input architecture, falling
+// back to input default action.
+func compileArch(arch string, syscalls []seccompSyscall, defaultAction uint32) ([]unix.SockFilter, error) {
+	table := syscallTables[arch]
+	section := []unix.SockFilter{load(offsetNr)}
+
+	// x32 syscalls share the x86_64 arch, they only get the default action
+	if arch == "SCMP_ARCH_X86_64" {
+		section = append(section, jump(unix.BPF_JGE, x32SyscallBit, 0, 1), ret(defaultAction))
+	}
+
+	for _, syscall := range syscalls {
+		// rules returning errors default to EPERM, like in docker
+		action, err := getAction(syscall.Action, syscall.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+
+		names := syscall.Names
+		if syscall.Name != "" {
+			names = append(names, syscall.Name)
+		}
+
+		for _, name := range names {
+			// like libseccomp, syscalls unknown to the architecture are skipped
+			nr, ok := table[name]
+			if !ok {
+				continue
+			}
+
+			rule, err := compileRule(nr, syscall.Args, action)
+			if err != nil {
+				return nil, fmt.Errorf("syscall %s: %w", name, err)
+			}
+
+			section = append(section, rule...)
+		}
+	}
+
+	return append(section, ret(defaultAction)), nil
+}
+
+// compileRule will compile the rule returning input action for syscall nr, if
+// all input args match. The syscall number must be loaded, and is loaded again
+// after checking the args.
+func compileRule(nr uint32, args []seccompArg, action uint32) ([]unix.SockFilter, error) {
+	if len(args) == 0 {
+		return []unix.SockFilter{jump(unix.BPF_JEQ, nr, 0, 1), ret(action)}, nil
+	}
+
+	block := []unix.SockFilter{}
+
+	for _, arg := range args {
+		check, err := compileArg(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		end := len(block) + len(check)
+
+		for i := range check {
+			pos := len(block) + i
+
+			check[i].Jt = resolveJump(check[i].Jt, jumpPass, end-pos-1)
+			check[i].Jf = resolveJump(check[i].Jf, jumpPass, end-pos-1)
+		}
+
+		block = append(block, check...)
+	}
+
+	// failing checks jump to the reload of the syscall number, after the action
+	for pos := range block {
+		block[pos].Jt = resolveJump(block[pos].Jt, jumpFail, len(block)-pos)
+		block[pos].Jf = resolveJump(block[pos].Jf, jumpFail, len(block)-pos)
+	}
+
+	if len(block)+2 > 0xff {
+		return nil, errors.New("too many argument checks")
+	}
+
+	rule := []unix.SockFilter{jump(unix.BPF_JEQ, nr, 0, uint8(len(block)+2))}
+	rule = append(rule, block...)
+
+	return append(rule, ret(action), load(offsetNr)), nil
+}
+
+// compileArg will compile the check of a 64 bit syscall argument, comparing
+// its high and low words, jumping to jumpPass or jumpFail.
+func compileArg(arg seccompArg) ([]unix.SockFilter, error) {
+	if arg.Index > 5 {
+		return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+	}
+
+	//nolint: gosec
+	offset := uint32(offsetArgs + 8*arg.Index)
+	loadHi := load(offset + 4)
+	loadLo := load(offset)
+	hi := uint32(arg.Value >> 32)
+	lo := uint32(arg.Value)
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return []unix.SockFilter{
+			loadHi, jump(unix.BPF_JEQ, hi, 0, jumpFail),
+			loadLo, jump(unix.BPF_JEQ, lo, jumpPass, jumpFail),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []unix.SockFilter{
+			loadHi, jump(unix.BPF_JEQ, hi, 0, jumpPass),
+			loadLo, jump(unix.BPF_JEQ, lo, jumpFail, jumpPass),
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		op := uint16(unix.BPF_JGT)
+		if arg.Op == "SCMP_CMP_GE" {
+			op = unix.BPF_JGE
+		}
+
+		return []unix.SockFilter{
+			loadHi, jump(unix.BPF_JGT, hi, jumpPass, 0), jump(unix.BPF_JEQ, hi, 0, jumpFail),
+			loadLo, jump(op, lo, jumpPass, jumpFail),
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		// the opposite of GE and GT
+		op := uint16(unix.BPF_JGE)
+		if arg.Op == "SCMP_CMP_LE" {
+			op = unix.BPF_JGT
+		}
+
+		return []unix.SockFilter{
+			loadHi, jump(unix.BPF_JGT, hi, jumpFail, 0), jump(unix.BPF_JEQ, hi, 0, jumpPass),
+			loadLo, jump(op, lo, jumpFail, jumpPass),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		return []unix.SockFilter{
+			loadHi, and(hi), jump(unix.BPF_JEQ, uint32(arg.ValueTwo>>32), 0, jumpFail),
+			loadLo, and(lo), jump(unix.BPF_JEQ, uint32(arg.ValueTwo), jumpPass, jumpFail),
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid argument operator %s", arg.Op)
+	}
+}
+
+// getAction returns the seccomp return value of input action, errno defaults to EPERM.
+func getAction(action string, errno *uint32) (uint32, error) {
+	data := uint32(unix.EPERM)
+	if errno != nil {
+		data = *errno & unix.SECCOMP_RET_DATA
+	}
+
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_ERRNO":
+		return unix.SECCOMP_RET_ERRNO | data, nil
+	case "SCMP_ACT_TRACE":
+		return unix.SECCOMP_RET_TRACE | data, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return unix.SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_LOG":
+		return unix.SECCOMP_RET_LOG, nil
+	default:
+		return 0, fmt.Errorf("unsupported action %s", action)
+	}
+}
+
+// equalCap returns if input capabilities are the same, with or without the CAP_
+// prefix, in any case.
+func equalCap(a, b string) bool {
+	a = strings.TrimPrefix(strings.ToUpper(a), "CAP_")
+	b = strings.TrimPrefix(strings.ToUpper(b), "CAP_")
+
+	return a == b
+}
+
+func resolveJump(target, marker uint8, offset int) uint8 {
+	if target != marker {
+		return target
+	}
+
+	return uint8(offset)
+}
+
+func load(offset uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset}
+}
+
+func jump(op uint16, value uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, Jt: jt, Jf: jf, K: value}
+}
+
+func and(value uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: value}
+}
+
+func ret(value uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: value}
+}
@@ -0,0 +1,340 @@
+package securityutils
+
+import (
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	retAllow = unix.SECCOMP_RET_ALLOW
+	retEPERM = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	retKill  = unix.SECCOMP_RET_KILL_PROCESS
+)
+
+// runFilter will run input filter on the seccomp_data of input syscall, like
+// the kernel does, and return its result.
+func runFilter(t *testing.T, filter []unix.SockFilter, arch, nr uint32, args [6]uint64) uint32 {
+	t.Helper()
+
+	data := make([]byte, offsetArgs+8*len(args))
+	binary.NativeEndian.PutUint32(data[offsetNr:], nr)
+	binary.NativeEndian.PutUint32(data[offsetArch:], arch)
+
+	for i, arg := range args {
+		binary.NativeEndian.PutUint64(data[offsetArgs+8*i:], arg)
+	}
+
+	accumulator := uint32(0)
+
+	for pc := 0; pc < len(filter); pc++ {
+		instruction := filter[pc]
+
+		switch instruction.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			if int(instruction.K)+4 > len(data) {
+				t.Fatalf("load out of seccomp_data at %d: %+v", pc, instruction)
+			}
+
+			accumulator = binary.NativeEndian.Uint32(data[instruction.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			accumulator &= instruction.K
+		case unix.BPF_JMP | unix.BPF_JA:
+			pc += int(instruction.K)
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K,
+			unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K,
+			unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			var result bool
+
+			switch instruction.Code &^ (unix.BPF_JMP | unix.BPF_K) {
+			case unix.BPF_JEQ:
+				result = accumulator == instruction.K
+			case unix.BPF_JGT:
+				result = accumulator > instruction.K
+			case unix.BPF_JGE:
+				result = accumulator >= instruction.K
+			}
+
+			if result {
+				pc += int(instruction.Jt)
+			} else {
+				pc += int(instruction.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return instruction.K
+		default:
+			t.Fatalf("unexpected instruction at %d: %+v", pc, instruction)
+		}
+	}
+
+	t.Fatal("filter did not return")
+
+	return 0
+}
+
+// compileTest will compile input profile for input native architecture.
+func compileTest(t *testing.T, profile seccompProfile, native string, caps []string) []unix.SockFilter {
+	t.Helper()
+
+	filter, err := profile.compile(native, caps)
+	if err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+
+	return filter
+}
+
+func TestSeccompArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		arg   seccompArg
+		value uint64
+		want  uint32
+	}{
+		{"EQ", seccompArg{Op: "SCMP_CMP_EQ", Value: 5}, 5, retAllow},
+		{"EQ lower", seccompArg{Op: "SCMP_CMP_EQ", Value: 5}, 4, retEPERM},
+		{"EQ high word", seccompArg{Op: "SCMP_CMP_EQ", Value: 5}, 1<<32 | 5, retEPERM},
+		{"EQ 64 bit", seccompArg{Op: "SCMP_CMP_EQ", Value: 1<<32 | 5}, 1<<32 | 5, retAllow},
+		{"EQ other index", seccompArg{Index: 3, Op: "SCMP_CMP_EQ", Value: 5}, 5, retAllow},
+		{"NE", seccompArg{Op: "SCMP_CMP_NE", Value: 5}, 6, retAllow},
+		{"NE equal", seccompArg{Op: "SCMP_CMP_NE", Value: 5}, 5, retEPERM},
+		{"NE high word", seccompArg{Op: "SCMP_CMP_NE", Value: 5}, 1<<32 | 5, retAllow},
+		{"GT", seccompArg{Op: "SCMP_CMP_GT", Value: 1 << 32}, 1<<32 | 1, retAllow},
+		{"GT equal", seccompArg{Op: "SCMP_CMP_GT", Value: 1 << 32}, 1 << 32, retEPERM},
+		{"GT lower high word", seccompArg{Op: "SCMP_CMP_GT", Value: 1 << 32}, 0xffffffff, retEPERM},
+		{"GT greater high word", seccompArg{Op: "SCMP_CMP_GT", Value: 1<<32 | 5}, 2 << 32, retAllow},
+		{"GE", seccompArg{Op: "SCMP_CMP_GE", Value: 1 << 32}, 1 << 32, retAllow},
+		{"GE lower", seccompArg{Op: "SCMP_CMP_GE", Value: 1 << 32}, 0xffffffff, retEPERM},
+		{"GE greater", seccompArg{Op: "SCMP_CMP_GE", Value: 5}, 6, retAllow},
+		{"LT", seccompArg{Op: "SCMP_CMP_LT", Value: 5}, 4, retAllow},
+		{"LT equal", seccompArg{Op: "SCMP_CMP_LT", Value: 5}, 5, retEPERM},
+		{"LT greater high word", seccompArg{Op: "SCMP_CMP_LT", Value: 5}, 1<<32 | 4, retEPERM},
+		{"LT lower high word", seccompArg{Op: "SCMP_CMP_LT", Value: 1<<32 | 5}, 0xffffffff, retAllow},
+		{"LE", seccompArg{Op: "SCMP_CMP_LE", Value: 1 << 32}, 1 << 32, retAllow},
+		{"LE greater", seccompArg{Op: "SCMP_CMP_LE", Value: 1 << 32}, 1<<32 | 1, retEPERM},
+		{"LE lower", seccompArg{Op: "SCMP_CMP_LE", Value: 1 << 32}, 0, retAllow},
+		{"MASKED_EQ", seccompArg{Op: "SCMP_CMP_MASKED_EQ", Value: 0xff_000000ff, ValueTwo: 0x12_00000034},
+			0xab12_0000cd34, retAllow},
+		{"MASKED_EQ high word", seccompArg{Op: "SCMP_CMP_MASKED_EQ", Value: 0xff_000000ff, ValueTwo: 0x12_00000034},
+			0xab13_0000cd34, retEPERM},
+		{"MASKED_EQ low word", seccompArg{Op: "SCMP_CMP_MASKED_EQ", Value: 0xff_000000ff, ValueTwo: 0x12_00000034},
+			0xab12_0000cd35, retEPERM},
+		{"MASKED_EQ flags", seccompArg{Op: "SCMP_CMP_MASKED_EQ", Value: unix.CLONE_NEWNS, ValueTwo: 0},
+			unix.CLONE_NEWNS | unix.CLONE_VM, retEPERM},
+	}
+
+	native := "SCMP_ARCH_X86_64"
+	nr := syscallTables[native]["getpid"]
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := seccompProfile{
+				DefaultAction: "SCMP_ACT_ERRNO",
+				Syscalls: []seccompSyscall{
+					{Names: []string{"getpid"}, Action: "SCMP_ACT_ALLOW", Args: []seccompArg{test.arg}},
+				},
+			}
+
+			args := [6]uint64{}
+			args[test.arg.Index] = test.value
+
+			got := runFilter(t, compileTest(t, profile, native, nil), unix.AUDIT_ARCH_X86_64, nr, args)
+			if got != test.want {
+				t.Errorf("%s %#x on %#x = %#x, want %#x", test.arg.Op, test.arg.Value, test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSeccompRules(t *testing.T) {
+	errno := uint32(unix.EINVAL)
+	profile := seccompProfile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Syscalls: []seccompSyscall{
+			{Names: []string{"getpid"}, Action: "SCMP_ACT_ALLOW", Args: []seccompArg{
+				{Index: 0, Op: "SCMP_CMP_EQ", Value: 1},
+				{Index: 2, Op: "SCMP_CMP_GE", Value: 10},
+			}},
+			{Name: "getpid", Action: "SCMP_ACT_ERRNO", ErrnoRet: &errno},
+			{Names: []string{"getppid", "gettid"}, Action: "SCMP_ACT_ALLOW"},
+			{Names: []string{"not_a_syscall"}, Action: "SCMP_ACT_ALLOW"},
+		},
+	}
+
+	native := "SCMP_ARCH_X86_64"
+	table := syscallTables[native]
+	filter := compileTest(t, profile, native, nil)
+
+	tests := []struct {
+		name    string
+		syscall string
+		args    [6]uint64
+		want    uint32
+	}{
+		{"all args match", "getpid", [6]uint64{1, 0, 10}, retAllow},
+		{"first arg fails", "getpid", [6]uint64{2, 0, 10}, unix.SECCOMP_RET_ERRNO | errno},
+		{"second arg fails", "getpid", [6]uint64{1, 0, 9}, unix.SECCOMP_RET_ERRNO | errno},
+		{"rule after failed args", "getppid", [6]uint64{}, retAllow},
+		{"rule with names", "gettid", [6]uint64{}, retAllow},
+		{"default action", "getuid", [6]uint64{}, retEPERM},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := runFilter(t, filter, unix.AUDIT_ARCH_X86_64, table[test.syscall], test.args)
+			if got != test.want {
+				t.Errorf("%s%v = %#x, want %#x", test.syscall, test.args, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSeccompArches(t *testing.T) {
+	tests := []struct {
+		name    string
+		native  string
+		profile seccompProfile
+		arch    uint32
+		nr      uint32
+		want    uint32
+	}{
+		{
+			name:   "native",
+			native: "SCMP_ARCH_X86_64",
+			arch:   unix.AUDIT_ARCH_X86_64,
+			nr:     syscallTables["SCMP_ARCH_X86_64"]["getpid"],
+			want:   retAllow,
+		},
+		{
+			name:   "native other syscall",
+			native: "SCMP_ARCH_X86_64",
+			arch:   unix.AUDIT_ARCH_X86_64,
+			nr:     syscallTables["SCMP_ARCH_X86"]["getpid"],
+			want:   retEPERM,
+		},
+		{
+			name:    "sub architecture",
+			native:  "SCMP_ARCH_X86_64",
+			profile: seccompProfile{Architectures: []string{"SCMP_ARCH_X86_64", "SCMP_ARCH_X86", "SCMP_ARCH_X32"}},
+			arch:    unix.AUDIT_ARCH_I386,
+			nr:      syscallTables["SCMP_ARCH_X86"]["getpid"],
+			want:    retAllow,
+		},
+		{
+			name:    "sub architecture uses its own numbers",
+			native:  "SCMP_ARCH_X86_64",
+			profile: seccompProfile{Architectures: []string{"SCMP_ARCH_X86_64", "SCMP_ARCH_X86"}},
+			arch:    unix.AUDIT_ARCH_I386,
+			nr:      syscallTables["SCMP_ARCH_X86_64"]["getpid"],
+			want:    retEPERM,
+		},
+		{
+			name:   "sub architecture not in the profile",
+			native: "SCMP_ARCH_X86_64",
+			arch:   unix.AUDIT_ARCH_I386,
+			nr:     syscallTables["SCMP_ARCH_X86"]["getpid"],
+			want:   retKill,
+		},
+		{
+			name:    "unknown architecture",
+			native:  "SCMP_ARCH_X86_64",
+			profile: seccompProfile{Architectures: []string{"SCMP_ARCH_X86"}},
+			arch:    unix.AUDIT_ARCH_AARCH64,
+			nr:      syscallTables["SCMP_ARCH_AARCH64"]["getpid"],
+			want:    retKill,
+		},
+		{
+			name:    "x32",
+			native:  "SCMP_ARCH_X86_64",
+			profile: seccompProfile{Architectures: []string{"SCMP_ARCH_X86_64", "SCMP_ARCH_X86", "SCMP_ARCH_X32"}},
+			arch:    unix.AUDIT_ARCH_X86_64,
+			nr:      x32SyscallBit | syscallTables["SCMP_ARCH_X86_64"]["getpid"],
+			want:    retEPERM,
+		},
+		{
+			name:   "arch map",
+			native: "SCMP_ARCH_AARCH64",
+			profile: seccompProfile{ArchMap: []seccompArchMap{
+				{Architecture: "SCMP_ARCH_X86_64", SubArchitectures: []string{"SCMP_ARCH_X86"}},
+				{Architecture: "SCMP_ARCH_AARCH64", SubArchitectures: []string{"SCMP_ARCH_ARM"}},
+			}},
+			arch: unix.AUDIT_ARCH_ARM,
+			nr:   syscallTables["SCMP_ARCH_ARM"]["getpid"],
+			want: retAllow,
+		},
+		{
+			name:   "arch map of another architecture",
+			native: "SCMP_ARCH_AARCH64",
+			profile: seccompProfile{ArchMap: []seccompArchMap{
+				{Architecture: "SCMP_ARCH_X86_64", SubArchitectures: []string{"SCMP_ARCH_X86"}},
+			}},
+			arch: unix.AUDIT_ARCH_I386,
+			nr:   syscallTables["SCMP_ARCH_X86"]["getpid"],
+			want: retKill,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := test.profile
+			profile.DefaultAction = "SCMP_ACT_ERRNO"
+			profile.Syscalls = []seccompSyscall{{Names: []string{"getpid"}, Action: "SCMP_ACT_ALLOW"}}
+
+			got := runFilter(t, compileTest(t, profile, test.native, nil), test.arch, test.nr, [6]uint64{})
+			if got != test.want {
+				t.Errorf("syscall %#x of arch %#x = %#x, want %#x", test.nr, test.arch, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileSeccompDefault(t *testing.T) {
+	native, ok := nativeArches[runtime.GOARCH]
+	if !ok {
+		t.Skipf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+
+	table := syscallTables[native]
+	arch := auditArches[native]
+
+	tests := []struct {
+		name    string
+		caps    []string
+		syscall string
+		args    [6]uint64
+		want    uint32
+	}{
+		{name: "allowed", syscall: "read", want: retAllow},
+		{name: "not allowed", syscall: "reboot", want: retEPERM},
+		{name: "allowed with caps", caps: []string{"CAP_SYS_BOOT"}, syscall: "reboot", want: retAllow},
+		{name: "NE", syscall: "socket", args: [6]uint64{unix.AF_INET}, want: retAllow},
+		{name: "NE equal", syscall: "socket", args: [6]uint64{unix.AF_VSOCK}, want: retEPERM},
+		{name: "EQ", syscall: "personality", args: [6]uint64{0xffffffff}, want: retAllow},
+		{name: "EQ not equal", syscall: "personality", args: [6]uint64{1}, want: retEPERM},
+		{name: "MASKED_EQ", syscall: "clone", args: [6]uint64{unix.CLONE_VM}, want: retAllow},
+		{name: "MASKED_EQ namespace", syscall: "clone", args: [6]uint64{unix.CLONE_NEWNS}, want: retEPERM},
+		{
+			name:    "MASKED_EQ namespace with caps",
+			caps:    []string{"CAP_SYS_ADMIN"},
+			syscall: "clone",
+			args:    [6]uint64{unix.CLONE_NEWNS},
+			want:    retAllow,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := CompileSeccomp("", test.caps)
+			if err != nil {
+				t.Fatalf("CompileSeccomp() error = %v", err)
+			}
+
+			got := runFilter(t, filter, arch, table[test.syscall], test.args)
+			if got != test.want {
+				t.Errorf("%s%v = %#x, want %#x", test.syscall, test.args, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Package utils contains generic helpers, utilities and structs.
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// EnvFile is the system-wide file of environment variables set in all the
+// containers, in the same format of --env-file.
+const EnvFile = "/etc/lilipod/env"
+
+// internalEnv are the environment variables used internally by lilipod, these
+// are never passed from the host to the containers.
+var internalEnv = []string{
+	"HOSTNAME",
+	"PARENT_GID_MAP",
+	"PARENT_UID_MAP",
+	"ROOTFUL",
+	"ROOTLESS_HELPER_CHILD",
+	"UNSHARED",
+}
+
+// ResolveEnv will return the environment of a container, merging in order of
+// precedence input base env, the host environment if envHost is specified,
+// input env files and input env, so that later values win.
+// Env entries are expanded as in ExpandEnv.
+func ResolveEnv(base []string, envHost bool, envFiles []string, env []string) ([]string, error) {
+	result := MergeEnv(base)
+
+	if envHost {
+		result = MergeEnv(result, HostEnv())
+	}
+
+	for _, file := range envFiles {
+		fileEnv, err := ReadEnvFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		result = MergeEnv(result, fileEnv)
+	}
+
+	expanded, err := ExpandEnv(env)
+	if err != nil {
+		return nil, err
+	}
+
+	return MergeEnv(result, expanded), nil
+}
+
+// ConfigEnv returns the environment variables of EnvFile, if present.
+func ConfigEnv() ([]string, error) {
+	_, err := os.Stat(EnvFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return ReadEnvFile(EnvFile)
+}
+
+// ExpandEnv will resolve input env entries, in the form of KEY=VALUE, KEY or PREFIX*.
+// Entries without a value take it from the host environment, and are skipped
+// if not set on the host.
+// Entries ending with * pass all the host variables starting with PREFIX.
+func ExpandEnv(env []string) ([]string, error) {
+	result := []string{}
+
+	for _, entry := range env {
+		key, _, found := strings.Cut(entry, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid environment variable %q", entry)
+		}
+
+		switch {
+		case found:
+			result = append(result, entry)
+		case strings.HasSuffix(key, "*"):
+			for _, variable := range HostEnv() {
+				if strings.HasPrefix(variable, strings.TrimSuffix(key, "*")) {
+					result = append(result, variable)
+				}
+			}
+		default:
+			value, ok := os.LookupEnv(key)
+			if ok && !isInternalEnv(key) {
+				result = append(result, key+"="+value)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ReadEnvFile will read input env file, containing one entry per line.
+// Empty lines and lines starting with # are ignored, entries are expanded
+// as in ExpandEnv.
+func ReadEnvFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	env := []string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		env = append(env, line)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ExpandEnv(env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid env file %s: %w", path, err)
+	}
+
+	return result, nil
+}
+
+// HostEnv returns the host environment, without lilipod's internal variables.
+func HostEnv() []string {
+	result := []string{}
+
+	for _, variable := range os.Environ() {
+		key, _, _ := strings.Cut(variable, "=")
+		if !isInternalEnv(key) {
+			result = append(result, variable)
+		}
+	}
+
+	return result
+}
+
+// MergeEnv will merge input envs, values of later envs replace the ones of the
+// previous envs with the same key. The order of first appearance is kept.
+func MergeEnv(envs ...[]string) []string {
+	result := []string{}
+	index := map[string]int{}
+
+	for _, env := range envs {
+		for _, variable := range env {
+			key, _, _ := strings.Cut(variable, "=")
+
+			position, ok := index[key]
+			if ok {
+				result[position] = variable
+
+				continue
+			}
+
+			index[key] = len(result)
+			result = append(result, variable)
+		}
+	}
+
+	return result
+}
+
+// UnsetEnv returns input env without the variables with input keys.
+func UnsetEnv(env []string, keys []string) []string {
+	result := []string{}
+
+	for _, variable := range env {
+		key, _, _ := strings.Cut(variable, "=")
+		if !slices.Contains(keys, key) {
+			result = append(result, variable)
+		}
+	}
+
+	return result
+}
+
+// isInternalEnv returns true if input variable is used internally by lilipod.
+func isInternalEnv(key string) bool {
+	return strings.HasPrefix(key, "LILIPOD_") || slices.Contains(internalEnv, key)
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		envs [][]string
+		want []string
+	}{
+		{
+			name: "empty",
+			envs: nil,
+			want: []string{},
+		},
+		{
+			name: "later values win",
+			envs: [][]string{{"A=1", "B=1"}, {"B=2"}, {"A=3"}},
+			want: []string{"A=3", "B=2"},
+		},
+		{
+			name: "first appearance order is kept",
+			envs: [][]string{{"B=1"}, {"A=1", "B=2", "C=1"}},
+			want: []string{"B=2", "A=1", "C=1"},
+		},
+		{
+			name: "values can contain =",
+			envs: [][]string{{"A=x=y"}, {"B=1"}},
+			want: []string{"A=x=y", "B=1"},
+		},
+		{
+			name: "duplicates in the same env",
+			envs: [][]string{{"A=1", "A=2"}},
+			want: []string{"A=2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := MergeEnv(test.envs...)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("MergeEnv(%v) = %v, want %v", test.envs, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnsetEnv(t *testing.T) {
+	got := UnsetEnv([]string{"A=1", "B=2", "AB=3"}, []string{"A"})
+	want := []string{"B=2", "AB=3"}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("UnsetEnv() = %v, want %v", got, want)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("LILIPOD_TEST_HOST", "host")
+	t.Setenv("LC_TEST_ONE", "one")
+	t.Setenv("LC_TEST_TWO", "two")
+	t.Setenv("ROOTFUL", "true")
+
+	tests := []struct {
+		name    string
+		env     []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "key and value",
+			env:  []string{"A=1", "B=x=y", "C="},
+			want: []string{"A=1", "B=x=y", "C="},
+		},
+		{
+			name: "key from host",
+			env:  []string{"LC_TEST_ONE"},
+			want: []string{"LC_TEST_ONE=one"},
+		},
+		{
+			name: "key missing on host is skipped",
+			env:  []string{"LILIPOD_TEST_MISSING_VARIABLE"},
+			want: []string{},
+		},
+		{
+			name: "internal variables are not passed",
+			env:  []string{"ROOTFUL", "LILIPOD_TEST_HOST"},
+			want: []string{},
+		},
+		{
+			name: "wildcard",
+			env:  []string{"LC_TEST_*"},
+			want: []string{"LC_TEST_ONE=one", "LC_TEST_TWO=two"},
+		},
+		{
+			name:    "missing key",
+			env:     []string{"=value"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ExpandEnv(test.env)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ExpandEnv(%v) error = %v, wantErr %v", test.env, err, test.wantErr)
+			}
+
+			// the host environment is not sorted
+			slices.Sort(got)
+
+			if !test.wantErr && !slices.Equal(got, test.want) {
+				t.Errorf("ExpandEnv(%v) = %v, want %v", test.env, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	t.Setenv("LC_TEST_ONE", "one")
+
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "entries",
+			content: "A=1\nB=x=y\n",
+			want:    []string{"A=1", "B=x=y"},
+		},
+		{
+			name:    "comments, empty lines and indentation",
+			content: "# comment\n\n  A=1\n\t# indented comment\nB=2",
+			want:    []string{"A=1", "B=2"},
+		},
+		{
+			name:    "values keep their spaces",
+			content: "A= spaced value \n",
+			want:    []string{"A= spaced value "},
+		},
+		{
+			name:    "keys from host",
+			content: "LC_TEST_ONE\nLILIPOD_TEST_MISSING_VARIABLE\n",
+			want:    []string{"LC_TEST_ONE=one"},
+		},
+		{
+			name:    "invalid entry",
+			content: "A=1\n=2\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "env")
+
+			err := os.WriteFile(path, []byte(test.content), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ReadEnvFile(path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ReadEnvFile() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if !test.wantErr && !slices.Equal(got, test.want) {
+				t.Errorf("ReadEnvFile() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	_, err := ReadEnvFile(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Error("ReadEnvFile() of a missing file should fail")
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	t.Setenv("LILIPOD_TEST_HOST", "host")
+	t.Setenv("A", "host")
+
+	path := filepath.Join(t.TempDir(), "env")
+
+	err := os.WriteFile(path, []byte("B=file\nC=file\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// config < host < env files < env
+	got, err := ResolveEnv([]string{"A=config", "B=config", "C=config", "D=config"},
+		true, []string{path}, []string{"C=env"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"A=host", "B=file", "C=env", "D=config"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("ResolveEnv() = %v, missing %s", got, want)
+		}
+	}
+
+	if slices.Contains(got, "LILIPOD_TEST_HOST=host") {
+		t.Errorf("ResolveEnv() = %v, should not contain internal variables", got)
+	}
+}
@@ -0,0 +1,182 @@
+// Package utils contains generic helpers, utilities and structs.
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// Container health states saved in the state file.
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// Actions taken when a container becomes unhealthy.
+const (
+	HealthActionNone    = "none"
+	HealthActionKill    = "kill"
+	HealthActionRestart = "restart"
+	HealthActionStop    = "stop"
+)
+
+// Healthcheck defaults, used when not set, like in docker.
+const (
+	defaultHealthInterval = time.Second * 30
+	defaultHealthTimeout  = time.Second * 30
+	defaultHealthRetries  = 3
+)
+
+// healthLogSize is the number of healthcheck results kept in the state.
+const healthLogSize = 5
+
+// healthOutputSize is the maximum size of the output saved for each healthcheck.
+const healthOutputSize = 4096
+
+// Healthcheck is the healthcheck of a container, following the image config's one.
+// Test is either ["NONE"], ["CMD", command...] or ["CMD-SHELL", command].
+// Zero durations and retries mean the defaults.
+type Healthcheck struct {
+	Test        []string      `json:"test"`
+	Interval    time.Duration `json:"interval"`
+	Timeout     time.Duration `json:"timeout"`
+	StartPeriod time.Duration `json:"startperiod"`
+	Retries     int           `json:"retries"`
+}
+
+// Health is the health of a running container, with the last healthcheck results.
+type Health struct {
+	Status        string      `json:"status"`
+	FailingStreak int         `json:"failingstreak"`
+	Log           []HealthLog `json:"log"`
+}
+
+// HealthLog is the result of a healthcheck.
+type HealthLog struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exitcode"`
+	Output   string    `json:"output"`
+}
+
+// Enabled returns true if the healthcheck has a command to run.
+func (h *Healthcheck) Enabled() bool {
+	return h != nil && len(h.Test) > 0 && h.Test[0] != "NONE"
+}
+
+// Command returns the command to run inside the container.
+func (h *Healthcheck) Command() ([]string, error) {
+	if !h.Enabled() {
+		return nil, fmt.Errorf("healthcheck is disabled")
+	}
+
+	switch {
+	case h.Test[0] == "CMD" && len(h.Test) > 1:
+		return h.Test[1:], nil
+	case h.Test[0] == "CMD-SHELL" && len(h.Test) == 2:
+		return []string{"/bin/sh", "-c", h.Test[1]}, nil
+	default:
+		return nil, fmt.Errorf("invalid healthcheck %q", h.Test)
+	}
+}
+
+// GetInterval returns the time to wait between healthchecks.
+func (h *Healthcheck) GetInterval() time.Duration {
+	if h.Interval <= 0 {
+		return defaultHealthInterval
+	}
+
+	return h.Interval
+}
+
+// GetTimeout returns the time after which a healthcheck is failed.
+func (h *Healthcheck) GetTimeout() time.Duration {
+	if h.Timeout <= 0 {
+		return defaultHealthTimeout
+	}
+
+	return h.Timeout
+}
+
+// GetRetries returns the number of consecutive failures needed to be unhealthy.
+func (h *Healthcheck) GetRetries() int {
+	if h.Retries <= 0 {
+		return defaultHealthRetries
+	}
+
+	return h.Retries
+}
+
+// MergeHealthcheck returns input base healthcheck, usually the image's one,
+// with the fields set in input override. A nil override returns base.
+func MergeHealthcheck(base, override *Healthcheck) *Healthcheck {
+	if base == nil || override == nil {
+		if override != nil {
+			return override
+		}
+
+		return base
+	}
+
+	result := *base
+
+	if len(override.Test) > 0 {
+		result.Test = override.Test
+	}
+
+	if override.Interval > 0 {
+		result.Interval = override.Interval
+	}
+
+	if override.Timeout > 0 {
+		result.Timeout = override.Timeout
+	}
+
+	if override.StartPeriod > 0 {
+		result.StartPeriod = override.StartPeriod
+	}
+
+	if override.Retries > 0 {
+		result.Retries = override.Retries
+	}
+
+	return &result
+}
+
+// RecordHealth will save input healthcheck result in the state, updating the
+// container's health following input healthcheck:
+//   - a successful check makes the container healthy
+//   - failed checks during the start period are not counted while starting
+//   - the container becomes unhealthy after Retries consecutive failed checks
+func (state *State) RecordHealth(check Healthcheck, result HealthLog) {
+	if state.Health == nil {
+		state.Health = &Health{Status: HealthStarting}
+	}
+
+	if len(result.Output) > healthOutputSize {
+		result.Output = result.Output[:healthOutputSize]
+	}
+
+	state.Health.Log = append(state.Health.Log, result)
+	if len(state.Health.Log) > healthLogSize {
+		state.Health.Log = state.Health.Log[len(state.Health.Log)-healthLogSize:]
+	}
+
+	if result.ExitCode == 0 {
+		state.Health.Status = HealthHealthy
+		state.Health.FailingStreak = 0
+
+		return
+	}
+
+	if state.Health.Status == HealthStarting && result.Start.Sub(state.StartedAt) < check.StartPeriod {
+		return
+	}
+
+	state.Health.FailingStreak++
+
+	if state.Health.FailingStreak >= check.GetRetries() {
+		state.Health.Status = HealthUnhealthy
+	}
+}
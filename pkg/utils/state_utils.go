@@ -0,0 +1,177 @@
+// Package utils contains generic helpers, utilities and structs.
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/89luca89/lilipod/pkg/logging"
+)
+
+// Container states saved in the state file.
+const (
+	StateCreated    = "created"
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateExited     = "exited"
+)
+
+// StateStopped is not saved, it is accepted as a status filter, for containers
+// that are either created or exited.
+const StateStopped = "stopped"
+
+// State is a struct that holds the runtime information of a container,
+// it is saved next to the container's config and updated at start and exit.
+//
+// Pid and StartTime identify the container's init process on the host,
+// StartTime is the one found in /proc/PID/stat, so that a reused pid is
+// not mistaken for the container.
+//
+// ExitCode and Signal are the ones of the last run, a container killed by a
+// signal has exit code 128+signal. UserTime, SystemTime and MaxRSS (in KiB)
+// are the resources used by the container's processes in the last run.
+//
+// MonitorPid is the process supervising the container, RestartCount the number
+// of times it restarted the container following its restart policy, and
+// StoppedByUser is set by stop, so that the container is not restarted.
+// Health is the health of containers with a healthcheck, while running.
+type State struct {
+	Status     string        `json:"status"`
+	Pid        int           `json:"pid"`
+	StartTime  uint64        `json:"starttime"`
+	ExitCode   int           `json:"exitcode"`
+	Signal     int           `json:"signal"`
+	StartedAt  time.Time     `json:"startedat"`
+	FinishedAt time.Time     `json:"finishedat"`
+	UserTime   time.Duration `json:"usertime"`
+	SystemTime time.Duration `json:"systemtime"`
+	MaxRSS     int64         `json:"maxrss"`
+
+	MonitorPid    int  `json:"monitorpid"`
+	RestartCount  int  `json:"restartcount"`
+	StoppedByUser bool `json:"stoppedbyuser"`
+
+	Health *Health `json:"health,omitempty"`
+}
+
+// HumanStatus returns a human readable description of the state, like
+// "Up 3 minutes (healthy)", "Restarting (1) 2 seconds ago" or "Exited (0) 3 minutes ago".
+func (state State) HumanStatus() string {
+	switch state.Status {
+	case StateRunning:
+		status := "Up"
+		if !state.StartedAt.IsZero() {
+			status += " " + HumanDuration(time.Since(state.StartedAt))
+		}
+
+		switch {
+		case state.Health == nil:
+		case state.Health.Status == HealthStarting:
+			status += " (health: starting)"
+		default:
+			status += " (" + state.Health.Status + ")"
+		}
+
+		if state.RestartCount > 0 {
+			status += fmt.Sprintf(" (restarts: %d)", state.RestartCount)
+		}
+
+		return status
+	case StateRestarting:
+		return fmt.Sprintf("Restarting (%d) %s ago", state.ExitCode, HumanDuration(time.Since(state.FinishedAt)))
+	case StateExited:
+		if state.FinishedAt.IsZero() {
+			return "Exited"
+		}
+
+		return fmt.Sprintf("Exited (%d) %s ago", state.ExitCode, HumanDuration(time.Since(state.FinishedAt)))
+	default:
+		return "Created"
+	}
+}
+
+// LoadState loads a state from file to state struct.
+// The file is read holding a shared lock, so that partial writes are never seen.
+func LoadState(path string) (State, error) {
+	state := State{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return state, err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return state, err
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(content, &state)
+
+	return state, err
+}
+
+// UpdateState will apply input update function to the state saved in path,
+// holding an exclusive lock for the whole read-modify-write.
+// A missing state file is created, starting from an empty state.
+func UpdateState(path string, update func(state *State)) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return err
+	}
+
+	state := State{}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	if len(content) > 0 {
+		err = json.Unmarshal(content, &state)
+		if err != nil {
+			logging.LogWarning("invalid state file %s, resetting it", path)
+
+			state = State{}
+		}
+	}
+
+	update(&state)
+
+	content, err = json.MarshalIndent(state, "", " ")
+	if err != nil {
+		return err
+	}
+
+	err = file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteAt(content, 0)
+
+	return err
+}
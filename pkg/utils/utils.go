@@ -2,13 +2,17 @@
 package utils
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/89luca89/lilipod/pkg/cgrouputils"
 	"github.com/89luca89/lilipod/pkg/constants"
 	"github.com/89luca89/lilipod/pkg/fileutils"
 	"github.com/89luca89/lilipod/pkg/logging"
@@ -23,30 +27,66 @@ import (
 // oci-registry and images compliant, but doesn't need
 // to create oci-compliant containers.
 type Config struct {
-	Env        []string          `json:"env"`
-	Cgroup     string            `json:"cgroup"`
-	Created    string            `json:"created"`
-	Gidmap     string            `json:"gidmap"`
-	Hostname   string            `json:"hostname"`
-	ID         string            `json:"id"`
-	Image      string            `json:"image"`
-	Ipc        string            `json:"ipc"`
-	Names      string            `json:"names"`
-	Network    string            `json:"network"`
-	Pid        string            `json:"pid"`
-	Privileged bool              `json:"privileged"`
-	Size       string            `json:"size"`
-	Status     string            `json:"status"`
-	Time       string            `json:"time"`
-	Uidmap     string            `json:"uidmap"`
-	User       string            `json:"user"`
-	Userns     string            `json:"userns"`
-	Workdir    string            `json:"workdir"`
-	Stopsignal string            `json:"stopsignal"`
-	Mounts     []string          `json:"mounts"`
-	Labels     map[string]string `json:"labels"`
+	AutoRemove  bool              `json:"autoremove"`
+	Env         []string          `json:"env"`
+	Unsetenv    []string          `json:"unsetenv"`
+	Cgroup      string            `json:"cgroup"`
+	Created     string            `json:"created"`
+	Gidmap      string            `json:"gidmap"`
+	Hostname    string            `json:"hostname"`
+	ID          string            `json:"id"`
+	Image       string            `json:"image"`
+	Init        bool              `json:"init"`
+	Rootfs      string            `json:"rootfs"`
+	Ipc         string            `json:"ipc"`
+	Names       string            `json:"names"`
+	Network     string            `json:"network"`
+	Passwd      bool              `json:"passwd"`
+	Sudo        bool              `json:"sudo"`
+	Pid         string            `json:"pid"`
+	Privileged  bool              `json:"privileged"`
+	Restart     string            `json:"restart"`
+	Size        string            `json:"size"`
+	Status      string            `json:"status"`
+	State       *State            `json:"state,omitempty"`
+	Systemd     string            `json:"systemd"`
+	Time        string            `json:"time"`
+	TimeOffsets map[string]int64  `json:"timeoffsets"`
+	Uidmap      string            `json:"uidmap"`
+	User        string            `json:"user"`
+	GroupAdd    []string          `json:"groupadd"`
+	Userns      string            `json:"userns"`
+	Workdir     string            `json:"workdir"`
+	Stopsignal  string            `json:"stopsignal"`
+	StopTimeout *int              `json:"stoptimeout,omitempty"`
+	Mounts      []string          `json:"mounts"`
+	Labels      map[string]string `json:"labels"`
+	LogMaxSize  int64             `json:"logmaxsize"`
+	LogMaxFiles int               `json:"logmaxfiles"`
 	// entry point related
 	Entrypoint []string `json:"entrypoint"`
+	// health related
+	Healthcheck     *Healthcheck `json:"healthcheck,omitempty"`
+	HealthOnFailure string       `json:"healthonfailure"`
+	// process related
+	Ulimits     []string          `json:"ulimits"`
+	Sysctls     map[string]string `json:"sysctls"`
+	Umask       string            `json:"umask"`
+	OomScoreAdj *int              `json:"oomscoreadj,omitempty"`
+	Timezone    string            `json:"timezone"`
+	// resources related
+	Resources *cgrouputils.Resources `json:"resources,omitempty"`
+	// security related
+	SecurityOpt     []string `json:"securityopt"`
+	Seccomp         string   `json:"seccomp"`
+	Landlock        string   `json:"landlock"`
+	LandlockABI     int      `json:"landlockabi"`
+	NoNewPrivileges bool     `json:"nonewprivileges"`
+	Mask            []string `json:"mask"`
+	Unmask          []string `json:"unmask"`
+	Capabilities    []string `json:"capabilities"`
+	CapAdd          []string `json:"capadd"`
+	CapDrop         []string `json:"capdrop"`
 }
 
 // GetDefaultTable returns the default table style we use to print out tables.
@@ -171,6 +211,26 @@ func GetLilipodHome() string {
 	return filepath.Join(os.Getenv("HOME"), ".local/share/lilipod")
 }
 
+// GetLilipodRuntimeDir will return where the program will save runtime files,
+// like the console sockets, whose paths are limited in length.
+// This function will return /run/lilipod when rootful, else search the environment or:
+//
+// XDG_RUNTIME_DIR
+// LILIPOD_HOME, XDG_DATA_HOME or HOME, see GetLilipodHome
+//
+// These variable are searched in this order.
+func GetLilipodRuntimeDir() string {
+	if os.Getenv("ROOTFUL") == constants.TrueString {
+		return "/run/lilipod"
+	}
+
+	if os.Getenv("XDG_RUNTIME_DIR") != "" {
+		return filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "lilipod")
+	}
+
+	return filepath.Join(GetLilipodHome(), "run")
+}
+
 // EnsureUNIXDependencies will link the missing utility to internally managed busybox binary.
 // If the binary does not exist, download it first.
 // Hard dependencies include:
@@ -236,9 +296,15 @@ func EnsureUNIXDependencies(ptyAgent []byte, busybox []byte) error {
 
 	logging.LogDebug("ensuring agent pty")
 
-	_, err := os.Stat(filepath.Join(LilipodBinPath, "pty"))
-	if err != nil {
+	// the agent is refreshed when it does not match the one we ship, so that
+	// upgrading lilipod also upgrades it
+	agentDigest := fmt.Sprintf("%x", sha256.Sum256(ptyAgent))
+
+	installedDigest, err := fileutils.ReadFile(filepath.Join(LilipodBinPath, "pty.sha256"))
+	if err != nil || !fileutils.Exist(filepath.Join(LilipodBinPath, "pty")) ||
+		strings.TrimSpace(string(installedDigest)) != agentDigest {
 		_ = os.MkdirAll(LilipodBinPath, os.ModePerm)
+		_ = os.Remove(filepath.Join(LilipodBinPath, "pty"))
 
 		logging.LogWarning("failed to find dependency 'pty agent', will inject it")
 
@@ -263,6 +329,11 @@ func EnsureUNIXDependencies(ptyAgent []byte, busybox []byte) error {
 		logging.LogDebug("cleanup pty agent archive")
 
 		_ = os.Remove(filepath.Join(LilipodBinPath, "pty.tar.gz"))
+
+		err = fileutils.WriteFile(filepath.Join(LilipodBinPath, "pty.sha256"), []byte(agentDigest), 0o644)
+		if err != nil {
+			logging.LogDebug("cannot save agent digest: %v", err)
+		}
 	}
 
 	_ = os.MkdirAll(filepath.Join(GetLilipodHome(), "volumes"), os.ModePerm)
@@ -300,6 +371,129 @@ func setupBusybox(busybox []byte, dependencies []string) error {
 	return nil
 }
 
+// ParseRestartPolicy will parse input restart policy, in the form of
+// no, on-failure[:N], always or unless-stopped, returning the policy and the
+// maximum number of restarts for on-failure, 0 meaning no limit.
+// An empty policy is the same as no.
+func ParseRestartPolicy(input string) (string, int, error) {
+	policy, retries, found := strings.Cut(input, ":")
+
+	switch policy {
+	case "", constants.RestartNo:
+		policy = constants.RestartNo
+	case constants.RestartAlways, constants.RestartUnlessStopped:
+	case constants.RestartOnFailure:
+		if !found {
+			return policy, 0, nil
+		}
+
+		maxRetries, err := strconv.Atoi(retries)
+		if err != nil || maxRetries < 0 {
+			return "", 0, fmt.Errorf("invalid restart policy %q, invalid maximum retries", input)
+		}
+
+		return policy, maxRetries, nil
+	default:
+		return "", 0, fmt.Errorf("invalid restart policy %q, use one of no, on-failure[:N], always, unless-stopped", input)
+	}
+
+	if found {
+		return "", 0, fmt.Errorf("invalid restart policy %q, maximum retries are only valid with on-failure", input)
+	}
+
+	return policy, 0, nil
+}
+
+// ParseSize will parse a human readable size like 10m or 1GB into bytes,
+// k, m and g suffixes are powers of 1024.
+func ParseSize(input string) (int64, error) {
+	units := map[string]int64{
+		"":  1,
+		"k": 1 << 10,
+		"m": 1 << 20,
+		"g": 1 << 30,
+	}
+
+	size := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(input)), "b")
+	number := strings.TrimRight(size, "kmg")
+
+	unit, ok := units[strings.TrimPrefix(size, number)]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+
+	return value * unit, nil
+}
+
+// ParseLogOptions will parse input log options, in the form of max-size=SIZE
+// and max-file=N, returning the size after which the logs are rotated and the
+// number of rotated files to keep.
+func ParseLogOptions(options []string) (int64, int, error) {
+	var maxSize int64
+
+	maxFiles := 1
+
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+
+		var err error
+
+		switch key {
+		case "max-size":
+			maxSize, err = ParseSize(value)
+		case "max-file":
+			maxFiles, err = strconv.Atoi(value)
+			if err == nil && maxFiles < 1 {
+				err = fmt.Errorf("max-file must be at least 1")
+			}
+		default:
+			err = fmt.Errorf("unsupported log option %s", key)
+		}
+
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid log option %q: %w", option, err)
+		}
+	}
+
+	return maxSize, maxFiles, nil
+}
+
+// HumanDuration returns a human readable approximation of input duration,
+// like "3 minutes" or "About an hour".
+func HumanDuration(duration time.Duration) string {
+	seconds := int(duration.Seconds())
+
+	switch hours := int(duration.Hours()); {
+	case seconds < 1:
+		return "Less than a second"
+	case seconds == 1:
+		return "1 second"
+	case seconds < 60:
+		return fmt.Sprintf("%d seconds", seconds)
+	case seconds < 120:
+		return "About a minute"
+	case int(duration.Minutes()) < 60:
+		return fmt.Sprintf("%d minutes", int(duration.Minutes()))
+	case hours < 2:
+		return "About an hour"
+	case hours < 48:
+		return fmt.Sprintf("%d hours", hours)
+	case hours < 24*14:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours < 24*60:
+		return fmt.Sprintf("%d weeks", hours/24/7)
+	case hours < 24*365*2:
+		return fmt.Sprintf("%d months", hours/24/30)
+	default:
+		return fmt.Sprintf("%d years", hours/24/365)
+	}
+}
+
 func MapToList(input map[string]string) []string {
 	result := []string{}
 
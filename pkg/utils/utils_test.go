@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/89luca89/lilipod/pkg/constants"
+)
+
+func TestParseRestartPolicy(t *testing.T) {
+	tests := []struct {
+		input       string
+		wantPolicy  string
+		wantRetries int
+		wantErr     bool
+	}{
+		{input: "", wantPolicy: constants.RestartNo},
+		{input: "no", wantPolicy: constants.RestartNo},
+		{input: "always", wantPolicy: constants.RestartAlways},
+		{input: "unless-stopped", wantPolicy: constants.RestartUnlessStopped},
+		{input: "on-failure", wantPolicy: constants.RestartOnFailure},
+		{input: "on-failure:0", wantPolicy: constants.RestartOnFailure},
+		{input: "on-failure:5", wantPolicy: constants.RestartOnFailure, wantRetries: 5},
+		{input: "on-failure:", wantErr: true},
+		{input: "on-failure:-1", wantErr: true},
+		{input: "on-failure:x", wantErr: true},
+		{input: "always:3", wantErr: true},
+		{input: "no:1", wantErr: true},
+		{input: "sometimes", wantErr: true},
+		{input: "Always", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			policy, retries, err := ParseRestartPolicy(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseRestartPolicy(%q) error = %v, wantErr %v", test.input, err, test.wantErr)
+			}
+
+			if test.wantErr {
+				return
+			}
+
+			if policy != test.wantPolicy || retries != test.wantRetries {
+				t.Errorf("ParseRestartPolicy(%q) = %s, %d, want %s, %d",
+					test.input, policy, retries, test.wantPolicy, test.wantRetries)
+			}
+		})
+	}
+}
@@ -1,19 +1,77 @@
 // Package main of ptyagent. This program is used to run input process instantiating
 // a working PTY.
+//
+// Usage:
+//
+//	pty [--uid UID] [--gid GID] [--groups GID,GID...] [--umask MASK] [--rlimit RESOURCE=SOFT:HARD...]
+//	    [--oom-score-adj SCORE] [--cap-bounding CAP,CAP...] [--cap-ambient CAP,CAP...]
+//	    [--landlock ACCESS] [--landlock-rule ACCESS=PATH...] [--seccomp FILTER] [--no-new-privileges]
+//	    [--no-tty] [--init] [--] command [args...]
+//
+// If uid, gid or groups are specified, the command is executed with said credentials.
+// If umask, rlimit or oom-score-adj are specified, they are set before switching
+// credentials, and inherited by the command. Rlimit resources are numeric, and can
+// be repeated.
+// If cap-bounding is specified, the capabilities not listed, by number, are dropped
+// from the bounding set. If cap-ambient is specified, the listed ones are kept by
+// the command as ambient capabilities, after switching to a non-root user.
+// If landlock is specified, a landlock ruleset handling said access rights, by number,
+// is applied after them, allowing the rules' access rights beneath their paths.
+// Rules can be repeated, and the ones of missing paths are skipped.
+// If seccomp is specified, the base64 encoded BPF filter is installed after them,
+// while still privileged, and applies to the agent and the command.
+// If --no-new-privileges is specified, the command can't gain privileges, like
+// through setuid binaries.
+// If --no-tty is specified, no PTY is created and the agent is replaced by the command.
+// If --init is specified, the agent is kept as the init of the container, even
+// without PTY: it reaps the orphaned processes, forwards the signals it receives
+// to the command's process group, and exits with the command's exit status.
 package main
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 var version = "development"
 
+func init() {
+	// keep main on the main thread, as capabilities are per thread, and the
+	// command is started from it
+	runtime.LockOSThread()
+}
+
+// options are the flags accepted by the agent before the command.
+type options struct {
+	credential  *syscall.Credential
+	umask       *int
+	rlimits     map[int]unix.Rlimit
+	oomScoreAdj *int
+	bounding    []uintptr
+	setBounding bool
+	ambient     []uintptr
+	landlock    uint64
+	rules       map[string]uint64
+	seccomp     []unix.SockFilter
+	noNewPrivs  bool
+	noTTY       bool
+	init        bool
+}
+
 func main() {
 	if os.Args[1] == "version" {
 		fmt.Println(version)
@@ -21,6 +79,40 @@ func main() {
 		return
 	}
 
+	opts, args, err := parseArgs(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(args) == 0 {
+		log.Fatal("no command specified")
+	}
+
+	err = setupProcess(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.noTTY && !opts.init {
+		err = execCommand(opts, args)
+
+		log.Fatal(err)
+	}
+
+	if opts.noTTY {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential:  opts.credential,
+			AmbientCaps: opts.ambient,
+			Setpgid:     true,
+		}
+
+		os.Exit(runInit(cmd))
+	}
+
 	pty, err := createPty()
 	if err != nil {
 		log.Fatal(err)
@@ -31,11 +123,19 @@ func main() {
 		log.Fatal(err)
 	}
 
-	cmd := exec.Command(os.Args[1], os.Args[2:]...)
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
 	cmd.SysProcAttr.Setctty = true
 	cmd.SysProcAttr.Setsid = true
 	cmd.SysProcAttr.Pdeathsig = syscall.SIGTERM
+	cmd.SysProcAttr.AmbientCaps = opts.ambient
+
+	if opts.credential != nil {
+		cmd.SysProcAttr.Credential = opts.credential
+
+		// let the user own its terminal
+		_ = pty.slave.Chown(int(opts.credential.Uid), int(opts.credential.Gid))
+	}
 
 	if cmd.Stdout == nil {
 		cmd.Stdout = pty.Stdout()
@@ -49,24 +149,30 @@ func main() {
 		cmd.Stdin = pty.Stdin()
 	}
 
+	if opts.init {
+		code := runInit(cmd)
+
+		pty.Terminate()
+		os.Exit(code)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		pty.Terminate()
+
+		log.Fatal(err)
+	}
+
+	// forward signals to the command, so that they reach the real workload
 	channel := make(chan os.Signal, 1)
-	signal.Notify(channel, os.Interrupt,
-		syscall.SIGHUP,
-		syscall.SIGTERM,
-		syscall.SIGINT)
+	signal.Notify(channel)
 
-	go func() {
-		<-channel
+	go forwardSignals(channel, cmd.Process.Pid)
 
-		if pty != nil {
-			pty.Terminate()
-			pty = nil
-		}
+	err = cmd.Wait()
 
-		_ = cmd.Process.Signal(syscall.SIGKILL)
-	}()
+	signal.Stop(channel)
 
-	err = cmd.Run()
 	if err != nil {
 		if pty != nil {
 			pty.Terminate()
@@ -75,6 +181,11 @@ func main() {
 
 		var exiterr *exec.ExitError
 		if errors.As(err, &exiterr) {
+			status, ok := exiterr.Sys().(syscall.WaitStatus)
+			if ok && status.Signaled() {
+				os.Exit(128 + int(status.Signal()))
+			}
+
 			os.Exit(exiterr.ExitCode())
 		}
 
@@ -86,3 +197,535 @@ func main() {
 		pty = nil
 	}
 }
+
+// forwardSignals will send the signals received on channel to input pid, or
+// process group if negative.
+// Signals related to the agent itself, like SIGCHLD, SIGWINCH or the ones used
+// by the go runtime, are not forwarded.
+func forwardSignals(channel chan os.Signal, pid int) {
+	for sig := range channel {
+		switch sig {
+		case syscall.SIGCHLD, syscall.SIGPIPE, syscall.SIGURG, syscall.SIGWINCH:
+			continue
+		}
+
+		signum, ok := sig.(syscall.Signal)
+		if ok {
+			_ = syscall.Kill(pid, signum)
+		}
+	}
+}
+
+// runInit will run input command with the agent as init: the orphaned processes
+// are reaped, the signals received are forwarded to the command's process group,
+// and the command's exit code is returned once it exits, like shells do.
+// The command must be started in its own process group.
+func runInit(cmd *exec.Cmd) int {
+	// without a private pid namespace we are not pid 1, adopt orphans anyway
+	_ = unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0)
+
+	children := make(chan os.Signal, 1)
+	signal.Notify(children, syscall.SIGCHLD)
+
+	channel := make(chan os.Signal, 1)
+	signal.Notify(channel)
+
+	err := cmd.Start()
+	if err != nil {
+		log.Print(err)
+
+		return 1
+	}
+
+	go forwardSignals(channel, -cmd.Process.Pid)
+
+	status := reap(cmd.Process.Pid, children)
+
+	signal.Stop(channel)
+	signal.Stop(children)
+
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return status.ExitStatus()
+}
+
+// reap will wait for all our children, as they exit or are orphaned and
+// reparented to us, until input pid exits, returning its wait status.
+func reap(pid int, children chan os.Signal) syscall.WaitStatus {
+	for {
+		for {
+			var status syscall.WaitStatus
+
+			child, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+
+			if err != nil || child <= 0 {
+				break
+			}
+
+			if child == pid {
+				return status
+			}
+		}
+
+		<-children
+	}
+}
+
+// parseArgs will split input arguments in the agent options and the command to run.
+// Options are only parsed until the first non-option argument or "--".
+func parseArgs(args []string) (options, []string, error) {
+	opts := options{}
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		flag := args[0]
+		args = args[1:]
+
+		switch flag {
+		case "--":
+			return opts, args, nil
+		case "--no-new-privileges":
+			opts.noNewPrivs = true
+		case "--no-tty":
+			opts.noTTY = true
+		case "--init":
+			opts.init = true
+		case "--umask", "--rlimit", "--oom-score-adj", "--cap-bounding", "--cap-ambient",
+			"--landlock", "--landlock-rule", "--seccomp":
+			if len(args) == 0 {
+				return opts, nil, fmt.Errorf("missing value for %s", flag)
+			}
+
+			value := args[0]
+			args = args[1:]
+
+			err := setProcessOption(&opts, flag, value)
+			if err != nil {
+				return opts, nil, err
+			}
+		case "--uid", "--gid", "--groups":
+			if len(args) == 0 {
+				return opts, nil, fmt.Errorf("missing value for %s", flag)
+			}
+
+			value := args[0]
+			args = args[1:]
+
+			if opts.credential == nil {
+				opts.credential = &syscall.Credential{}
+			}
+
+			err := setCredential(opts.credential, flag, value)
+			if err != nil {
+				return opts, nil, err
+			}
+		default:
+			return opts, nil, fmt.Errorf("unknown option %s", flag)
+		}
+	}
+
+	return opts, args, nil
+}
+
+// setProcessOption will set input process option's flag to value.
+func setProcessOption(opts *options, flag, value string) error {
+	switch flag {
+	case "--umask":
+		umask, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid umask %s: %w", value, err)
+		}
+
+		mask := int(umask)
+		opts.umask = &mask
+	case "--oom-score-adj":
+		score, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid oom score adjustment %s: %w", value, err)
+		}
+
+		opts.oomScoreAdj = &score
+	case "--cap-bounding", "--cap-ambient":
+		caps, err := parseCaps(value)
+		if err != nil {
+			return err
+		}
+
+		if flag == "--cap-ambient" {
+			opts.ambient = caps
+		} else {
+			opts.bounding = caps
+			opts.setBounding = true
+		}
+	case "--landlock":
+		access, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid landlock access %s: %w", value, err)
+		}
+
+		opts.landlock = access
+	case "--landlock-rule":
+		access, path, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("invalid landlock rule %s", value)
+		}
+
+		allowed, err := strconv.ParseUint(access, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid landlock rule %s: %w", value, err)
+		}
+
+		if opts.rules == nil {
+			opts.rules = map[string]uint64{}
+		}
+
+		opts.rules[path] |= allowed
+	case "--seccomp":
+		content, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(content) == 0 || len(content)%8 != 0 {
+			return errors.New("invalid seccomp filter")
+		}
+
+		opts.seccomp = make([]unix.SockFilter, len(content)/8)
+
+		_, err = binary.Decode(content, binary.NativeEndian, opts.seccomp)
+		if err != nil {
+			return fmt.Errorf("invalid seccomp filter: %w", err)
+		}
+	default:
+		resource, limits, ok := strings.Cut(value, "=")
+		soft, hard, found := strings.Cut(limits, ":")
+
+		if !ok || !found {
+			return fmt.Errorf("invalid rlimit %s", value)
+		}
+
+		res, err := strconv.Atoi(resource)
+		if err != nil {
+			return fmt.Errorf("invalid rlimit %s: %w", value, err)
+		}
+
+		limit := unix.Rlimit{}
+
+		limit.Cur, err = strconv.ParseUint(soft, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid rlimit %s: %w", value, err)
+		}
+
+		limit.Max, err = strconv.ParseUint(hard, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid rlimit %s: %w", value, err)
+		}
+
+		if opts.rlimits == nil {
+			opts.rlimits = map[int]unix.Rlimit{}
+		}
+
+		opts.rlimits[res] = limit
+	}
+
+	return nil
+}
+
+// setupProcess will apply the process options to the agent, so that they are
+// inherited by the command. This is done before switching credentials, as
+// raising limits requires privileges.
+func setupProcess(opts options) error {
+	for resource, limit := range opts.rlimits {
+		err := unix.Setrlimit(resource, &limit)
+		if err != nil {
+			return fmt.Errorf("cannot set rlimit %d: %w", resource, err)
+		}
+	}
+
+	if opts.oomScoreAdj != nil {
+		err := os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(*opts.oomScoreAdj)), 0o644)
+		if err != nil {
+			return fmt.Errorf("cannot set oom score adjustment: %w", err)
+		}
+	}
+
+	if opts.umask != nil {
+		syscall.Umask(*opts.umask)
+	}
+
+	if opts.setBounding {
+		err := dropBounding(opts.bounding)
+		if err != nil {
+			return fmt.Errorf("cannot drop bounding capabilities: %w", err)
+		}
+	}
+
+	if opts.landlock != 0 {
+		err := applyLandlock(opts.landlock, opts.rules)
+		if err != nil {
+			return fmt.Errorf("cannot apply landlock ruleset: %w", err)
+		}
+	}
+
+	if opts.seccomp != nil {
+		prog := unix.SockFprog{Len: uint16(len(opts.seccomp)), Filter: &opts.seccomp[0]}
+
+		tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+			unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+		if errno != 0 {
+			return fmt.Errorf("cannot install seccomp filter: %w", errno)
+		}
+
+		if tid != 0 {
+			return fmt.Errorf("cannot install seccomp filter: cannot synchronize thread %d", tid)
+		}
+	}
+
+	if opts.noNewPrivs {
+		err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		if err != nil {
+			return fmt.Errorf("cannot set no new privileges: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// parseCaps will parse input comma separated capabilities numbers.
+func parseCaps(value string) ([]uintptr, error) {
+	caps := []uintptr{}
+
+	for _, item := range strings.Split(value, ",") {
+		if item == "" {
+			continue
+		}
+
+		c, err := strconv.ParseUint(item, 10, 6)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capability %s: %w", item, err)
+		}
+
+		caps = append(caps, uintptr(c))
+	}
+
+	return caps, nil
+}
+
+// dropBounding will drop from the bounding set the capabilities not in input ones.
+func dropBounding(caps []uintptr) error {
+	content, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return err
+	}
+
+	last, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return err
+	}
+
+	for c := uintptr(0); c <= uintptr(last); c++ {
+		if slices.Contains(caps, c) {
+			continue
+		}
+
+		err = unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// raiseAmbient will set input capabilities as the only permitted, effective,
+// inheritable and ambient ones, like the go runtime does for AmbientCaps.
+// Only the permitted ones are raised, kept with PR_SET_KEEPCAPS when switching user.
+func raiseAmbient(caps []uintptr) error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	current := [2]unix.CapUserData{}
+
+	err := unix.Capget(&header, &current[0])
+	if err != nil {
+		return err
+	}
+
+	// capabilities missing from our bounding set can't be raised
+	permitted := []uintptr{}
+	data := [2]unix.CapUserData{}
+
+	for _, c := range caps {
+		if current[c/32].Permitted&(1<<(c%32)) == 0 {
+			continue
+		}
+
+		permitted = append(permitted, c)
+		data[c/32].Permitted |= 1 << (c % 32)
+		data[c/32].Effective |= 1 << (c % 32)
+		data[c/32].Inheritable |= 1 << (c % 32)
+	}
+
+	err = unix.Capset(&header, &data[0])
+	if err != nil {
+		return err
+	}
+
+	for _, c := range permitted {
+		err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c, 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyLandlock will restrict the agent, and the command, to input rules, denying
+// the handled access rights elsewhere. Only file access rights are allowed on files.
+func applyLandlock(handled uint64, rules map[string]uint64) error {
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+
+	defer unix.Close(int(fd))
+
+	for path, access := range rules {
+		err := addLandlockRule(int(fd), path, access)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	_, _, errno = unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// addLandlockRule will add input rule to the ruleset fd, skipping missing paths.
+func addLandlockRule(fd int, path string, access uint64) error {
+	pathFd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(pathFd)
+
+	stat := unix.Stat_t{}
+
+	err = unix.Fstat(pathFd, &stat)
+	if err != nil {
+		return err
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+			unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+			unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+
+	if access == 0 {
+		return nil
+	}
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(pathFd)}
+
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(fd),
+		unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// setCredential will set input credential's flag to value.
+func setCredential(credential *syscall.Credential, flag, value string) error {
+	if flag == "--groups" {
+		credential.Groups = []uint32{}
+
+		for _, group := range strings.Split(value, ",") {
+			if group == "" {
+				continue
+			}
+
+			gid, err := strconv.ParseUint(group, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid group %s: %w", group, err)
+			}
+
+			credential.Groups = append(credential.Groups, uint32(gid))
+		}
+
+		return nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid value %s for %s: %w", value, flag, err)
+	}
+
+	if flag == "--uid" {
+		credential.Uid = uint32(id)
+	} else {
+		credential.Gid = uint32(id)
+	}
+
+	return nil
+}
+
+// execCommand will replace the agent with input command, after switching to
+// the requested credentials.
+func execCommand(opts options, args []string) error {
+	if opts.credential != nil {
+		groups := []int{}
+		for _, group := range opts.credential.Groups {
+			groups = append(groups, int(group))
+		}
+
+		err := syscall.Setgroups(groups)
+		if err != nil {
+			return err
+		}
+
+		err = syscall.Setgid(int(opts.credential.Gid))
+		if err != nil {
+			return err
+		}
+
+		if len(opts.ambient) > 0 {
+			err = unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = syscall.Setuid(int(opts.credential.Uid))
+		if err != nil {
+			return err
+		}
+
+		if len(opts.ambient) > 0 {
+			err = raiseAmbient(opts.ambient)
+			if err != nil {
+				return fmt.Errorf("cannot set ambient capabilities: %w", err)
+			}
+		}
+	}
+
+	command, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(command, args, os.Environ())
+}